@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AdminRole decides which admin routes an admin user may call, every role includes the ones before it
+type AdminRole string
+
+const (
+	// AdminRoleViewer may read the fleet, keys and settings
+	AdminRoleViewer AdminRole = "viewer"
+	// AdminRoleOperator may additionally manage servers, pairings, proxies and revoke tokens
+	AdminRoleOperator AdminRole = "operator"
+	// AdminRoleAdmin may additionally change tiers, revoke signing keys and manage admin users
+	AdminRoleAdmin AdminRole = "admin"
+)
+
+// adminRoles lists the roles from least to most privileged
+var adminRoles = []AdminRole{AdminRoleViewer, AdminRoleOperator, AdminRoleAdmin}
+
+// IsValid reports whether the role exists
+func (r AdminRole) IsValid() bool {
+	return slices.Contains(adminRoles, r)
+}
+
+// Includes reports whether the role grants everything required grants
+func (r AdminRole) Includes(required AdminRole) bool {
+	return r.IsValid() && slices.Index(adminRoles, r) >= slices.Index(adminRoles, required)
+}
+
+// AdminUser is a person or tool calling the admin routes with its own API key.
+// Only the hash of the key is stored.
+type AdminUser struct {
+	ID string
+	// Hash is the hex encoded SHA-256 of the API key
+	Hash      string
+	Name      string
+	Role      AdminRole
+	CreatedAt time.Time
+}
+
+// adminIdentity is the caller of an admin route
+type adminIdentity struct {
+	// Name identifies the caller in logs, "admin secret" for requests authenticated with ZDVV_ADMIN_SECRET
+	Name string
+	Role AdminRole
+}
+
+// adminIdentityKey is the context key of the authenticated adminIdentity
+type adminIdentityKey struct{}
+
+// newAdminUser creates a random API key for an admin user, returning it with its stored state
+func newAdminUser(name string, role AdminRole) (string, *AdminUser, error) {
+	apiKey, err := randomSecret(32)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := randomSecret(12)
+	if err != nil {
+		return "", nil, err
+	}
+	return apiKey, &AdminUser{
+		ID:        id,
+		Hash:      hashCredential(apiKey),
+		Name:      name,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// adminCaller returns who called an admin route
+func adminCaller(ctx context.Context) adminIdentity {
+	identity, _ := ctx.Value(adminIdentityKey{}).(adminIdentity)
+	return identity
+}
+
+// adminAuth lets requests carrying the admin secret or an admin user's API key through, with the
+// caller in the request context. The admin secret has the admin role.
+func adminAuth(db Database, secret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := adminIdentity{Name: "admin secret", Role: AdminRoleAdmin}
+			if !hasSecret(r, secret) {
+				apiKey, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || apiKey == "" {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				user, err := db.GetAdminUser(hashCredential(apiKey))
+				if errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to check credential", http.StatusInternalServerError)
+					log.Printf("Error retrieving admin user: %v", err)
+					return
+				}
+				identity = adminIdentity{Name: user.Name, Role: user.Role}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, identity)))
+		})
+	}
+}
+
+// requireRole lets only admin callers with at least the given role through, it runs after adminAuth
+func requireRole(role AdminRole) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !adminCaller(r.Context()).Role.Includes(role) {
+				http.Error(w, "Requires the "+string(role)+" role", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
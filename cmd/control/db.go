@@ -6,21 +6,116 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
 )
 
+// ErrNotFound is returned when a requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
 // Database defines an interface for database operations.
 type Database interface {
 	GetAllServers() ([]*common.Server, error)
+	// GetServer looks up a server by its ID or ProxyURL, returning ErrNotFound if there is none.
+	GetServer(ref string) (*common.Server, error)
+	// GetServerByRevocationToken looks up a server by its revocation token, returning ErrNotFound if there is none.
+	GetServerByRevocationToken(revocationToken string) (*common.Server, error)
 	PutJWTKey(val *common.JWTKey) error
 	GetAllActiveJWTKeys() ([]*common.JWTKey, error)
-	AddServer(server *common.Server) error
+	// GetJWTKey looks up the public part of a key by its kid, returning ErrNotFound if there is none.
+	GetJWTKey(kid string) (*common.JWTKey, error)
+	// RemoveJWTKey removes a key from the key set, returning ErrNotFound if there is none.
+	RemoveJWTKey(kid string) error
+	// PutJWTPrivateKey stores the encrypted private part of a key stored with PutJWTKey.
+	PutJWTPrivateKey(kid string, key *EncryptedKey) error
+	// GetJWTPrivateKey returns the encrypted private part of a key, returning ErrNotFound if there is none.
+	GetJWTPrivateKey(kid string) (*EncryptedKey, error)
+	// RetainJWTKey keeps a key in the key set until the given time.
+	RetainJWTKey(kid string, until time.Time) error
+	// SetJWTKeyID points a key role, "active" or "next", at the key with the given kid until the given time.
+	// An empty kid clears the role.
+	SetJWTKeyID(role string, kid string, until time.Time) error
+	// GetJWTKeyID returns the kid of the key in a role, returning ErrNotFound if there is none.
+	GetJWTKeyID(role string) (string, error)
+	// AcquireLock takes the named lock for owner until it is released or ttl passed, returning false if it is held.
+	AcquireLock(name string, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLock releases the named lock if owner still holds it.
+	ReleaseLock(name string, owner string) error
+	// AddServer stores a server, it is removed unless its lease is renewed in time. A lease of 0 never expires.
+	AddServer(server *common.Server, lease time.Duration) error
+	// RenewServerLease extends the lease of the server with the given revocation token and records its load,
+	// returning ErrNotFound if there is no such server.
+	RenewServerLease(revocationToken string, activeConnections int, lease time.Duration) error
+	// SetServerState changes the lifecycle state of the server with the given ID, returning ErrNotFound if there is none.
+	// The state outlives the server's lease, see GetServerState.
+	SetServerState(id string, state common.ServerState) error
+	// GetServerState returns the state the server with the given proxy URL was last moved to, ServerStateActive if
+	// it never was. It is kept after the server's lease ran out, so registering again does not bring a server back.
+	GetServerState(proxyURL string) (common.ServerState, error)
+	// UpdateServer overwrites the location, group and capabilities of the server with the same ID,
+	// returning ErrNotFound if there is none.
+	UpdateServer(server *common.Server) error
 	RemoveServerByToken(revocationToken string) error
+	// RevokeToken marks the token with the given jti as revoked until it expires anyway.
+	RevokeToken(jti string, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
+	PutTier(tier *common.Tier) error
+	// GetTier looks up a tier by name, returning ErrNotFound if there is none.
+	GetTier(name string) (*common.Tier, error)
+	GetAllTiers() ([]*common.Tier, error)
+	// SetUserTier assigns the user with the given subject to a tier.
+	SetUserTier(subject string, tier string) error
+	// GetUserTier returns the tier name of a user, returning ErrNotFound if none was assigned.
+	GetUserTier(subject string) (string, error)
+	PutRefreshToken(token *RefreshToken) error
+	// ConsumeRefreshToken marks a refresh token as used and returns it, returning ErrNotFound if there is none.
+	// A token that was used before, or whose family was revoked, is returned with ErrRefreshTokenReused.
+	ConsumeRefreshToken(hash string) (*RefreshToken, error)
+	// RevokeRefreshTokenFamily invalidates all refresh tokens of a family until the given time.
+	RevokeRefreshTokenFamily(familyID string, until time.Time) error
+	PutPrivateTokenKey(key *PrivateTokenKey) error
+	// UseChallenge records a solved proof-of-work challenge until it expires, returning false if it was used before.
+	UseChallenge(id string, expiresAt time.Time) (bool, error)
+	// IncrementRateLimit counts a request in the fixed window of a rate limit counter,
+	// returning the requests counted so far and the time until the window resets.
+	IncrementRateLimit(key string, window time.Duration) (int64, time.Duration, error)
+	// GetAllPrivateTokenKeys returns the Privacy Pass issuer keys whose tokens are still redeemable.
+	GetAllPrivateTokenKeys() ([]*PrivateTokenKey, error)
+	// PutPendingServer stores a registration waiting for approval until it expires.
+	PutPendingServer(pending *PendingServer) error
+	// GetPendingServer looks up a registration by its pairing token hash, returning ErrNotFound if there is none.
+	GetPendingServer(tokenHash string) (*PendingServer, error)
+	GetAllPendingServers() ([]*PendingServer, error)
+	// ApprovePendingServer stores the ID, revocation token and owner of the approved server with the API key
+	// of its owner, returning false if the registration expired or was approved before.
+	ApprovePendingServer(tokenHash string, server *common.Server, apiKey string) (bool, error)
+	RemovePendingServer(tokenHash string) error
+	// PutEnrollmentToken stores an enrollment token until it expires.
+	PutEnrollmentToken(token *EnrollmentToken) error
+	// ConsumeEnrollmentToken removes an enrollment token and returns it, returning ErrNotFound if there is none.
+	ConsumeEnrollmentToken(hash string) (*EnrollmentToken, error)
+	PutProxyCredential(credential *ProxyCredential) error
+	// GetProxyCredential looks up a proxy credential by its hash, returning ErrNotFound if there is none.
+	GetProxyCredential(hash string) (*ProxyCredential, error)
+	GetAllProxyCredentials() ([]*ProxyCredential, error)
+	// RemoveProxyCredential revokes the proxy credential with the given ID, returning ErrNotFound if there is none.
+	RemoveProxyCredential(id string) error
+	PutAdminUser(user *AdminUser) error
+	// GetAdminUser looks up an admin user by the hash of its API key, returning ErrNotFound if there is none.
+	GetAdminUser(hash string) (*AdminUser, error)
+	GetAllAdminUsers() ([]*AdminUser, error)
+	// RemoveAdminUser revokes the admin user with the given ID, returning ErrNotFound if there is none.
+	RemoveAdminUser(id string) error
 }
 
 // RedisDatabase is an implementation of the Database interface using Redis.
@@ -33,14 +128,16 @@ func NewRedisDatabase(db *redis.Client) *RedisDatabase {
 	return &RedisDatabase{db: db}
 }
 
-// PutServer stores the Server object in Redis as a hash using proxyUrl as the key.
-func (r *RedisDatabase) AddServer(val *common.Server) error {
+// AddServer stores the Server object in Redis as a hash using proxyUrl as the key, expiring with its lease.
+func (r *RedisDatabase) AddServer(val *common.Server, lease time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
 	key := fmt.Sprintf("server:%s", val.ProxyURL)
 	data := map[string]interface{}{
+		"id":                 val.ID,
 		"proxyUrl":           val.ProxyURL,
+		"group":              val.Group,
 		"latitude":           val.Latitude,
 		"longitude":          val.Longitude,
 		"city":               val.City,
@@ -49,11 +146,234 @@ func (r *RedisDatabase) AddServer(val *common.Server) error {
 		"supportsConnectUdp": val.SupportsConnectUDP,
 		"supportsConnectIp":  val.SupportsConnectIP,
 		"revocationToken":    val.RevocationToken,
+		"owner":              val.Owner,
+		"state":              string(val.State),
+		"lastHeartbeat":      time.Now().Unix(),
+		"activeConnections":  0,
 	}
 
-	return r.db.HSet(ctx, key, data).Err()
+	previous, err := r.db.HMGet(ctx, key, "revocationToken", "id").Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := r.db.TxPipeline()
+	pipe.HSet(ctx, key, data)
+	if lease > 0 {
+		pipe.Expire(ctx, key, lease)
+	} else {
+		pipe.Persist(ctx, key)
+	}
+	// A server registering again gets new credentials, the old ones no longer find it
+	if token, ok := previous[0].(string); ok && token != "" && token != val.RevocationToken {
+		pipe.Del(ctx, serverTokenIndex(token))
+	}
+	if id, ok := previous[1].(string); ok && id != "" && id != val.ID {
+		pipe.Del(ctx, serverIDIndex(id))
+	}
+	// The index entries expire with the server, a lease of 0 keeps them
+	if val.RevocationToken != "" {
+		pipe.Set(ctx, serverTokenIndex(val.RevocationToken), key, lease)
+	}
+	if val.ID != "" {
+		pipe.Set(ctx, serverIDIndex(val.ID), key, lease)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// serverTokenIndex is the key pointing from a revocation token to the hash of its server
+func serverTokenIndex(revocationToken string) string {
+	return fmt.Sprintf("servertoken:%s", revocationToken)
+}
+
+// serverIDIndex is the key pointing from a server ID to the hash of its server
+func serverIDIndex(id string) string {
+	return fmt.Sprintf("serverid:%s", id)
+}
+
+// serverStateKey is the key of the state a server was moved to, it does not expire with the server
+func serverStateKey(proxyURL string) string {
+	return fmt.Sprintf("serverstate:%s", proxyURL)
+}
+
+// serverKey looks up the hash key of a server in an index, returning ErrNotFound if there is none.
+// Entries may be stale, callers check the hash still belongs to the token or ID.
+func (r *RedisDatabase) serverKey(ctx context.Context, index string) (string, error) {
+	key, err := r.db.Get(ctx, index).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return key, err
 }
 
+// IndexServers adds the index entries of servers stored before servers were indexed,
+// expiring with their servers. It runs once at startup.
+func (r *RedisDatabase) IndexServers() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	iter := r.db.Scan(ctx, 0, "server:*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		values, err := r.db.HMGet(ctx, key, "revocationToken", "id").Result()
+		if err != nil {
+			return err
+		}
+		ttl, err := r.db.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl == -2 {
+			// The lease ran out after the scan
+			continue
+		}
+		ttl = max(ttl, 0)
+		if token, ok := values[0].(string); ok && token != "" {
+			if err := r.db.SetNX(ctx, serverTokenIndex(token), key, ttl).Err(); err != nil {
+				return err
+			}
+		}
+		if id, ok := values[1].(string); ok && id != "" {
+			if err := r.db.SetNX(ctx, serverIDIndex(id), key, ttl).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Err()
+}
+
+// RenewServerLease finds a server by its revocation token and extends its lease.
+func (r *RedisDatabase) RenewServerLease(revocationToken string, activeConnections int, lease time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key, err := r.serverKey(ctx, serverTokenIndex(revocationToken))
+	if err != nil {
+		return err
+	}
+	id, err := r.db.HGet(ctx, key, "id").Result()
+	if err == redis.Nil {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	renewed, err := renewServerLeaseScript.Run(ctx, r.db, []string{key, serverTokenIndex(revocationToken), serverIDIndex(id)},
+		revocationToken, time.Now().Unix(), activeConnections, lease.Milliseconds()).Bool()
+	if err != nil {
+		return err
+	}
+	if !renewed {
+		// The lease ran out or the server registered again
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetServerState finds a server by its ID and changes its state.
+func (r *RedisDatabase) SetServerState(id string, state common.ServerState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key, err := r.serverKey(ctx, serverIDIndex(id))
+	if err != nil {
+		return err
+	}
+	stateKey := serverStateKey(strings.TrimPrefix(key, "server:"))
+	changed, err := setServerStateScript.Run(ctx, r.db, []string{key, stateKey}, id, string(state)).Bool()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		// The lease ran out or the server registered again
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetServerState reads the state a server was moved to, active servers have none stored.
+func (r *RedisDatabase) GetServerState(proxyURL string) (common.ServerState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	state, err := r.db.Get(ctx, serverStateKey(proxyURL)).Result()
+	if err == redis.Nil {
+		return common.ServerStateActive, nil
+	} else if err != nil {
+		return "", err
+	}
+	return serverState(state), nil
+}
+
+// UpdateServer finds a server by its ID and overwrites the fields describing it.
+func (r *RedisDatabase) UpdateServer(server *common.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key, err := r.serverKey(ctx, serverIDIndex(server.ID))
+	if err != nil {
+		return err
+	}
+	updated, err := updateServerScript.Run(ctx, r.db, []string{key}, server.ID,
+		"group", server.Group,
+		"latitude", server.Latitude,
+		"longitude", server.Longitude,
+		"city", server.City,
+		"country", server.Country,
+		"supportsConnectTcp", server.SupportsConnectTCP,
+		"supportsConnectUdp", server.SupportsConnectUDP,
+		"supportsConnectIp", server.SupportsConnectIP,
+	).Bool()
+	if err != nil {
+		return err
+	}
+	if !updated {
+		// The lease ran out or the server registered again
+		return ErrNotFound
+	}
+	return nil
+}
+
+// updateServerScript sets the field value pairs following the ID only if the server still exists
+var updateServerScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "id") ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 2))
+return 1
+`)
+
+// setServerStateScript changes the state of a server only if it still exists, and keeps any state but
+// active beyond its lease
+var setServerStateScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "id") ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "state", ARGV[2])
+if ARGV[2] == "active" then
+	redis.call("DEL", KEYS[2])
+else
+	redis.call("SET", KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// renewServerLeaseScript updates a server and extends the lease of it and its index entries, only if it still
+// exists: a plain HSET would recreate an expired server
+var renewServerLeaseScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "revocationToken") ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "lastHeartbeat", ARGV[2], "activeConnections", ARGV[3])
+if tonumber(ARGV[4]) > 0 then
+	for _, key in ipairs(KEYS) do
+		redis.call("PEXPIRE", key, ARGV[4])
+	end
+end
+return 1
+`)
+
 // GetAllServers retrieves all Server objects stored in Redis hashes.
 func (r *RedisDatabase) GetAllServers() ([]*common.Server, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -74,24 +394,95 @@ func (r *RedisDatabase) GetAllServers() ([]*common.Server, error) {
 		if err != nil {
 			return nil, err
 		}
-
-		server := &common.Server{
-			ProxyURL:           data["proxyUrl"],
-			Latitude:           parseFloat(data["latitude"]),
-			Longitude:          parseFloat(data["longitude"]),
-			City:               data["city"],
-			Country:            data["country"],
-			SupportsConnectTCP: parseBool(data["supportsConnectTcp"]),
-			SupportsConnectUDP: parseBool(data["supportsConnectUdp"]),
-			SupportsConnectIP:  parseBool(data["supportsConnectIp"]),
-			RevocationToken:    data["revocationToken"],
+		// The lease ran out after the scan
+		if len(data) == 0 {
+			continue
 		}
-		servers = append(servers, server)
+
+		servers = append(servers, serverFromHash(data))
 	}
 
 	return servers, nil
 }
 
+// GetServer retrieves a single server by its ID or ProxyURL.
+func (r *RedisDatabase) GetServer(ref string) (*common.Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Fast path: the reference is the ProxyURL the hash is keyed by
+	data, err := r.db.HGetAll(ctx, fmt.Sprintf("server:%s", ref)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		return serverFromHash(data), nil
+	}
+
+	key, err := r.serverKey(ctx, serverIDIndex(ref))
+	if err != nil {
+		return nil, err
+	}
+	data, err = r.db.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if data["id"] != ref {
+		// The lease ran out or the server registered again
+		return nil, ErrNotFound
+	}
+	return serverFromHash(data), nil
+}
+
+// GetServerByRevocationToken retrieves a server through the revocation token index.
+func (r *RedisDatabase) GetServerByRevocationToken(revocationToken string) (*common.Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key, err := r.serverKey(ctx, serverTokenIndex(revocationToken))
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.db.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if data["revocationToken"] != revocationToken {
+		// The lease ran out or the server registered again
+		return nil, ErrNotFound
+	}
+	return serverFromHash(data), nil
+}
+
+// serverFromHash converts a Redis server hash into a Server object.
+func serverFromHash(data map[string]string) *common.Server {
+	return &common.Server{
+		ID:                 data["id"],
+		ProxyURL:           data["proxyUrl"],
+		Group:              data["group"],
+		Latitude:           parseFloat(data["latitude"]),
+		Longitude:          parseFloat(data["longitude"]),
+		City:               data["city"],
+		Country:            data["country"],
+		SupportsConnectTCP: parseBool(data["supportsConnectTcp"]),
+		SupportsConnectUDP: parseBool(data["supportsConnectUdp"]),
+		SupportsConnectIP:  parseBool(data["supportsConnectIp"]),
+		RevocationToken:    data["revocationToken"],
+		Owner:              data["owner"],
+		LastHeartbeat:      parseInt64(data["lastHeartbeat"]),
+		ActiveConnections:  int(parseInt64(data["activeConnections"])),
+		State:              serverState(data["state"]),
+	}
+}
+
+// serverState returns the stored state, servers stored before there were states are active
+func serverState(state string) common.ServerState {
+	if state == "" {
+		return common.ServerStateActive
+	}
+	return common.ServerState(state)
+}
+
 // PutJWTKey stores the JWTKey object in Redis as a hash using kid as the key.
 func (r *RedisDatabase) PutJWTKey(val *common.JWTKey) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -99,10 +490,12 @@ func (r *RedisDatabase) PutJWTKey(val *common.JWTKey) error {
 
 	key := fmt.Sprintf("kid:%s", val.Kid)
 	data := map[string]interface{}{
-		"kty":       val.Kty,
-		"publicKey": val.PublicKey,
-		"kid":       val.Kid,
-		"expiresAt": val.ExpiresAt,
+		"kty":         val.Kty,
+		"alg":         val.Alg,
+		"publicKey":   val.PublicKey,
+		"kid":         val.Kid,
+		"expiresAt":   val.ExpiresAt,
+		"publishedAt": val.PublishedAt,
 	}
 
 	expireAt := time.Unix(val.ExpiresAt, 0).Add(25 * time.Hour)
@@ -138,12 +531,18 @@ func (r *RedisDatabase) GetAllActiveJWTKeys() ([]*common.JWTKey, error) {
 		if err != nil {
 			return nil, err
 		}
+		// The key expired after the scan
+		if len(data) == 0 {
+			continue
+		}
 
 		jwtKey := &common.JWTKey{
-			Kty:       data["kty"],
-			PublicKey: data["publicKey"],
-			Kid:       data["kid"],
-			ExpiresAt: parseInt64(data["expiresAt"]),
+			Kty:         data["kty"],
+			Alg:         data["alg"],
+			PublicKey:   data["publicKey"],
+			Kid:         data["kid"],
+			ExpiresAt:   parseInt64(data["expiresAt"]),
+			PublishedAt: parseInt64(data["publishedAt"]),
 		}
 		jwtKeys = append(jwtKeys, jwtKey)
 	}
@@ -151,32 +550,805 @@ func (r *RedisDatabase) GetAllActiveJWTKeys() ([]*common.JWTKey, error) {
 	return jwtKeys, nil
 }
 
+// GetJWTKey retrieves the public part of a JWTKey by its kid.
+func (r *RedisDatabase) GetJWTKey(kid string) (*common.JWTKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := r.db.HMGet(ctx, fmt.Sprintf("kid:%s", kid), "kty", "alg", "publicKey", "kid", "expiresAt", "publishedAt").Result()
+	if err != nil {
+		return nil, err
+	}
+	if data[3] == nil {
+		return nil, ErrNotFound
+	}
+	field := func(i int) string {
+		value, _ := data[i].(string)
+		return value
+	}
+	return &common.JWTKey{
+		Kty:         field(0),
+		Alg:         field(1),
+		PublicKey:   field(2),
+		Kid:         field(3),
+		ExpiresAt:   parseInt64(field(4)),
+		PublishedAt: parseInt64(field(5)),
+	}, nil
+}
+
+// PutJWTPrivateKey adds the encrypted private key to the hash of the key, it expires together with it.
+func (r *RedisDatabase) PutJWTPrivateKey(kid string, key *EncryptedKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return r.db.HSet(ctx, fmt.Sprintf("kid:%s", kid), map[string]interface{}{
+		"masterKeyId":         key.MasterKeyID,
+		"wrappedKey":          key.WrappedKey,
+		"encryptedPrivateKey": key.Ciphertext,
+	}).Err()
+}
+
+// GetJWTPrivateKey retrieves the encrypted private key of a JWTKey.
+func (r *RedisDatabase) GetJWTPrivateKey(kid string) (*EncryptedKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := r.db.HMGet(ctx, fmt.Sprintf("kid:%s", kid), "masterKeyId", "wrappedKey", "encryptedPrivateKey").Result()
+	if err != nil {
+		return nil, err
+	}
+	masterKeyID, _ := data[0].(string)
+	wrappedKey, _ := data[1].(string)
+	ciphertext, _ := data[2].(string)
+	if ciphertext == "" {
+		return nil, ErrNotFound
+	}
+	return &EncryptedKey{MasterKeyID: masterKeyID, WrappedKey: wrappedKey, Ciphertext: ciphertext}, nil
+}
+
+// RetainJWTKey sets when the hash of a key expires.
+func (r *RedisDatabase) RetainJWTKey(kid string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return r.db.ExpireAt(ctx, fmt.Sprintf("kid:%s", kid), until).Err()
+}
+
+// RemoveJWTKey deletes a key with its encrypted private part.
+func (r *RedisDatabase) RemoveJWTKey(kid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	removed, err := r.db.Del(ctx, fmt.Sprintf("kid:%s", kid)).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetJWTKeyID stores the kid of a key role, it expires with the key.
+func (r *RedisDatabase) SetJWTKeyID(role string, kid string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("%skid", role)
+	ttl := time.Until(until)
+	if kid == "" || ttl <= 0 {
+		return r.db.Del(ctx, key).Err()
+	}
+	return r.db.Set(ctx, key, kid, ttl).Err()
+}
+
+// GetJWTKeyID retrieves the kid of a key role.
+func (r *RedisDatabase) GetJWTKeyID(role string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	kid, err := r.db.Get(ctx, fmt.Sprintf("%skid", role)).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return kid, err
+}
+
+// AcquireLock sets the lock key unless it exists, it expires after ttl.
+func (r *RedisDatabase) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return r.db.SetNX(ctx, fmt.Sprintf("lock:%s", name), owner, ttl).Result()
+}
+
+// releaseLockScript deletes a lock only if it still belongs to the caller, it may have expired and been taken over
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ReleaseLock deletes the lock key if it holds owner.
+func (r *RedisDatabase) ReleaseLock(name string, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return releaseLockScript.Run(ctx, r.db, []string{fmt.Sprintf("lock:%s", name)}, owner).Err()
+}
+
 // RemoveServerByToken removes a server from the database by its revocation token.
 func (r *RedisDatabase) RemoveServerByToken(revocationToken string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	var keys []string
-	iter := r.db.Scan(ctx, 0, "server:*", 0).Iterator()
+	key, err := r.serverKey(ctx, serverTokenIndex(revocationToken))
+	if err != nil {
+		return err
+	}
+	id, err := r.db.HGet(ctx, key, "id").Result()
+	if err == redis.Nil {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	removed, err := removeServerScript.Run(ctx, r.db, []string{key, serverTokenIndex(revocationToken), serverIDIndex(id)},
+		revocationToken).Bool()
+	if err != nil {
+		return err
+	}
+	if !removed {
+		// The lease ran out or the server registered again
+		return ErrNotFound
+	}
+	return nil
+}
+
+// removeServerScript deletes a server with its index entries, only if it still has the revocation token
+var removeServerScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "revocationToken") ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", unpack(KEYS))
+return 1
+`)
+
+// RevokeToken stores the jti of a revoked token until the token expires.
+func (r *RedisDatabase) RevokeToken(jti string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		// Expired tokens are rejected anyway
+		return nil
+	}
+	return r.db.Set(ctx, fmt.Sprintf("revoked:%s", jti), expiresAt.Unix(), ttl).Err()
+}
+
+// IsTokenRevoked checks whether the token with the given jti has been revoked.
+func (r *RedisDatabase) IsTokenRevoked(jti string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	n, err := r.db.Exists(ctx, fmt.Sprintf("revoked:%s", jti)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PutTier stores the tier as JSON using its name as the key.
+func (r *RedisDatabase) PutTier(tier *common.Tier) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := json.Marshal(tier)
+	if err != nil {
+		return err
+	}
+	return r.db.Set(ctx, fmt.Sprintf("tier:%s", tier.Name), data, 0).Err()
+}
+
+// GetTier retrieves a single tier by its name.
+func (r *RedisDatabase) GetTier(name string) (*common.Tier, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := r.db.Get(ctx, fmt.Sprintf("tier:%s", name)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tier common.Tier
+	if err := json.Unmarshal(data, &tier); err != nil {
+		return nil, err
+	}
+	return &tier, nil
+}
+
+// GetAllTiers retrieves all stored tiers.
+func (r *RedisDatabase) GetAllTiers() ([]*common.Tier, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var tiers []*common.Tier
+	iter := r.db.Scan(ctx, 0, "tier:*", 0).Iterator()
 	for iter.Next(ctx) {
-		keys = append(keys, iter.Val())
+		data, err := r.db.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			return nil, err
+		}
+		var tier common.Tier
+		if err := json.Unmarshal(data, &tier); err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, &tier)
 	}
 	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return tiers, nil
+}
+
+// SetUserTier stores the tier assignment of a user.
+func (r *RedisDatabase) SetUserTier(subject string, tier string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return r.db.Set(ctx, fmt.Sprintf("usertier:%s", subject), tier, 0).Err()
+}
+
+// GetUserTier retrieves the tier assignment of a user.
+func (r *RedisDatabase) GetUserTier(subject string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	tier, err := r.db.Get(ctx, fmt.Sprintf("usertier:%s", subject)).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return tier, err
+}
+
+// PutRefreshToken stores a refresh token as a hash using the token hash as the key.
+func (r *RedisDatabase) PutRefreshToken(token *RefreshToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(token.ExpiresAt)
+	if ttl <= 0 {
+		return fmt.Errorf("expiration time is in the past")
+	}
+
+	key := fmt.Sprintf("refresh:%s", token.Hash)
+	data := map[string]interface{}{
+		"family":       token.FamilyID,
+		"subject":      token.Subject,
+		"server":       token.Server,
+		"group":        token.Group,
+		"confirmation": token.Confirmation,
+		"expiresAt":    token.ExpiresAt.Unix(),
+	}
+
+	pipe := r.db.TxPipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ConsumeRefreshToken marks a refresh token as used, a second use is detected atomically.
+func (r *RedisDatabase) ConsumeRefreshToken(hash string) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("refresh:%s", hash)
+	data, err := r.db.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	token := &RefreshToken{
+		Hash:         hash,
+		FamilyID:     data["family"],
+		Subject:      data["subject"],
+		Server:       data["server"],
+		Group:        data["group"],
+		Confirmation: data["confirmation"],
+		ExpiresAt:    time.Unix(parseInt64(data["expiresAt"]), 0),
+	}
+
+	consumed, err := consumeRefreshTokenScript.Run(ctx, r.db,
+		[]string{key, fmt.Sprintf("refreshfamily:%s", token.FamilyID)}, time.Now().Unix()).Int()
+	if err != nil {
+		return nil, err
+	}
+	switch consumed {
+	case 1:
+		return token, nil
+	case 0:
+		return token, ErrRefreshTokenReused
+	default:
+		// The token expired after it was read
+		return nil, ErrNotFound
+	}
+}
+
+// consumeRefreshTokenScript marks a refresh token used unless it was used before or its family was
+// revoked, in one step so a concurrent reuse cannot slip in between. It returns 1 if the token was
+// consumed, 0 if it was reused and -1 if it no longer exists.
+var consumeRefreshTokenScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+return redis.call("HSETNX", KEYS[1], "usedAt", ARGV[1])
+`)
+
+// RevokeRefreshTokenFamily stores the revocation of a refresh token family until its tokens expire.
+func (r *RedisDatabase) RevokeRefreshTokenFamily(familyID string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	return r.db.Set(ctx, fmt.Sprintf("refreshfamily:%s", familyID), until.Unix(), ttl).Err()
+}
+
+// UseChallenge atomically records a solved challenge, the key expires together with the challenge.
+func (r *RedisDatabase) UseChallenge(id string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return false, nil
+	}
+	return r.db.SetNX(ctx, fmt.Sprintf("powchallenge:%s", id), 1, ttl).Result()
+}
+
+// incrementRateLimitScript increments a counter, starting its window on the first increment
+var incrementRateLimitScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// IncrementRateLimit increments a counter that expires with its window, shared by all replicas.
+func (r *RedisDatabase) IncrementRateLimit(key string, window time.Duration) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	result, err := incrementRateLimitScript.Run(ctx, r.db, []string{"ratelimit:" + key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	reset := time.Duration(result[1]) * time.Millisecond
+	if reset < 0 {
+		reset = window
+	}
+	return result[0], reset, nil
+}
+
+// PutPrivateTokenKey stores a Privacy Pass issuer key as a hash until its tokens are no longer redeemable.
+func (r *RedisDatabase) PutPrivateTokenKey(key *PrivateTokenKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(time.Unix(key.RedeemableUntil, 0))
+	if ttl <= 0 {
+		return fmt.Errorf("expiration time is in the past")
+	}
+
+	hash := sha256.Sum256([]byte(key.PublicKey))
+	redisKey := fmt.Sprintf("privatetokenkey:%s", hex.EncodeToString(hash[:]))
+	data := map[string]interface{}{
+		"publicKey":       key.PublicKey,
+		"notBefore":       key.NotBefore,
+		"redeemableUntil": key.RedeemableUntil,
+	}
+
+	pipe := r.db.TxPipeline()
+	pipe.HSet(ctx, redisKey, data)
+	pipe.Expire(ctx, redisKey, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetAllPrivateTokenKeys retrieves all stored Privacy Pass issuer keys.
+func (r *RedisDatabase) GetAllPrivateTokenKeys() ([]*PrivateTokenKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var keys []*PrivateTokenKey
+	iter := r.db.Scan(ctx, 0, "privatetokenkey:*", 0).Iterator()
+	for iter.Next(ctx) {
+		data, err := r.db.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		keys = append(keys, &PrivateTokenKey{
+			PublicKey:       data["publicKey"],
+			NotBefore:       parseInt64(data["notBefore"]),
+			RedeemableUntil: parseInt64(data["redeemableUntil"]),
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// PutPendingServer stores a pending registration as a hash using the pairing token hash as the key.
+func (r *RedisDatabase) PutPendingServer(pending *PendingServer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(pending.ExpiresAt)
+	if ttl <= 0 {
+		return fmt.Errorf("expiration time is in the past")
+	}
+	server, err := json.Marshal(pending.Server)
+	if err != nil {
 		return err
 	}
 
-	for _, key := range keys {
-		data, err := r.db.HGetAll(ctx, key).Result()
+	key := fmt.Sprintf("pairing:%s", pending.TokenHash)
+	data := map[string]interface{}{
+		"code":            pending.Code,
+		"server":          server,
+		"requestedAt":     pending.RequestedAt.Unix(),
+		"expiresAt":       pending.ExpiresAt.Unix(),
+		"owner":           pending.Server.Owner,
+		"serverId":        pending.ServerID,
+		"revocationToken": pending.RevocationToken,
+		"apiKey":          pending.APIKey,
+	}
+
+	pipe := r.db.TxPipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.Expire(ctx, key, ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetPendingServer retrieves a pending registration by its pairing token hash.
+func (r *RedisDatabase) GetPendingServer(tokenHash string) (*PendingServer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := r.db.HGetAll(ctx, fmt.Sprintf("pairing:%s", tokenHash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	return pendingServerFromHash(tokenHash, data)
+}
+
+// GetAllPendingServers retrieves all pending and approved registrations that did not expire.
+func (r *RedisDatabase) GetAllPendingServers() ([]*PendingServer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var pendingServers []*PendingServer
+	iter := r.db.Scan(ctx, 0, "pairing:*", 0).Iterator()
+	for iter.Next(ctx) {
+		data, err := r.db.HGetAll(ctx, iter.Val()).Result()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		pending, err := pendingServerFromHash(iter.Val()[len("pairing:"):], data)
+		if err != nil {
+			return nil, err
+		}
+		pendingServers = append(pendingServers, pending)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return pendingServers, nil
+}
+
+// pendingServerFromHash converts a Redis pairing hash into a PendingServer object.
+func pendingServerFromHash(tokenHash string, data map[string]string) (*PendingServer, error) {
+	pending := &PendingServer{
+		Code:            data["code"],
+		TokenHash:       tokenHash,
+		RequestedAt:     time.Unix(parseInt64(data["requestedAt"]), 0),
+		ExpiresAt:       time.Unix(parseInt64(data["expiresAt"]), 0),
+		ServerID:        data["serverId"],
+		RevocationToken: data["revocationToken"],
+		APIKey:          data["apiKey"],
+	}
+	if err := json.Unmarshal([]byte(data["server"]), &pending.Server); err != nil {
+		return nil, fmt.Errorf("invalid pending server %s: %w", pending.Code, err)
+	}
+	pending.Server.Owner = data["owner"]
+	return pending, nil
+}
+
+// approvePendingServerScript sets the credentials of a registration that exists and was not approved yet
+var approvePendingServerScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local current = redis.call("HGET", KEYS[1], "revocationToken")
+if current and current ~= "" then
+	return 0
+end
+redis.call("HSET", KEYS[1], "serverId", ARGV[1], "revocationToken", ARGV[2], "owner", ARGV[3], "apiKey", ARGV[4])
+return 1
+`)
+
+// ApprovePendingServer atomically stores the credentials of an approved registration.
+func (r *RedisDatabase) ApprovePendingServer(tokenHash string, server *common.Server, apiKey string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("pairing:%s", tokenHash)
+	return approvePendingServerScript.Run(ctx, r.db, []string{key}, server.ID, server.RevocationToken, server.Owner, apiKey).Bool()
+}
+
+// RemovePendingServer deletes a pending registration.
+func (r *RedisDatabase) RemovePendingServer(tokenHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return r.db.Del(ctx, fmt.Sprintf("pairing:%s", tokenHash)).Err()
+}
+
+// PutEnrollmentToken stores an enrollment token as a hash until it expires.
+func (r *RedisDatabase) PutEnrollmentToken(token *EnrollmentToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ttl := time.Until(token.ExpiresAt)
+	if ttl <= 0 {
+		return fmt.Errorf("expiration time is in the past")
+	}
+
+	key := fmt.Sprintf("enrollment:%s", token.Hash)
+	data := map[string]interface{}{
+		"name":      token.Name,
+		"expiresAt": token.ExpiresAt.Unix(),
+	}
+
+	pipe := r.db.TxPipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ConsumeEnrollmentToken reads and deletes an enrollment token in one transaction, so it is used once.
+func (r *RedisDatabase) ConsumeEnrollmentToken(hash string) (*EnrollmentToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("enrollment:%s", hash)
+	pipe := r.db.TxPipeline()
+	get := pipe.HGetAll(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	data := get.Val()
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	return &EnrollmentToken{
+		Hash:      hash,
+		Name:      data["name"],
+		ExpiresAt: time.Unix(parseInt64(data["expiresAt"]), 0),
+	}, nil
+}
+
+// PutProxyCredential stores a proxy credential as a hash using the API key hash as the key.
+func (r *RedisDatabase) PutProxyCredential(credential *ProxyCredential) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("proxycredential:%s", credential.Hash)
+	data := map[string]interface{}{
+		"id":        credential.ID,
+		"name":      credential.Name,
+		"createdAt": credential.CreatedAt.Unix(),
+	}
+
+	return r.db.HSet(ctx, key, data).Err()
+}
+
+// GetProxyCredential retrieves a proxy credential by the hash of its API key.
+func (r *RedisDatabase) GetProxyCredential(hash string) (*ProxyCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := r.db.HGetAll(ctx, fmt.Sprintf("proxycredential:%s", hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	return proxyCredentialFromHash(hash, data), nil
+}
+
+// GetAllProxyCredentials retrieves all proxy credentials.
+func (r *RedisDatabase) GetAllProxyCredentials() ([]*ProxyCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var credentials []*ProxyCredential
+	iter := r.db.Scan(ctx, 0, "proxycredential:*", 0).Iterator()
+	for iter.Next(ctx) {
+		data, err := r.db.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		credentials = append(credentials, proxyCredentialFromHash(iter.Val()[len("proxycredential:"):], data))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// RemoveProxyCredential removes a proxy credential by its ID.
+func (r *RedisDatabase) RemoveProxyCredential(id string) error {
+	credentials, err := r.GetAllProxyCredentials()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	for _, credential := range credentials {
+		if credential.ID == id {
+			return r.db.Del(ctx, fmt.Sprintf("proxycredential:%s", credential.Hash)).Err()
+		}
+	}
+	return ErrNotFound
+}
+
+// proxyCredentialFromHash converts a Redis proxy credential hash into a ProxyCredential object.
+func proxyCredentialFromHash(hash string, data map[string]string) *ProxyCredential {
+	return &ProxyCredential{
+		ID:        data["id"],
+		Hash:      hash,
+		Name:      data["name"],
+		CreatedAt: time.Unix(parseInt64(data["createdAt"]), 0),
+	}
+}
+
+// PutAdminUser stores an admin user as a hash using the API key hash as the key.
+func (r *RedisDatabase) PutAdminUser(user *AdminUser) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("adminuser:%s", user.Hash)
+	data := map[string]interface{}{
+		"id":        user.ID,
+		"name":      user.Name,
+		"role":      string(user.Role),
+		"createdAt": user.CreatedAt.Unix(),
+	}
+
+	return r.db.HSet(ctx, key, data).Err()
+}
+
+// GetAdminUser retrieves an admin user by the hash of its API key.
+func (r *RedisDatabase) GetAdminUser(hash string) (*AdminUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	data, err := r.db.HGetAll(ctx, fmt.Sprintf("adminuser:%s", hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	return adminUserFromHash(hash, data), nil
+}
+
+// GetAllAdminUsers retrieves all admin users.
+func (r *RedisDatabase) GetAllAdminUsers() ([]*AdminUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var users []*AdminUser
+	iter := r.db.Scan(ctx, 0, "adminuser:*", 0).Iterator()
+	for iter.Next(ctx) {
+		data, err := r.db.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
 		}
+		if len(data) == 0 {
+			continue
+		}
+		users = append(users, adminUserFromHash(iter.Val()[len("adminuser:"):], data))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
 
-		if data["revocationToken"] == revocationToken {
-			return r.db.Del(ctx, key).Err()
+// RemoveAdminUser removes an admin user by its ID.
+func (r *RedisDatabase) RemoveAdminUser(id string) error {
+	users, err := r.GetAllAdminUsers()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	for _, user := range users {
+		if user.ID == id {
+			return r.db.Del(ctx, fmt.Sprintf("adminuser:%s", user.Hash)).Err()
 		}
 	}
+	return ErrNotFound
+}
 
-	return fmt.Errorf("server with revocation token not found")
+// adminUserFromHash converts a Redis admin user hash into an AdminUser object.
+func adminUserFromHash(hash string, data map[string]string) *AdminUser {
+	return &AdminUser{
+		ID:        data["id"],
+		Hash:      hash,
+		Name:      data["name"],
+		Role:      AdminRole(data["role"]),
+		CreatedAt: time.Unix(parseInt64(data["createdAt"]), 0),
+	}
+}
+
+// dbKeyProvider provides the control server's own verification keys from the database.
+type dbKeyProvider struct {
+	db Database
+}
+
+// PublicKeys returns all active public keys
+func (p dbKeyProvider) PublicKeys() (map[string]auth.PublicKey, error) {
+	keys, err := p.db.GetAllActiveJWTKeys()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		return nil, err
+	}
+	return auth.ParseJWKS(data)
 }
 
 // Helper functions to parse string values from Redis
@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// defaultTiers are stored on startup unless a tier of the same name exists already,
+// the free tier matches what every user got before tiers existed.
+func defaultTiers() []*common.Tier {
+	return []*common.Tier{
+		{
+			Name:           "free",
+			Permissions:    []string{string(auth.PERMISSION_CONNECT_TCP)},
+			TokenTTL:       60 * 60,
+			BandwidthLimit: 1250000, // 10 Mbit/s
+		},
+		{
+			Name:        "pro",
+			Permissions: []string{string(auth.PERMISSION_PROXY_ALL)},
+			TokenTTL:    4 * 60 * 60,
+		},
+		{
+			Name:        "internal",
+			Permissions: []string{string(auth.PERMISSION_PROXY_ALL)},
+			TokenTTL:    24 * 60 * 60,
+		},
+	}
+}
+
+// seedTiers stores the default tiers that are missing from the database
+func seedTiers(db Database) error {
+	for _, tier := range defaultTiers() {
+		_, err := db.GetTier(tier.Name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		log.Printf("Creating default tier %s", tier.Name)
+		if err := db.PutTier(tier); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tierForUser returns the tier of a user, anonymous and unassigned users get the default tier
+func tierForUser(db Database, subject string, defaultTier string) (*common.Tier, error) {
+	name := defaultTier
+	if subject != "" {
+		assigned, err := db.GetUserTier(subject)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			name = assigned
+		}
+	}
+
+	tier, err := db.GetTier(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tier %s: %w", name, err)
+	}
+	return tier, nil
+}
+
+// tierPermissions returns the permissions a tier grants
+func tierPermissions(tier *common.Tier) []auth.Permission {
+	permissions := make([]auth.Permission, 0, len(tier.Permissions))
+	for _, p := range tier.Permissions {
+		permissions = append(permissions, auth.ParsePermission(p))
+	}
+	return permissions
+}
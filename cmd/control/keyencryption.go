@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// masterKeySize is the size of the AES-256 master key
+const masterKeySize = 32
+
+// ErrWrongMasterKey is returned when a key was encrypted under another master key
+var ErrWrongMasterKey = errors.New("key was encrypted with another master key")
+
+// EncryptedKey is a private key sealed with envelope encryption: the key is encrypted with a random
+// data key, which is encrypted with the master key. Both ciphertexts are bound to the key ID.
+type EncryptedKey struct {
+	// MasterKeyID identifies the master key the data key is wrapped with
+	MasterKeyID string
+	// WrappedKey is the base64 encoded nonce and ciphertext of the data key
+	WrappedKey string
+	// Ciphertext is the base64 encoded nonce and ciphertext of the private key
+	Ciphertext string
+}
+
+// keyEncrypter seals private keys for storage in the database
+type keyEncrypter struct {
+	masterKey cipher.AEAD
+	id        string
+}
+
+// newKeyEncrypter creates an encrypter using a 256 bit master key
+func newKeyEncrypter(masterKey []byte) (*keyEncrypter, error) {
+	if len(masterKey) != masterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", masterKeySize, len(masterKey))
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(masterKey)
+	return &keyEncrypter{masterKey: aead, id: hex.EncodeToString(id[:8])}, nil
+}
+
+// loadMasterKey reads the base64 encoded master key from the config value or the key file.
+// It returns nil if neither is set.
+func loadMasterKey(value string, file string) ([]byte, error) {
+	if value == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		value = string(data)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not base64 encoded: %w", err)
+	}
+	return key, nil
+}
+
+// seal encrypts a private key for the key with the given ID
+func (e *keyEncrypter) seal(kid string, plaintext []byte) (*EncryptedKey, error) {
+	dataKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := encrypt(e.masterKey, dataKey, []byte(kid))
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := encrypt(dataAEAD, plaintext, []byte(kid))
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedKey{
+		MasterKeyID: e.id,
+		WrappedKey:  base64.StdEncoding.EncodeToString(wrappedKey),
+		Ciphertext:  base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+// open decrypts the private key sealed for the key with the given ID
+func (e *keyEncrypter) open(kid string, key *EncryptedKey) ([]byte, error) {
+	if key.MasterKeyID != e.id {
+		return nil, fmt.Errorf("%w %s", ErrWrongMasterKey, key.MasterKeyID)
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(key.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(key.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+
+	dataKey, err := decrypt(e.masterKey, wrappedKey, []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(dataAEAD, ciphertext, []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns the random nonce followed by the ciphertext
+func encrypt(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+}
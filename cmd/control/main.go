@@ -8,6 +8,7 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -20,6 +21,154 @@ type Config struct {
 	RedisPassword string `env:"ZDVV_REDIS_PASSWORD" default:""`
 	RedisDB       int    `env:"ZDVV_REDIS_DB" default:"0"`
 	AuthSecret    string `env:"ZDVV_AUTH_SECRET" default:"my-secret-key"`
+	// Opens every admin route, must differ from the secret shared with proxies. Empty leaves the admin routes to admin users
+	AdminSecret string `env:"ZDVV_ADMIN_SECRET"`
+	// Algorithm used to sign tokens: RS256, ES256 or EdDSA
+	JWTAlgorithm string `env:"ZDVV_JWT_ALGORITHM,default=RS256"`
+	// Issuer name put into the iss claim, proxies trusting several control servers tell them apart by it
+	Issuer string `env:"ZDVV_ISSUER,default=zdvv-control-server"`
+	// Also emit the old boolean permission claims, while proxies predating scopes are still deployed
+	LegacyPermissionClaims bool `env:"ZDVV_LEGACY_PERMISSION_CLAIMS,default=false"`
+	// Tier of users without an assignment and of anonymous tokens
+	DefaultTier string `env:"ZDVV_DEFAULT_TIER,default=free"`
+	// Lifetime of refresh tokens in hours, every refresh extends it
+	RefreshTokenTTLHours int `env:"ZDVV_REFRESH_TOKEN_TTL_HOURS,default=720"`
+	// OAuth2/OIDC provider whose access or ID tokens are exchanged for proxy tokens
+	OIDCDiscoveryURL string `env:"ZDVV_OIDC_DISCOVERY_URL"`
+	OIDCClientID     string `env:"ZDVV_OIDC_CLIENT_ID"`
+	// Comma separated audiences accepted in provider tokens, defaults to the client ID
+	OIDCAudiences string `env:"ZDVV_OIDC_AUDIENCES"`
+	// Issue tokens without a provider token, only meant for development
+	AllowAnonymousTokens bool `env:"ZDVV_ALLOW_ANONYMOUS_TOKENS,default=false"`
+	// Make anonymous users solve a proof-of-work challenge before they get a token
+	ProofOfWork bool `env:"ZDVV_PROOF_OF_WORK,default=false"`
+	// Leading zero bits a solution needs while the issuance rate is below the target
+	ProofOfWorkDifficulty int `env:"ZDVV_PROOF_OF_WORK_DIFFICULTY,default=18"`
+	// Anonymous tokens per minute before every doubling of the rate adds a bit of difficulty
+	ProofOfWorkTargetRate int `env:"ZDVV_PROOF_OF_WORK_TARGET_RATE,default=60"`
+	// Secret challenges are signed with, must be shared by all control server instances
+	ProofOfWorkSecret string `env:"ZDVV_PROOF_OF_WORK_SECRET"`
+	// Base64 encoded 256 bit master key signing keys are encrypted with in the database, or a file holding it.
+	// Without one each instance signs with its own in-memory key.
+	KeyEncryptionKey     string `env:"ZDVV_KEY_ENCRYPTION_KEY"`
+	KeyEncryptionKeyFile string `env:"ZDVV_KEY_ENCRYPTION_KEY_FILE"`
+	// Where signing keys are generated and kept: memory, file or pkcs11
+	SignerBackend string `env:"ZDVV_SIGNER_BACKEND,default=memory"`
+	// Directory the file signer backend keeps keys in
+	SignerKeyDir string `env:"ZDVV_SIGNER_KEY_DIR"`
+	// PKCS #11 module, token and user PIN of the pkcs11 signer backend
+	PKCS11Module     string `env:"ZDVV_PKCS11_MODULE"`
+	PKCS11TokenLabel string `env:"ZDVV_PKCS11_TOKEN_LABEL"`
+	PKCS11PIN        string `env:"ZDVV_PKCS11_PIN"`
+	// How long a signing key signs tokens before the next one takes over
+	JWTKeyLifetimeHours int `env:"ZDVV_JWT_KEY_LIFETIME_HOURS,default=24"`
+	// How long the next signing key is published in the key set before it signs tokens,
+	// must exceed the time proxies cache the key set
+	JWTKeyPrepublishMinutes int `env:"ZDVV_JWT_KEY_PREPUBLISH_MINUTES,default=60"`
+	// Requests per minute and client address to the token issuing routes, -1 disables the limit
+	RateLimitIssuance int `env:"ZDVV_RATE_LIMIT_ISSUANCE,default=30"`
+	// Token requests per minute and authenticated user, -1 disables the limit
+	RateLimitUserIssuance int `env:"ZDVV_RATE_LIMIT_USER_ISSUANCE,default=60"`
+	// Requests per minute and client address to the server list, -1 disables the limit
+	RateLimitServers int `env:"ZDVV_RATE_LIMIT_SERVERS,default=60"`
+	// Header the load balancer in front of the control server puts the client address into, e.g. X-Forwarded-For
+	ClientIPHeader string `env:"ZDVV_CLIENT_IP_HEADER"`
+	// New servers registered with the shared secret wait for an admin to approve their pairing code before they are listed
+	ServerPairing bool `env:"ZDVV_SERVER_PAIRING,default=true"`
+	// Base32 TOTP secret of the authenticator app pairing approvals are confirmed with
+	AdminTOTPSecret string `env:"ZDVV_ADMIN_TOTP_SECRET"`
+	// Seconds a server stays listed without a heartbeat, -1 keeps servers until they deregister
+	ServerLeaseSeconds int `env:"ZDVV_SERVER_LEASE_SECONDS,default=90"`
+}
+
+// defaultTier returns the configured default tier name or the free tier
+func (c *Config) defaultTier() string {
+	if c.DefaultTier == "" {
+		return "free"
+	}
+	return c.DefaultTier
+}
+
+// refreshTokenTTL returns the configured refresh token lifetime or 30 days
+func (c *Config) refreshTokenTTL() time.Duration {
+	if c.RefreshTokenTTLHours <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(c.RefreshTokenTTLHours) * time.Hour
+}
+
+// proofOfWorkDifficulty returns the configured base difficulty, limited to what clients can solve
+func (c *Config) proofOfWorkDifficulty() int {
+	if c.ProofOfWorkDifficulty <= 0 {
+		return 18
+	}
+	return min(c.ProofOfWorkDifficulty, 32)
+}
+
+// proofOfWorkTargetRate returns the configured anonymous tokens per minute or 60
+func (c *Config) proofOfWorkTargetRate() int {
+	if c.ProofOfWorkTargetRate <= 0 {
+		return 60
+	}
+	return c.ProofOfWorkTargetRate
+}
+
+// jwtKeyLifetime returns the configured signing key lifetime or 24 hours
+func (c *Config) jwtKeyLifetime() time.Duration {
+	if c.JWTKeyLifetimeHours <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.JWTKeyLifetimeHours) * time.Hour
+}
+
+// jwtKeyPrepublish returns the configured pre-publication time or an hour, at most half the key lifetime
+func (c *Config) jwtKeyPrepublish() time.Duration {
+	prepublish := time.Hour
+	if c.JWTKeyPrepublishMinutes > 0 {
+		prepublish = time.Duration(c.JWTKeyPrepublishMinutes) * time.Minute
+	}
+	return min(prepublish, c.jwtKeyLifetime()/2)
+}
+
+// serverLease returns the configured server lease, 90 seconds if it is unset or 0 if leases are disabled
+func (c *Config) serverLease() time.Duration {
+	if c.ServerLeaseSeconds < 0 {
+		return 0
+	}
+	if c.ServerLeaseSeconds == 0 {
+		return 90 * time.Second
+	}
+	return time.Duration(c.ServerLeaseSeconds) * time.Second
+}
+
+// rateLimit returns a configured rate limit, the fallback if it is unset or 0 if it is disabled
+func rateLimit(configured int, fallback int) int {
+	if configured < 0 {
+		return 0
+	}
+	if configured == 0 {
+		return fallback
+	}
+	return configured
+}
+
+// oidcAudiences returns the configured provider token audiences
+func (c *Config) oidcAudiences() []string {
+	var audiences []string
+	for _, aud := range strings.Split(c.OIDCAudiences, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+	return audiences
+}
+
+// issuer returns the configured issuer name or the default one
+func (c *Config) issuer() string {
+	if c.Issuer == "" {
+		return "zdvv-control-server"
+	}
+	return c.Issuer
 }
 
 func main() {
@@ -46,8 +195,29 @@ func main() {
 
 	log.Println("Successfully connected to Redis")
 
+	if cfg.OIDCDiscoveryURL == "" && !cfg.AllowAnonymousTokens {
+		log.Println("Warning: neither ZDVV_OIDC_DISCOVERY_URL nor ZDVV_ALLOW_ANONYMOUS_TOKENS is set, no tokens can be issued")
+	}
+
+	if cfg.ProofOfWork && cfg.ProofOfWorkSecret == "" {
+		log.Println("Warning: ZDVV_PROOF_OF_WORK_SECRET is not set, challenges can only be redeemed at the instance that issued them")
+	}
+
+	// Proxies know the shared secret, it must not open the admin routes
+	if cfg.AdminSecret == "my-secret-key" || (cfg.AdminSecret != "" && cfg.AdminSecret == cfg.AuthSecret) {
+		log.Fatal("ZDVV_ADMIN_SECRET must be neither the default secret nor ZDVV_AUTH_SECRET")
+	}
+
+	if cfg.ServerPairing && cfg.AdminTOTPSecret == "" {
+		log.Fatal("ZDVV_SERVER_PAIRING requires ZDVV_ADMIN_TOTP_SECRET, otherwise no server could ever be approved; " +
+			"set ZDVV_SERVER_PAIRING=false to list servers registered with the shared secret right away")
+	}
+
 	// Initialize the RedisDatabase
 	db := NewRedisDatabase(rdb)
+	if err := db.IndexServers(); err != nil {
+		log.Fatalf("Failed to index servers: %v", err)
+	}
 	r := createRouter(db, cfg)
 
 	log.Printf("Starting control server on %s", cfg.ListenAddr)
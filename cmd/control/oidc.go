@@ -0,0 +1,131 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// oidcDiscoverySuffix is appended to an issuer to form its discovery URL (OpenID Connect Discovery 1.0)
+const oidcDiscoverySuffix = "/.well-known/openid-configuration"
+
+// ErrInvalidIdentityToken is returned when a token of the identity provider is rejected
+var ErrInvalidIdentityToken = errors.New("invalid identity token")
+
+// OIDCVerifier validates access or ID tokens issued by an OAuth2/OIDC identity provider
+type OIDCVerifier struct {
+	discoveryURL string
+	clientID     string
+	audiences    []string
+	client       *http.Client
+
+	mutex     sync.Mutex
+	validator *auth.MultiKeyJWTValidator
+}
+
+// oidcProviderMetadata holds the parts of the discovery document the verifier needs
+type oidcProviderMetadata struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// NewOIDCVerifier creates a verifier for the provider at discoveryURL.
+// Tokens must be issued to one of the audiences, which default to the client ID.
+func NewOIDCVerifier(discoveryURL, clientID string, audiences []string) *OIDCVerifier {
+	if len(audiences) == 0 {
+		audiences = []string{clientID}
+	}
+	return &OIDCVerifier{
+		discoveryURL: discoveryURL,
+		clientID:     clientID,
+		audiences:    audiences,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Verify validates a token of the identity provider and returns the end-user's subject
+func (o *OIDCVerifier) Verify(tokenStr string) (string, error) {
+	validator, err := o.getValidator()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := validator.ValidateToken(tokenStr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidIdentityToken, err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	audiences, err := claims.GetAudience()
+	if err != nil || !slices.ContainsFunc(audiences, func(aud string) bool { return slices.Contains(o.audiences, aud) }) {
+		return "", fmt.Errorf("%w: audience not accepted", ErrInvalidIdentityToken)
+	}
+	// ID tokens name the client they were issued to in azp, access tokens (RFC 9068) in client_id
+	for _, claim := range []string{"azp", "client_id"} {
+		if party, ok := claims[claim].(string); ok && party != o.clientID {
+			return "", fmt.Errorf("%w: issued to another client", ErrInvalidIdentityToken)
+		}
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return "", fmt.Errorf("%w: missing subject", ErrInvalidIdentityToken)
+	}
+	return subject, nil
+}
+
+// getValidator discovers the provider on first use, a failed discovery is retried on the next call
+func (o *OIDCVerifier) getValidator() (*auth.MultiKeyJWTValidator, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.validator != nil {
+		return o.validator, nil
+	}
+
+	metadata, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("OIDC: discovered issuer %s with JWKS at %s", metadata.Issuer, metadata.JWKSURI)
+	o.validator = auth.NewMultiKeyJWTValidator(nil, nil,
+		auth.WithIssuers(auth.Issuer{Name: metadata.Issuer, Keys: auth.NewHTTPKeyProvider(metadata.JWKSURI)}))
+	return o.validator, nil
+}
+
+// discover fetches the provider metadata from the discovery URL
+func (o *OIDCVerifier) discover() (*oidcProviderMetadata, error) {
+	resp, err := o.client.Get(o.discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from OIDC discovery endpoint: %d", resp.StatusCode)
+	}
+
+	var metadata oidcProviderMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC discovery document: %w", err)
+	}
+	if metadata.Issuer == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document lacks issuer or jwks_uri")
+	}
+	// The issuer must be the one the discovery URL was derived from, or tokens of another provider could pass
+	if strings.TrimSuffix(metadata.Issuer, "/")+oidcDiscoverySuffix != o.discoveryURL {
+		return nil, fmt.Errorf("OIDC issuer %s does not match discovery URL %s", metadata.Issuer, o.discoveryURL)
+	}
+	return &metadata, nil
+}
@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// stubIdP is a minimal OIDC provider serving discovery and JWKS documents
+type stubIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// issuer announced in the discovery document, defaults to the server URL
+	issuer string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	idp := &stubIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoverySuffix, func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.issuer
+		if issuer == "" {
+			issuer = idp.server.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer,
+			"jwks_uri": idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, err := auth.NewJWK(&key.PublicKey)
+		if err != nil {
+			t.Errorf("failed to encode key: %v", err)
+			return
+		}
+		jwk.Kid = "idp-key"
+		jwk.Use = "sig"
+		json.NewEncoder(w).Encode(map[string][]*auth.JWK{"keys": {jwk}})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *stubIdP) discoveryURL() string {
+	return idp.server.URL + oidcDiscoverySuffix
+}
+
+// token signs an ID token, overrides replace or with nil remove the default claims
+func (idp *stubIdP) token(t *testing.T, overrides jwt.MapClaims) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"iss": idp.server.URL,
+		"sub": "user-123",
+		"aud": "zdvv-client",
+		"azp": "zdvv-client",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-key"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	idp := newStubIdP(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": idp.server.URL, "sub": "user-123", "aud": "zdvv-client", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	forged.Header["kid"] = "idp-key"
+	forgedToken, _ := forged.SignedString(otherKey)
+
+	tests := []struct {
+		name      string
+		token     string
+		audiences []string
+		wantErr   bool
+	}{
+		{name: "Valid ID token", token: idp.token(t, nil)},
+		{name: "Access token without azp", token: idp.token(t, jwt.MapClaims{"azp": nil, "client_id": "zdvv-client"})},
+		{name: "Configured audience", token: idp.token(t, jwt.MapClaims{"aud": "zdvv-api"}), audiences: []string{"zdvv-api"}},
+		{name: "Wrong audience", token: idp.token(t, jwt.MapClaims{"aud": "other-client"}), wantErr: true},
+		{name: "Other client", token: idp.token(t, jwt.MapClaims{"azp": "other-client"}), wantErr: true},
+		{name: "Wrong issuer", token: idp.token(t, jwt.MapClaims{"iss": "https://evil.example"}), wantErr: true},
+		{name: "Expired", token: idp.token(t, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), wantErr: true},
+		{name: "Missing subject", token: idp.token(t, jwt.MapClaims{"sub": nil}), wantErr: true},
+		{name: "Forged signature", token: forgedToken, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewOIDCVerifier(idp.discoveryURL(), "zdvv-client", tt.audiences)
+			subject, err := verifier.Verify(tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIdentityToken) {
+					t.Errorf("expected ErrInvalidIdentityToken, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if subject != "user-123" {
+				t.Errorf("expected subject user-123, got %q", subject)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifierDiscoveryMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	// The discovery document names an issuer the URL was not derived from
+	idp.issuer = "https://evil.example"
+	verifier := NewOIDCVerifier(idp.discoveryURL(), "zdvv-client", nil)
+	if _, err := verifier.Verify(idp.token(t, jwt.MapClaims{"iss": idp.issuer})); err == nil || errors.Is(err, ErrInvalidIdentityToken) {
+		t.Errorf("expected discovery error, got %v", err)
+	}
+}
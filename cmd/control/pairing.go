@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+)
+
+const (
+	// pairingLifetime is how long a registration waits for approval, and how long the
+	// credentials of an approved one wait for the proxy to pick them up
+	pairingLifetime = 24 * time.Hour
+	// pairingCodeAlphabet leaves out characters that are easily confused, like 0 and O
+	pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	pairingCodeLength   = 8
+)
+
+// PendingServer is a server registration waiting for an admin to approve it. The proxy logs the
+// code for the admin and polls the registration with its token, only a hash of the token is stored.
+type PendingServer struct {
+	Server common.Server
+	// Code is the pairing code the admin approves the server with, e.g. ABCD-EFGH
+	Code string
+	// TokenHash is the hex encoded SHA-256 of the pairing token handed to the proxy
+	TokenHash   string
+	RequestedAt time.Time
+	ExpiresAt   time.Time
+	// ServerID and RevocationToken are set once the server was approved
+	ServerID        string
+	RevocationToken string
+	// APIKey is the proxy's own credential, set on approval alongside Server.Owner
+	APIKey string
+}
+
+// Approved reports whether an admin approved the server
+func (p *PendingServer) Approved() bool {
+	return p.RevocationToken != ""
+}
+
+// newPendingServer creates a pending registration, returning the pairing token for the proxy with it
+func newPendingServer(server common.Server) (string, *PendingServer, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	codeBytes := make([]byte, pairingCodeLength)
+	if _, err := rand.Read(codeBytes); err != nil {
+		return "", nil, err
+	}
+	var code strings.Builder
+	for i, b := range codeBytes {
+		if i == pairingCodeLength/2 {
+			code.WriteByte('-')
+		}
+		// The alphabet has 32 characters, so every byte maps to one without bias
+		code.WriteByte(pairingCodeAlphabet[int(b)%len(pairingCodeAlphabet)])
+	}
+
+	now := time.Now()
+	server.ID, server.RevocationToken = "", ""
+	server.State = common.ServerStatePending
+	return token, &PendingServer{
+		Server:      server,
+		Code:        code.String(),
+		TokenHash:   hashPairingToken(token),
+		RequestedAt: now,
+		ExpiresAt:   now.Add(pairingLifetime),
+	}, nil
+}
+
+// normalizePairingCode accepts codes typed in lower case or without the dash
+func normalizePairingCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(code, "-", ""))
+	if len(code) != pairingCodeLength {
+		return code
+	}
+	return code[:pairingCodeLength/2] + "-" + code[pairingCodeLength/2:]
+}
+
+// hashPairingToken returns the hash a pairing token is stored under
+func hashPairingToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,188 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	// powChallengeLifetime is how long a client has to solve a challenge
+	powChallengeLifetime = 2 * time.Minute
+	// powMaxExtraDifficulty caps how many bits the issuance rate adds to the base difficulty,
+	// every bit doubles the expected work
+	powMaxExtraDifficulty = 8
+	// powRateWindow is the window the issuance rate is measured over
+	powRateWindow = time.Minute
+	// powMaxNonceLength bounds the solutions clients may send
+	powMaxNonceLength = 64
+
+	powRandomSize = 16
+	powMACSize    = 16
+	// expiry, difficulty and random bytes
+	powPayloadSize = 8 + 1 + powRandomSize
+)
+
+var (
+	// ErrInvalidChallenge is returned for challenges not issued by this server or already expired
+	ErrInvalidChallenge = errors.New("invalid or expired challenge")
+	// ErrInsufficientWork is returned when a solution does not meet the difficulty of its challenge
+	ErrInsufficientWork = errors.New("solution does not meet the challenge difficulty")
+)
+
+// proofOfWork issues and checks hashcash style challenges. A challenge is solved by finding a nonce
+// so that SHA-256(challenge || nonce) starts with difficulty zero bits. Challenges are signed, so the
+// server keeps no state until one is redeemed.
+type proofOfWork struct {
+	key            []byte
+	baseDifficulty int
+	// targetRate is the number of anonymous issuances per window before the difficulty grows
+	targetRate int
+
+	mutex       sync.Mutex
+	windowStart time.Time
+	current     int
+	previous    int
+}
+
+// powChallenge is a decoded challenge
+type powChallenge struct {
+	// ID identifies the challenge to detect reuse of a solution
+	ID         string
+	Difficulty int
+	ExpiresAt  time.Time
+}
+
+// newProofOfWork creates challenges signed with secret, a random secret is used if it is empty
+func newProofOfWork(secret string, baseDifficulty int, targetRate int) (*proofOfWork, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &proofOfWork{
+		key:            key,
+		baseDifficulty: baseDifficulty,
+		targetRate:     targetRate,
+		windowStart:    time.Now(),
+	}, nil
+}
+
+// newChallenge returns an encoded challenge at the current difficulty
+func (p *proofOfWork) newChallenge() (string, *powChallenge, error) {
+	payload := make([]byte, powPayloadSize)
+	if _, err := rand.Read(payload[9:]); err != nil {
+		return "", nil, err
+	}
+	challenge := &powChallenge{
+		ID:         hex.EncodeToString(payload[9:]),
+		Difficulty: p.difficulty(),
+		ExpiresAt:  time.Now().Add(powChallengeLifetime).Truncate(time.Second),
+	}
+	binary.BigEndian.PutUint64(payload, uint64(challenge.ExpiresAt.Unix()))
+	payload[8] = uint8(challenge.Difficulty)
+
+	return base64.RawURLEncoding.EncodeToString(append(payload, p.mac(payload)...)), challenge, nil
+}
+
+// verify checks the signature, expiry and solution of a challenge. Reuse is not detected here,
+// callers record the returned challenge ID until it expires.
+func (p *proofOfWork) verify(encoded string, nonce string) (*powChallenge, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(data) != powPayloadSize+powMACSize {
+		return nil, ErrInvalidChallenge
+	}
+	payload := data[:powPayloadSize]
+	if !hmac.Equal(data[powPayloadSize:], p.mac(payload)) {
+		return nil, ErrInvalidChallenge
+	}
+	challenge := &powChallenge{
+		ID:         hex.EncodeToString(payload[9:]),
+		Difficulty: int(payload[8]),
+		ExpiresAt:  time.Unix(int64(binary.BigEndian.Uint64(payload)), 0),
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrInvalidChallenge
+	}
+
+	if nonce == "" || len(nonce) > powMaxNonceLength {
+		return nil, ErrInsufficientWork
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(encoded+nonce))) < challenge.Difficulty {
+		return nil, ErrInsufficientWork
+	}
+	return challenge, nil
+}
+
+// recordIssuance counts a token issued after solving a challenge towards the issuance rate
+func (p *proofOfWork) recordIssuance() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.advanceLocked(time.Now())
+	p.current++
+}
+
+// difficulty returns the base difficulty plus one bit for every doubling of the issuance rate over the target
+func (p *proofOfWork) difficulty() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	p.advanceLocked(now)
+
+	// Sliding window estimate: the previous window counts for the part still overlapping the last minute
+	overlap := 1 - float64(now.Sub(p.windowStart))/float64(powRateWindow)
+	rate := float64(p.previous)*overlap + float64(p.current)
+
+	extra := 0
+	for threshold := float64(p.targetRate); rate > threshold && extra < powMaxExtraDifficulty; threshold *= 2 {
+		extra++
+	}
+	return p.baseDifficulty + extra
+}
+
+// advanceLocked moves the rate window forward to now
+func (p *proofOfWork) advanceLocked(now time.Time) {
+	elapsed := now.Sub(p.windowStart)
+	if elapsed < powRateWindow {
+		return
+	}
+	if elapsed < 2*powRateWindow {
+		p.previous = p.current
+		p.windowStart = p.windowStart.Add(powRateWindow)
+	} else {
+		p.previous = 0
+		p.windowStart = now
+	}
+	p.current = 0
+}
+
+func (p *proofOfWork) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, p.key)
+	h.Write(payload)
+	return h.Sum(nil)[:powMACSize]
+}
+
+// leadingZeroBits counts the zero bits a hash starts with
+func leadingZeroBits(hash [32]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProofOfWorkDifficulty(t *testing.T) {
+	pow, err := newProofOfWork("secret", 10, 4)
+	if err != nil {
+		t.Fatalf("failed to set up proof-of-work: %v", err)
+	}
+
+	tests := []struct {
+		issued   int
+		expected int
+	}{
+		{0, 10},
+		{4, 10},  // at the target rate
+		{5, 11},  // over the target
+		{16, 12}, // four times the target
+		{1000, 10 + powMaxExtraDifficulty},
+	}
+	for _, tc := range tests {
+		pow.current = tc.issued
+		if got := pow.difficulty(); got != tc.expected {
+			t.Errorf("expected difficulty %d after %d issuances, got %d", tc.expected, tc.issued, got)
+		}
+	}
+
+	// The rate of a window fades out over the next one
+	pow.windowStart = time.Now().Add(-powRateWindow - powRateWindow/2)
+	pow.current = 16
+	if got := pow.difficulty(); got != 11 {
+		t.Errorf("expected difficulty 11 half a window later, got %d", got)
+	}
+	pow.windowStart = time.Now().Add(-3 * powRateWindow)
+	if got := pow.difficulty(); got != 10 {
+		t.Errorf("expected base difficulty after an idle window, got %d", got)
+	}
+}
+
+func TestProofOfWorkVerify(t *testing.T) {
+	pow, err := newProofOfWork("", 8, 60)
+	if err != nil {
+		t.Fatalf("failed to set up proof-of-work: %v", err)
+	}
+	challenge, decoded, err := pow.newChallenge()
+	if err != nil {
+		t.Fatalf("failed to create challenge: %v", err)
+	}
+	nonce := solveChallenge(challenge, decoded.Difficulty)
+
+	verified, err := pow.verify(challenge, nonce)
+	if err != nil {
+		t.Fatalf("expected solution to verify: %v", err)
+	}
+	if verified.ID != decoded.ID || !verified.ExpiresAt.Equal(decoded.ExpiresAt) {
+		t.Errorf("expected %+v, got %+v", decoded, verified)
+	}
+
+	other, _ := newProofOfWork("", 8, 60)
+	if _, err := other.verify(challenge, nonce); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expected ErrInvalidChallenge for another secret, got %v", err)
+	}
+	if _, err := pow.verify(challenge, ""); !errors.Is(err, ErrInsufficientWork) {
+		t.Errorf("expected ErrInsufficientWork without a nonce, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common/privacypass"
+)
+
+const (
+	// privateTokenKeyLifetime is how long an issuer key signs tokens. Every key splits users into
+	// a separate anonymity set, so keys rotate rarely.
+	privateTokenKeyLifetime = 7 * 24 * time.Hour
+	// privateTokenRedeemWindow is how long tokens stay redeemable after their key stopped signing
+	privateTokenRedeemWindow = 7 * 24 * time.Hour
+)
+
+// PrivateTokenKey is the public part of a Privacy Pass issuer key as published in the issuer directory
+type PrivateTokenKey struct {
+	// PublicKey is the base64url encoded RSASSA-PSS SubjectPublicKeyInfo
+	PublicKey string
+	NotBefore int64
+	// RedeemableUntil is when proxies stop accepting tokens of the key
+	RedeemableUntil int64
+}
+
+// privateTokenIssuer holds the Privacy Pass issuer key of this control server
+type privateTokenIssuer struct {
+	db        Database
+	mutex     sync.Mutex
+	key       *rsa.PrivateKey
+	keyID     [privacypass.Nid]byte
+	expiresAt time.Time
+}
+
+// currentKey returns the signing key, replacing it once it expired
+func (i *privateTokenIssuer) currentKey() (*rsa.PrivateKey, [privacypass.Nid]byte, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.key != nil && time.Now().Before(i.expiresAt) {
+		return i.key, i.keyID, nil
+	}
+
+	key, err := privacypass.GenerateKey()
+	if err != nil {
+		return nil, [privacypass.Nid]byte{}, fmt.Errorf("failed to create issuer key: %w", err)
+	}
+	der, err := privacypass.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, [privacypass.Nid]byte{}, err
+	}
+	keyID, err := privacypass.TokenKeyID(&key.PublicKey)
+	if err != nil {
+		return nil, [privacypass.Nid]byte{}, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(privateTokenKeyLifetime)
+	if err := i.db.PutPrivateTokenKey(&PrivateTokenKey{
+		PublicKey:       base64.RawURLEncoding.EncodeToString(der),
+		NotBefore:       now.Unix(),
+		RedeemableUntil: expiresAt.Add(privateTokenRedeemWindow).Unix(),
+	}); err != nil {
+		return nil, [privacypass.Nid]byte{}, fmt.Errorf("failed to store issuer key: %w", err)
+	}
+	log.Printf("Created Privacy Pass issuer key %x", keyID)
+
+	i.key, i.keyID, i.expiresAt = key, keyID, expiresAt
+	return key, keyID, nil
+}
@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultEnrollmentTokenLifetime is how long an enrollment token can be redeemed unless the admin chose otherwise
+const defaultEnrollmentTokenLifetime = 24 * time.Hour
+
+// EnrollmentToken is a one-time token an admin hands to a new proxy, which exchanges it for its own credential.
+// Only the hash of the token is stored.
+type EnrollmentToken struct {
+	// Hash is the hex encoded SHA-256 of the token
+	Hash string
+	// Name describes the proxy, it is carried over to the credential
+	Name      string
+	ExpiresAt time.Time
+}
+
+// ProxyCredential is the API key a single proxy authenticates to the control server with.
+// Only the hash of the key is stored.
+type ProxyCredential struct {
+	// ID identifies the proxy, servers registered with the credential are owned by it
+	ID string
+	// Hash is the hex encoded SHA-256 of the API key
+	Hash      string
+	Name      string
+	CreatedAt time.Time
+}
+
+// proxyIdentityKey is the context key of the ID of the authenticated proxy
+type proxyIdentityKey struct{}
+
+// newEnrollmentToken creates a random enrollment token, returning it with its stored state
+func newEnrollmentToken(name string, validFor time.Duration) (string, *EnrollmentToken, error) {
+	token, err := randomSecret(32)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &EnrollmentToken{
+		Hash:      hashCredential(token),
+		Name:      name,
+		ExpiresAt: time.Now().Add(validFor),
+	}, nil
+}
+
+// newProxyCredential creates a random API key for a proxy, returning it with its stored state
+func newProxyCredential(name string) (string, *ProxyCredential, error) {
+	apiKey, err := randomSecret(32)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := randomSecret(12)
+	if err != nil {
+		return "", nil, err
+	}
+	return apiKey, &ProxyCredential{
+		ID:        id,
+		Hash:      hashCredential(apiKey),
+		Name:      name,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// randomSecret returns size random bytes, base64url encoded
+func randomSecret(size int) (string, error) {
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashCredential returns the hash an enrollment token or API key is stored under
+func hashCredential(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// proxyIdentity returns the ID of the proxy that authenticated the request,
+// it is empty for requests authenticated with the shared secret
+func proxyIdentity(ctx context.Context) string {
+	id, _ := ctx.Value(proxyIdentityKey{}).(string)
+	return id
+}
+
+// proxyAuth lets requests carrying the shared secret or a proxy credential through,
+// the latter with the proxy identity in the request context
+func proxyAuth(db Database, secret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasSecret(r, secret) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			apiKey, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || apiKey == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			credential, err := db.GetProxyCredential(hashCredential(apiKey))
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to check credential", http.StatusInternalServerError)
+				log.Printf("Error retrieving proxy credential: %v", err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyIdentityKey{}, credential.ID)))
+		})
+	}
+}
+
+// hasSecret reports whether the request carries the secret as bearer token, an empty secret matches nothing
+func hasSecret(r *http.Request, secret string) bool {
+	expected := []byte("Bearer " + secret)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
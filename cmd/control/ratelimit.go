@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitPolicy allows Limit requests per Window for every identity
+type RateLimitPolicy struct {
+	// Name separates the counters of policies, identities share no counter across policies
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// rateLimiter enforces rate limit policies with counters in the database, so all replicas share them
+type rateLimiter struct {
+	db Database
+	// clientIPHeader is the header a trusted load balancer puts the client address into
+	clientIPHeader string
+}
+
+// allow counts a request of identity against policy and sets the RateLimit headers
+// (draft-ietf-httpapi-ratelimit-headers). Once the limit is exceeded a 429 is written and false returned.
+// Requests are let through when the counter cannot be updated.
+func (l *rateLimiter) allow(w http.ResponseWriter, policy RateLimitPolicy, identity string) bool {
+	if policy.Limit <= 0 {
+		return true
+	}
+	count, reset, err := l.db.IncrementRateLimit(fmt.Sprintf("%s:%s", policy.Name, identity), policy.Window)
+	if err != nil {
+		log.Printf("Error updating rate limit %s: %v", policy.Name, err)
+		return true
+	}
+
+	resetSeconds := strconv.Itoa(int((reset + time.Second - 1) / time.Second))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, int(policy.Window.Seconds())))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(max(int64(policy.Limit)-count, 0), 10))
+	w.Header().Set("RateLimit-Reset", resetSeconds)
+	if count > int64(policy.Limit) {
+		w.Header().Set("Retry-After", resetSeconds)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// middleware limits requests per client address
+func (l *rateLimiter) middleware(policy RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.allow(w, policy, "ip:"+l.clientIP(r)) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the address of the client, taken from the last entry of the client IP header
+// if one is configured, as that is the one added by the load balancer in front of the control server
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.clientIPHeader != "" {
+		if value := r.Header.Get(l.clientIPHeader); value != "" {
+			addresses := strings.Split(value, ",")
+			if ip := net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
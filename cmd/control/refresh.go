@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrRefreshTokenReused is returned when a rotated refresh token is presented again,
+// or any token of a family that was revoked because of such a reuse.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// RefreshToken is the stored state of an opaque refresh token. Only the hash of the token is kept.
+type RefreshToken struct {
+	// Hash is the hex encoded SHA-256 of the token handed to the client
+	Hash string
+	// FamilyID is shared by all tokens rotated from the same initial grant
+	FamilyID string
+	// Subject of the user the token was issued to
+	Subject string
+	// Server and Group are the audience options of the initial token request, re-applied on refresh
+	Server string
+	Group  string
+	// Confirmation is the DPoP key thumbprint access tokens are bound to, empty for bearer tokens
+	Confirmation string
+	ExpiresAt    time.Time
+}
+
+// newRefreshToken creates a random refresh token, returning it with its stored state.
+// An empty familyID starts a new family.
+func newRefreshToken(familyID string, validFor time.Duration) (string, *RefreshToken, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	if familyID == "" {
+		familyBytes := make([]byte, 16)
+		if _, err := rand.Read(familyBytes); err != nil {
+			return "", nil, err
+		}
+		familyID = hex.EncodeToString(familyBytes)
+	}
+
+	return token, &RefreshToken{
+		Hash:      hashRefreshToken(token),
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(validFor),
+	}, nil
+}
+
+// hashRefreshToken returns the hash a refresh token is stored under
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -5,27 +5,317 @@
 package main
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/strseb/zdvv/pkg/common"
 	"github.com/strseb/zdvv/pkg/common/auth"
+	"github.com/strseb/zdvv/pkg/common/privacypass"
 )
 
 func createRouter(db Database, cfg *Config) *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 
-	jwtKeyMutex := sync.RWMutex{}
-	jwtKey, err := common.NewJWTKey()
-	db.PutJWTKey(jwtKey) // Store the initial JWT key in the database
+	signers, err := newSignerBackend(cfg, db)
 	if err != nil {
-		log.Fatalf("Failed to create JWT key: %v", err)
+		log.Fatalf("Failed to set up signer backend: %v", err)
+	}
+	if !signers.Shared() {
+		log.Println("Warning: no key encryption key configured, signing keys are kept in memory and not shared between replicas")
+	}
+	signingKeys, err := newSigningKeyStore(db, signers, cfg.JWTAlgorithm, cfg.jwtKeyLifetime(), cfg.jwtKeyPrepublish())
+	if err != nil {
+		log.Fatalf("Failed to set up signing keys: %v", err)
+	}
+	// Another replica starting at the same time may hold the rotation lock while it creates the first key
+	for attempt := 1; ; attempt++ {
+		if _, err = signingKeys.activeKey(); err == nil || attempt == 30 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load JWT key: %v", err)
+	}
+	go signingKeys.run()
+
+	// Second factor for approving server pairings
+	var totpKey []byte
+	if cfg.AdminTOTPSecret != "" {
+		if totpKey, err = decodeTOTPSecret(cfg.AdminTOTPSecret); err != nil {
+			log.Fatalf("Invalid admin TOTP secret: %v", err)
+		}
+	}
+	// requireTOTP checks the admin's one-time password in the request body
+	requireTOTP := func(w http.ResponseWriter, r *http.Request) bool {
+		var confirmation struct {
+			TOTP string `json:"totp"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&confirmation); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return false
+		}
+		if totpKey == nil {
+			http.Error(w, "No admin TOTP secret configured", http.StatusForbidden)
+			return false
+		}
+		if !verifyTOTP(totpKey, confirmation.TOTP, time.Now()) {
+			http.Error(w, "Invalid TOTP code", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	// findPairing returns the registration waiting for approval with the given code
+	findPairing := func(w http.ResponseWriter, code string) (*PendingServer, bool) {
+		pendingServers, err := db.GetAllPendingServers()
+		if err != nil {
+			http.Error(w, "Failed to retrieve pending servers", http.StatusInternalServerError)
+			log.Printf("Error retrieving pending servers: %v", err)
+			return nil, false
+		}
+		code = normalizePairingCode(code)
+		for _, pending := range pendingServers {
+			if pending.Code == code && !pending.Approved() {
+				return pending, true
+			}
+		}
+		http.Error(w, "Unknown pairing code", http.StatusNotFound)
+		return nil, false
+	}
+	// findOwnServer returns the server with the revocation token, or nil if there is none.
+	// Proxies may only act on their own servers, the shared secret only on servers no proxy owns.
+	findOwnServer := func(w http.ResponseWriter, r *http.Request, revocationToken string) (*common.Server, bool) {
+		server, err := db.GetServerByRevocationToken(revocationToken)
+		if errors.Is(err, ErrNotFound) {
+			return nil, true
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve server", http.StatusInternalServerError)
+			log.Printf("Error retrieving server: %v", err)
+			return nil, false
+		}
+		if server.Owner != proxyIdentity(r.Context()) {
+			http.Error(w, "Server registered by another proxy", http.StatusForbidden)
+			return nil, false
+		}
+		return server, true
+	}
+	// findServer returns the server with the ID, responding with an error if there is none
+	findServer := func(w http.ResponseWriter, id string) (*common.Server, bool) {
+		server, err := db.GetServer(id)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return nil, false
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve server", http.StatusInternalServerError)
+			log.Printf("Error retrieving server: %v", err)
+			return nil, false
+		}
+		return server, true
+	}
+	// setServerState moves a server to a lifecycle state and responds with it
+	setServerState := func(w http.ResponseWriter, server *common.Server, state common.ServerState) {
+		if err := db.SetServerState(server.ID, state); errors.Is(err, ErrNotFound) {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to change server state", http.StatusInternalServerError)
+			log.Printf("Error changing state of server %s: %v", server.ProxyURL, err)
+			return
+		}
+		if state != server.State {
+			log.Printf("Server %s is now %s", server.ProxyURL, state)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    server.ID,
+			"state": state,
+		})
+	}
+
+	// Validates tokens issued by this control server for revocation and introspection
+	tokenValidator := auth.NewMultiKeyJWTValidator(nil, nil,
+		auth.WithIssuers(auth.Issuer{Name: cfg.issuer(), Keys: dbKeyProvider{db: db}}),
+		auth.WithKeyCacheTTL(ownKeyCacheTTL))
+
+	// Privacy Pass issuer, the key is created now so the issuer directory is never empty
+	tokenIssuer := &privateTokenIssuer{db: db}
+	if _, _, err := tokenIssuer.currentKey(); err != nil {
+		log.Fatalf("Failed to create Privacy Pass issuer key: %v", err)
+	}
+
+	if err := seedTiers(db); err != nil {
+		log.Fatalf("Failed to create default tiers: %v", err)
+	}
+
+	// Tokens are only handed to users authenticated by the identity provider
+	var identityVerifier *OIDCVerifier
+	if cfg.OIDCDiscoveryURL != "" {
+		identityVerifier = NewOIDCVerifier(cfg.OIDCDiscoveryURL, cfg.OIDCClientID, cfg.oidcAudiences())
+	}
+
+	// Rate limits are counted in the database, so they hold across replicas
+	limiter := &rateLimiter{db: db, clientIPHeader: cfg.ClientIPHeader}
+	issuanceLimit := limiter.middleware(RateLimitPolicy{
+		Name:   "issuance",
+		Limit:  rateLimit(cfg.RateLimitIssuance, 30),
+		Window: time.Minute,
+	})
+	userIssuancePolicy := RateLimitPolicy{
+		Name:   "user-issuance",
+		Limit:  rateLimit(cfg.RateLimitUserIssuance, 60),
+		Window: time.Minute,
+	}
+	serversLimit := limiter.middleware(RateLimitPolicy{
+		Name:   "servers",
+		Limit:  rateLimit(cfg.RateLimitServers, 60),
+		Window: time.Minute,
+	})
+
+	// Anonymous issuance is made expensive to script with proof-of-work challenges
+	var pow *proofOfWork
+	if cfg.ProofOfWork {
+		pow, err = newProofOfWork(cfg.ProofOfWorkSecret, cfg.proofOfWorkDifficulty(), cfg.proofOfWorkTargetRate())
+		if err != nil {
+			log.Fatalf("Failed to set up proof-of-work: %v", err)
+		}
+	}
+
+	// authenticateUser returns the subject of the end-user, who authenticates with an access or ID token
+	// of the identity provider. Anonymous users get an empty subject if allowed and, if required, after
+	// solving a proof-of-work challenge. Otherwise a 401 is written.
+	authenticateUser := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		if idToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && identityVerifier != nil {
+			subject, err := identityVerifier.Verify(idToken)
+			if errors.Is(err, ErrInvalidIdentityToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Invalid identity token", http.StatusUnauthorized)
+				return "", false
+			}
+			if err != nil {
+				http.Error(w, "Failed to verify identity token", http.StatusBadGateway)
+				log.Printf("Error verifying identity token: %v", err)
+				return "", false
+			}
+			// Users switching addresses still share a limit
+			if !limiter.allow(w, userIssuancePolicy, "sub:"+subject) {
+				return "", false
+			}
+			return subject, true
+		}
+		if !cfg.AllowAnonymousTokens {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return "", false
+		}
+		if pow != nil {
+			challenge, err := pow.verify(r.URL.Query().Get("pow_challenge"), r.URL.Query().Get("pow_nonce"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Proof of work required: %v", err), http.StatusUnauthorized)
+				return "", false
+			}
+			first, err := db.UseChallenge(challenge.ID, challenge.ExpiresAt)
+			if err != nil {
+				http.Error(w, "Failed to record challenge", http.StatusInternalServerError)
+				log.Printf("Error recording proof-of-work challenge: %v", err)
+				return "", false
+			}
+			if !first {
+				http.Error(w, "Proof of work required: challenge already used", http.StatusUnauthorized)
+				return "", false
+			}
+			pow.recordIssuance()
+		}
+		return "", true
+	}
+
+	// issueTokens answers a token request with an access token following the user's tier,
+	// plus a refresh token for authenticated users
+	issueTokens := func(w http.ResponseWriter, grant tokenGrant) {
+		// The user's tier decides what the token may do
+		tier, err := tierForUser(db, grant.Subject, cfg.defaultTier())
+		if err != nil {
+			http.Error(w, "Failed to retrieve tier", http.StatusInternalServerError)
+			log.Printf("Error retrieving tier of %q: %v", grant.Subject, err)
+			return
+		}
+
+		audience, status, err := tokenAudience(db, tier, grant.Server, grant.Group)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// Sign the token with the permissions of the tier
+		permissions := tierPermissions(tier)
+		var legacyClaims []string
+		if cfg.LegacyPermissionClaims {
+			for _, perm := range permissions {
+				if claim := perm.LegacyClaim(); claim != "" {
+					legacyClaims = append(legacyClaims, claim)
+				}
+			}
+		}
+		validFor := time.Duration(tier.TokenTTL) * time.Second
+		signedToken, err := signingKeys.Sign(common.TokenRequest{
+			Issuer:         cfg.issuer(),
+			Subject:        grant.Subject,
+			Audience:       audience,
+			ValidFor:       validFor,
+			Permissions:    auth.GetPermissionStrings(permissions),
+			LegacyClaims:   legacyClaims,
+			Confirmation:   grant.Confirmation,
+			MaxUses:        grant.MaxUses,
+			BandwidthLimit: tier.BandwidthLimit,
+		})
+		if err != nil {
+			http.Error(w, "Failed to sign JWT token", http.StatusInternalServerError)
+			log.Printf("Error signing JWT token: %v", err)
+			return
+		}
+		response := map[string]interface{}{
+			"token":      signedToken,
+			"expires_in": int64(validFor.Seconds()),
+		}
+
+		// Anonymous users can simply ask again, one-shot tokens are not meant to be renewed
+		if grant.Subject != "" && grant.MaxUses == 0 {
+			refreshToken, stored, err := newRefreshToken(grant.RefreshFamily, cfg.refreshTokenTTL())
+			if err != nil {
+				http.Error(w, "Failed to create refresh token", http.StatusInternalServerError)
+				return
+			}
+			stored.Subject = grant.Subject
+			stored.Server = grant.Server
+			stored.Group = grant.Group
+			stored.Confirmation = grant.Confirmation
+			if err := db.PutRefreshToken(stored); err != nil {
+				http.Error(w, "Failed to store refresh token", http.StatusInternalServerError)
+				log.Printf("Error storing refresh token: %v", err)
+				return
+			}
+			response["refresh_token"] = refreshToken
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
 	}
 
 	r.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
@@ -49,6 +339,35 @@ func createRouter(db Database, cfg *Config) *chi.Mux {
 		json.NewEncoder(w).Encode(jwks)
 	})
 
+	// Privacy Pass issuer directory (RFC 9578 section 4)
+	r.Get(privacypass.DirectoryPath, func(w http.ResponseWriter, r *http.Request) {
+		keys, err := db.GetAllPrivateTokenKeys()
+		if err != nil {
+			http.Error(w, "Failed to retrieve issuer keys", http.StatusInternalServerError)
+			log.Printf("Error retrieving Privacy Pass issuer keys: %v", err)
+			return
+		}
+		// Newest key first, clients use the first key they support
+		slices.SortFunc(keys, func(a, b *PrivateTokenKey) int { return cmp.Compare(b.NotBefore, a.NotBefore) })
+
+		directory := privacypass.Directory{IssuerRequestURI: "/api/v1/private-token"}
+		now := time.Now().Unix()
+		for _, key := range keys {
+			if key.RedeemableUntil <= now {
+				continue
+			}
+			directory.TokenKeys = append(directory.TokenKeys, privacypass.DirectoryKey{
+				TokenType: privacypass.TokenTypeBlindRSA,
+				TokenKey:  key.PublicKey,
+				NotBefore: key.NotBefore,
+				ExpiresAt: key.RedeemableUntil,
+			})
+		}
+
+		w.Header().Set("Content-Type", privacypass.DirectoryMediaType)
+		json.NewEncoder(w).Encode(directory)
+	})
+
 	r.Route("/api/v1", func(r chi.Router) {
 		// Unauthenticated routes
 		r.Group(func(r chi.Router) {
@@ -57,81 +376,212 @@ func createRouter(db Database, cfg *Config) *chi.Mux {
 				w.Write([]byte("OK"))
 			})
 
-			r.Get("/token", func(w http.ResponseWriter, r *http.Request) {
-				jwtKeyMutex.RLock()
-				if jwtKey.IsExpired() {
-					jwtKeyMutex.RUnlock()
-					jwtKeyMutex.Lock()
-					defer jwtKeyMutex.Unlock()
-					if jwtKey.IsExpired() {
-						newKey, err := common.NewJWTKey()
-						db.PutJWTKey(jwtKey)
-						if err != nil {
-							http.Error(w, "Failed to create new JWT key", http.StatusInternalServerError)
-							return
-						}
-						if err := db.PutJWTKey(newKey); err != nil {
-							http.Error(w, "Failed to store new JWT key", http.StatusInternalServerError)
-							log.Printf("Error storing new JWT key: %v", err)
-							return
-						}
-						jwtKey = newKey
+			r.With(issuanceLimit).Get("/token", func(w http.ResponseWriter, r *http.Request) {
+				subject, ok := authenticateUser(w, r)
+				if !ok {
+					return
+				}
+
+				// Tokens can optionally be bound to a single server or a fleet group
+				grant := tokenGrant{
+					Subject: subject,
+					Server:  r.URL.Query().Get("server"),
+					Group:   r.URL.Query().Get("group"),
+				}
+				if grant.Server != "" && grant.Group != "" {
+					http.Error(w, "server and group are mutually exclusive", http.StatusBadRequest)
+					return
+				}
+
+				// Tokens can optionally be bound to a DPoP key by its JWK thumbprint
+				grant.Confirmation = r.URL.Query().Get("dpop_jkt")
+				if grant.Confirmation != "" && !isThumbprint(grant.Confirmation) {
+					http.Error(w, "Invalid dpop_jkt", http.StatusBadRequest)
+					return
+				}
+
+				// One-shot tokens may open a single tunnel only
+				if singleUse := r.URL.Query().Get("single_use"); singleUse != "" {
+					enabled, err := strconv.ParseBool(singleUse)
+					if err != nil {
+						http.Error(w, "Invalid single_use", http.StatusBadRequest)
+						return
+					}
+					if enabled {
+						grant.MaxUses = 1
 					}
-				} else {
-					defer jwtKeyMutex.RUnlock()
 				}
 
-				// Sign the token using the SignWithClaims method with specific permissions
-				signedToken, err := jwtKey.SignWithClaims(
-					"zdvv-control-server",
-					time.Hour*1,
-					auth.GetPermissionStrings([]auth.Permission{auth.PERMISSION_CONNECT_TCP}),
-				)
+				issueTokens(w, grant)
+			})
+
+			// Proof-of-work challenge for anonymous token requests
+			r.With(issuanceLimit).Get("/token/challenge", func(w http.ResponseWriter, r *http.Request) {
+				if pow == nil {
+					http.Error(w, "Proof of work is not enabled", http.StatusNotFound)
+					return
+				}
+				challenge, decoded, err := pow.newChallenge()
 				if err != nil {
-					http.Error(w, "Failed to sign JWT token", http.StatusInternalServerError)
-					log.Printf("Error signing JWT token: %v", err)
+					http.Error(w, "Failed to create challenge", http.StatusInternalServerError)
 					return
 				}
 				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Cache-Control", "no-store")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"challenge":  challenge,
+					"difficulty": decoded.Difficulty,
+					"expires_in": int64(time.Until(decoded.ExpiresAt).Seconds()),
+				})
+			})
+
+			// Refresh token grant, rotates the refresh token on every use
+			r.With(issuanceLimit).Post("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+				refreshToken := r.PostFormValue("refresh_token")
+				if refreshToken == "" {
+					http.Error(w, "Missing refresh_token", http.StatusBadRequest)
+					return
+				}
+
+				stored, err := db.ConsumeRefreshToken(hashRefreshToken(refreshToken))
+				if errors.Is(err, ErrRefreshTokenReused) {
+					// A rotated token showing up again means it leaked, end the whole family
+					log.Printf("Refresh token reuse detected for %q, revoking family %s", stored.Subject, stored.FamilyID)
+					if err := db.RevokeRefreshTokenFamily(stored.FamilyID, time.Now().Add(cfg.refreshTokenTTL())); err != nil {
+						log.Printf("Error revoking refresh token family %s: %v", stored.FamilyID, err)
+					}
+					http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+					return
+				}
+				if errors.Is(err, ErrNotFound) || (err == nil && time.Now().After(stored.ExpiresAt)) {
+					http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					http.Error(w, "Failed to retrieve refresh token", http.StatusInternalServerError)
+					log.Printf("Error consuming refresh token: %v", err)
+					return
+				}
+
+				issueTokens(w, tokenGrant{
+					Subject:       stored.Subject,
+					Server:        stored.Server,
+					Group:         stored.Group,
+					Confirmation:  stored.Confirmation,
+					RefreshFamily: stored.FamilyID,
+				})
+			})
+
+			// Privacy Pass issuance (RFC 9578), the signed tokens cannot be linked to this request
+			r.With(issuanceLimit).Post("/private-token", func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := authenticateUser(w, r); !ok {
+					return
+				}
+				if r.Header.Get("Content-Type") != privacypass.TokenRequestMediaType {
+					http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+					return
+				}
+				body, err := io.ReadAll(io.LimitReader(r.Body, 3+privacypass.Nk+1))
+				if err != nil {
+					http.Error(w, "Failed to read token request", http.StatusBadRequest)
+					return
+				}
+				tokenRequest, err := privacypass.UnmarshalTokenRequest(body)
+				if err != nil {
+					http.Error(w, "Invalid token request", http.StatusBadRequest)
+					return
+				}
+
+				key, keyID, err := tokenIssuer.currentKey()
+				if err != nil {
+					http.Error(w, "Failed to retrieve issuer key", http.StatusInternalServerError)
+					log.Printf("Error retrieving Privacy Pass issuer key: %v", err)
+					return
+				}
+				if tokenRequest.TruncatedTokenKeyID != keyID[privacypass.Nid-1] {
+					http.Error(w, "Unknown token key", http.StatusBadRequest)
+					return
+				}
+				blindSignature, err := privacypass.BlindSign(key, tokenRequest)
+				if err != nil {
+					http.Error(w, "Failed to sign token request", http.StatusBadRequest)
+					log.Printf("Error signing Privacy Pass token request: %v", err)
+					return
+				}
+
+				w.Header().Set("Content-Type", privacypass.TokenResponseMediaType)
 				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(`{"token":"` + signedToken + `"}`))
+				w.Write(blindSignature)
 			})
 
-			r.Get("/servers", func(w http.ResponseWriter, r *http.Request) {
+			r.With(serversLimit).Get("/servers", func(w http.ResponseWriter, r *http.Request) {
 				servers, err := db.GetAllServers()
 				if err != nil {
 					http.Error(w, "Failed to retrieve servers", http.StatusInternalServerError)
 					log.Printf("Error retrieving servers: %v", err)
 					return
 				}
+				// Draining and disabled servers take no new clients
+				servers = slices.DeleteFunc(servers, func(s *common.Server) bool { return s.State != common.ServerStateActive })
 
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(map[string]interface{}{
 					"servers": servers,
 				})
 			})
-		})
 
-		// Authenticated routes
-		r.Group(func(r chi.Router) {
-			r.Use(func(next http.Handler) http.Handler {
-				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					authHeader := r.Header.Get("Authorization")
-					expectedAuth := "Bearer " + cfg.AuthSecret
-					if authHeader != expectedAuth {
-						http.Error(w, "Unauthorized", http.StatusUnauthorized)
-						return
-					}
-					next.ServeHTTP(w, r)
+			// Exchanges a one-time enrollment token for the proxy's own API key
+			r.Post("/enroll", func(w http.ResponseWriter, r *http.Request) {
+				enrollmentToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || enrollmentToken == "" {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				enrollment, err := db.ConsumeEnrollmentToken(hashCredential(enrollmentToken))
+				if errors.Is(err, ErrNotFound) {
+					http.Error(w, "Invalid or used enrollment token", http.StatusUnauthorized)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to redeem enrollment token", http.StatusInternalServerError)
+					log.Printf("Error redeeming enrollment token: %v", err)
+					return
+				}
+
+				apiKey, credential, err := newProxyCredential(enrollment.Name)
+				if err != nil {
+					http.Error(w, "Failed to create credential", http.StatusInternalServerError)
+					return
+				}
+				if err := db.PutProxyCredential(credential); err != nil {
+					http.Error(w, "Failed to store credential", http.StatusInternalServerError)
+					log.Printf("Error storing proxy credential %s: %v", credential.ID, err)
+					return
+				}
+				log.Printf("Enrolled proxy %s as %s", credential.Name, credential.ID)
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{
+					"id":     credential.ID,
+					"apiKey": apiKey,
 				})
 			})
+		})
+
+		// Routes called by proxies, authenticated with their own credential or the shared secret
+		r.Group(func(r chi.Router) {
+			r.Use(proxyAuth(db, cfg.AuthSecret))
 
 			r.Post("/server", func(w http.ResponseWriter, r *http.Request) {
-				var server common.Server
-				if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+				var request struct {
+					common.Server
+					// RevocationToken is the current token of a server registering again
+					RevocationToken string `json:"revocationToken"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 					http.Error(w, "Invalid request payload", http.StatusBadRequest)
 					return
 				}
+				server := request.Server
 
 				// Validate the server object
 				if valid, message := server.IsValid(); !valid {
@@ -139,25 +589,198 @@ func createRouter(db Database, cfg *Config) *chi.Mux {
 					return
 				}
 
+				server.Owner = proxyIdentity(r.Context())
+				server.State = common.ServerStateActive
+				existing, err := db.GetServer(server.ProxyURL)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					http.Error(w, "Failed to retrieve server", http.StatusInternalServerError)
+					log.Printf("Error retrieving server %s: %v", server.ProxyURL, err)
+					return
+				}
+				if err == nil {
+					// A proxy may not take over a server registered by someone else, nor may the shared secret
+					// take over the server of an enrolled proxy
+					if existing.Owner != server.Owner {
+						http.Error(w, "Server registered by another proxy", http.StatusForbidden)
+						return
+					}
+					// Registering again does not bring back a server taken out of service
+					if existing.State == common.ServerStateDraining || existing.State == common.ServerStateDisabled {
+						server.State = existing.State
+					}
+				}
+				// not even once its lease ran out
+				state, err := db.GetServerState(server.ProxyURL)
+				if err != nil {
+					http.Error(w, "Failed to retrieve server state", http.StatusInternalServerError)
+					log.Printf("Error retrieving state of server %s: %v", server.ProxyURL, err)
+					return
+				}
+				if state != common.ServerStateActive {
+					server.State = state
+				}
+
+				// Proxies with their own credential were vetted at enrollment or pairing. With the shared
+				// secret only the holder of the server's current revocation token registers it again unpaired.
+				reregistration := existing != nil && request.RevocationToken != "" &&
+					subtle.ConstantTimeCompare([]byte(request.RevocationToken), []byte(existing.RevocationToken)) == 1
+				if cfg.ServerPairing && server.Owner == "" && !reregistration {
+					pairingToken, pending, err := newPendingServer(server)
+					if err != nil {
+						http.Error(w, "Failed to create pairing", http.StatusInternalServerError)
+						return
+					}
+					if err := db.PutPendingServer(pending); err != nil {
+						http.Error(w, "Failed to store pairing", http.StatusInternalServerError)
+						log.Printf("Error storing pending server %s: %v", server.ProxyURL, err)
+						return
+					}
+					log.Printf("Server %s requested pairing with code %s", server.ProxyURL, pending.Code)
+
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusAccepted)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"pairingCode":  pending.Code,
+						"pairingToken": pairingToken,
+						"expiresIn":    int(pairingLifetime.Seconds()),
+					})
+					return
+				}
+
 				revocationToken, err := server.GenerateRevocationToken()
 				if err != nil {
 					http.Error(w, "Failed to generate revocation token", http.StatusInternalServerError)
 					return
 				}
+				serverID, err := server.GenerateID()
+				if err != nil {
+					http.Error(w, "Failed to generate server ID", http.StatusInternalServerError)
+					return
+				}
 
-				if err := db.AddServer(&server); err != nil {
+				if err := db.AddServer(&server, cfg.serverLease()); err != nil {
 					http.Error(w, "Failed to add server", http.StatusInternalServerError)
 					return
 				}
 
 				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"id":              serverID,
 					"revocationToken": revocationToken,
+					"leaseSeconds":    int(cfg.serverLease().Seconds()),
+					"state":           server.State,
+				})
+			})
+
+			// Polled by a proxy until an admin approved its pairing code
+			r.Get("/server/pairing/{pairingToken}", func(w http.ResponseWriter, r *http.Request) {
+				tokenHash := hashPairingToken(chi.URLParam(r, "pairingToken"))
+				pending, err := db.GetPendingServer(tokenHash)
+				if errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unknown or expired pairing", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to retrieve pairing", http.StatusInternalServerError)
+					log.Printf("Error retrieving pending server: %v", err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				if !pending.Approved() {
+					w.WriteHeader(http.StatusAccepted)
+					json.NewEncoder(w).Encode(map[string]string{"status": "pending"})
+					return
+				}
+				// The credentials are handed out once
+				if err := db.RemovePendingServer(tokenHash); err != nil {
+					http.Error(w, "Failed to complete pairing", http.StatusInternalServerError)
+					log.Printf("Error removing pending server %s: %v", pending.Code, err)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"status":          "approved",
+					"id":              pending.ServerID,
+					"revocationToken": pending.RevocationToken,
+					"leaseSeconds":    int(cfg.serverLease().Seconds()),
+					"state":           cmp.Or(pending.Server.State, common.ServerStateActive),
+					"proxyId":         pending.Server.Owner,
+					"apiKey":          pending.APIKey,
+				})
+			})
+
+			// Renews the lease of a server, proxies call it well before the lease runs out
+			r.Post("/server/{revocationToken}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+				revocationToken := chi.URLParam(r, "revocationToken")
+				var heartbeat struct {
+					ActiveConnections int `json:"activeConnections"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil && !errors.Is(err, io.EOF) {
+					http.Error(w, "Invalid request payload", http.StatusBadRequest)
+					return
+				}
+				server, ok := findOwnServer(w, r, revocationToken)
+				if !ok {
+					return
+				}
+				if server == nil {
+					// The lease ran out or the server was removed, the proxy has to register again
+					http.Error(w, "Unknown server", http.StatusNotFound)
+					return
+				}
+
+				err := db.RenewServerLease(revocationToken, max(heartbeat.ActiveConnections, 0), cfg.serverLease())
+				if errors.Is(err, ErrNotFound) {
+					// The lease ran out or the server was removed, the proxy has to register again
+					http.Error(w, "Unknown server", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to renew lease", http.StatusInternalServerError)
+					log.Printf("Error renewing server lease: %v", err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"leaseSeconds": int(cfg.serverLease().Seconds()),
+					"state":        server.State,
 				})
 			})
 
+			// Moves a server to another lifecycle state, e.g. draining it before maintenance
+			r.Put("/server/{revocationToken}/state", func(w http.ResponseWriter, r *http.Request) {
+				var request struct {
+					State common.ServerState `json:"state"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !request.State.IsValid() {
+					http.Error(w, "Invalid server state", http.StatusBadRequest)
+					return
+				}
+				server, ok := findOwnServer(w, r, chi.URLParam(r, "revocationToken"))
+				if !ok {
+					return
+				}
+				if server == nil {
+					http.Error(w, "Unknown server", http.StatusNotFound)
+					return
+				}
+				// Proxies cannot overrule a server being taken out of service
+				if server.State == common.ServerStateDisabled && request.State != server.State {
+					http.Error(w, "Only an admin can enable a disabled server", http.StatusForbidden)
+					return
+				}
+				setServerState(w, server, request.State)
+			})
+
 			r.Delete("/server/{revocationToken}", func(w http.ResponseWriter, r *http.Request) {
 				revocationToken := chi.URLParam(r, "revocationToken")
+				server, ok := findOwnServer(w, r, revocationToken)
+				if !ok {
+					return
+				}
+				if server == nil {
+					http.Error(w, "Unknown server", http.StatusNotFound)
+					return
+				}
 				if err := db.RemoveServerByToken(revocationToken); err != nil {
 					http.Error(w, "Failed to remove server", http.StatusInternalServerError)
 					return
@@ -166,8 +789,633 @@ func createRouter(db Database, cfg *Config) *chi.Mux {
 				w.WriteHeader(http.StatusOK)
 				w.Write([]byte("Server removed successfully"))
 			})
+
+			// Token introspection (RFC 7662)
+			r.Post("/introspect", func(w http.ResponseWriter, r *http.Request) {
+				inactive := map[string]bool{"active": false}
+				w.Header().Set("Content-Type", "application/json")
+
+				token, err := tokenValidator.ValidateToken(r.PostFormValue("token"))
+				if err != nil {
+					json.NewEncoder(w).Encode(inactive)
+					return
+				}
+				claims := token.Claims.(jwt.MapClaims)
+				revoked, err := db.IsTokenRevoked(auth.TokenID(claims))
+				if err != nil {
+					http.Error(w, "Failed to check token revocation", http.StatusInternalServerError)
+					log.Printf("Error checking token revocation: %v", err)
+					return
+				}
+				if revoked {
+					json.NewEncoder(w).Encode(inactive)
+					return
+				}
+
+				response := map[string]interface{}{"active": true}
+				for name, value := range claims {
+					response[name] = value
+				}
+				json.NewEncoder(w).Encode(response)
+			})
 		})
-	})
 
-	return r
+		// Admin routes, authenticated with the admin secret or an admin user's API key. Every admin
+		// user may read, changes require the operator or admin role.
+		r.Group(func(r chi.Router) {
+			r.Use(adminAuth(db, cfg.AdminSecret))
+			r.Use(requireRole(AdminRoleViewer))
+			asOperator := r.With(requireRole(AdminRoleOperator))
+			asAdmin := r.With(requireRole(AdminRoleAdmin))
+
+			r.Get("/admin/servers", func(w http.ResponseWriter, r *http.Request) {
+				servers, err := db.GetAllServers()
+				if err != nil {
+					http.Error(w, "Failed to retrieve servers", http.StatusInternalServerError)
+					log.Printf("Error retrieving servers: %v", err)
+					return
+				}
+
+				views := []adminServer{}
+				for _, server := range servers {
+					views = append(views, newAdminServer(server))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"servers": views,
+				})
+			})
+
+			r.Get("/admin/servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				server, ok := findServer(w, chi.URLParam(r, "id"))
+				if !ok {
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(newAdminServer(server))
+			})
+
+			// Corrects the location, group or capabilities of a server, omitted fields are kept
+			asOperator.Patch("/admin/servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				var edit struct {
+					Group              *string  `json:"group"`
+					Latitude           *float64 `json:"latitude"`
+					Longitude          *float64 `json:"longitude"`
+					City               *string  `json:"city"`
+					Country            *string  `json:"country"`
+					SupportsConnectTCP *bool    `json:"supportsConnectTcp"`
+					SupportsConnectUDP *bool    `json:"supportsConnectUdp"`
+					SupportsConnectIP  *bool    `json:"supportsConnectIp"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+					http.Error(w, "Invalid request payload", http.StatusBadRequest)
+					return
+				}
+				found, ok := findServer(w, chi.URLParam(r, "id"))
+				if !ok {
+					return
+				}
+
+				server := *found
+				setIfPresent(&server.Group, edit.Group)
+				setIfPresent(&server.Latitude, edit.Latitude)
+				setIfPresent(&server.Longitude, edit.Longitude)
+				setIfPresent(&server.City, edit.City)
+				setIfPresent(&server.Country, edit.Country)
+				setIfPresent(&server.SupportsConnectTCP, edit.SupportsConnectTCP)
+				setIfPresent(&server.SupportsConnectUDP, edit.SupportsConnectUDP)
+				setIfPresent(&server.SupportsConnectIP, edit.SupportsConnectIP)
+				if valid, message := server.IsValid(); !valid {
+					http.Error(w, message, http.StatusBadRequest)
+					return
+				}
+
+				if err := db.UpdateServer(&server); errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unknown server", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to update server", http.StatusInternalServerError)
+					log.Printf("Error updating server %s: %v", server.ProxyURL, err)
+					return
+				}
+				log.Printf("%s updated server %s", adminCaller(r.Context()).Name, server.ProxyURL)
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(newAdminServer(&server))
+			})
+
+			// Removes a server, a proxy that is still running registers it again with its next heartbeat
+			asOperator.Delete("/admin/servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				server, ok := findServer(w, chi.URLParam(r, "id"))
+				if !ok {
+					return
+				}
+				if err := db.RemoveServerByToken(server.RevocationToken); err != nil {
+					http.Error(w, "Failed to remove server", http.StatusInternalServerError)
+					log.Printf("Error removing server %s: %v", server.ProxyURL, err)
+					return
+				}
+				log.Printf("%s removed server %s", adminCaller(r.Context()).Name, server.ProxyURL)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			asOperator.Put("/admin/servers/{id}/state", func(w http.ResponseWriter, r *http.Request) {
+				var request struct {
+					State common.ServerState `json:"state"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !request.State.IsValid() {
+					http.Error(w, "Invalid server state", http.StatusBadRequest)
+					return
+				}
+				server, ok := findServer(w, chi.URLParam(r, "id"))
+				if !ok {
+					return
+				}
+				log.Printf("%s moves server %s to state %s", adminCaller(r.Context()).Name, server.ProxyURL, request.State)
+				setServerState(w, server, request.State)
+			})
+
+			r.Get("/admin/keys", func(w http.ResponseWriter, r *http.Request) {
+				jwtKeys, err := db.GetAllActiveJWTKeys()
+				if err != nil {
+					http.Error(w, "Failed to retrieve keys", http.StatusInternalServerError)
+					log.Printf("Error retrieving JWT keys: %v", err)
+					return
+				}
+				roles, err := signingKeys.keyRoles()
+				if err != nil {
+					http.Error(w, "Failed to retrieve keys", http.StatusInternalServerError)
+					log.Printf("Error retrieving JWT key roles: %v", err)
+					return
+				}
+				slices.SortFunc(jwtKeys, func(a, b *common.JWTKey) int { return cmp.Compare(a.ExpiresAt, b.ExpiresAt) })
+
+				keys := []map[string]interface{}{}
+				for _, key := range jwtKeys {
+					keys = append(keys, map[string]interface{}{
+						"kid":         key.Kid,
+						"alg":         key.Alg,
+						"publishedAt": key.PublishedAt,
+						"expiresAt":   key.ExpiresAt,
+						"role":        roles[key.Kid],
+					})
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"keys": keys,
+				})
+			})
+
+			// Revokes a signing key and a new key takes its role. Tokens signed with it stop validating
+			// here right away, on other replicas and proxies once their key cache expires.
+			asAdmin.Delete("/admin/keys/{kid}", func(w http.ResponseWriter, r *http.Request) {
+				kid := chi.URLParam(r, "kid")
+				if err := signingKeys.revoke(kid); errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unknown key", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to revoke key", http.StatusInternalServerError)
+					log.Printf("Error revoking JWT key %s: %v", kid, err)
+					return
+				}
+				tokenValidator.ExpireKeys()
+				log.Printf("%s revoked JWT key %s", adminCaller(r.Context()).Name, kid)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			asAdmin.Get("/admin/users", func(w http.ResponseWriter, r *http.Request) {
+				adminUsers, err := db.GetAllAdminUsers()
+				if err != nil {
+					http.Error(w, "Failed to retrieve admin users", http.StatusInternalServerError)
+					log.Printf("Error retrieving admin users: %v", err)
+					return
+				}
+
+				users := []map[string]interface{}{}
+				for _, user := range adminUsers {
+					users = append(users, map[string]interface{}{
+						"id":        user.ID,
+						"name":      user.Name,
+						"role":      user.Role,
+						"createdAt": user.CreatedAt.Unix(),
+					})
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"users": users,
+				})
+			})
+
+			// Creates an admin user, its API key is only returned in this response
+			asAdmin.Post("/admin/users", func(w http.ResponseWriter, r *http.Request) {
+				var request struct {
+					Name string    `json:"name"`
+					Role AdminRole `json:"role"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+					http.Error(w, "Invalid request payload", http.StatusBadRequest)
+					return
+				}
+				if !request.Role.IsValid() {
+					http.Error(w, "Invalid role", http.StatusBadRequest)
+					return
+				}
+
+				apiKey, user, err := newAdminUser(request.Name, request.Role)
+				if err != nil {
+					http.Error(w, "Failed to create admin user", http.StatusInternalServerError)
+					return
+				}
+				if err := db.PutAdminUser(user); err != nil {
+					http.Error(w, "Failed to store admin user", http.StatusInternalServerError)
+					log.Printf("Error storing admin user %s: %v", request.Name, err)
+					return
+				}
+				log.Printf("%s created admin user %s with role %s", adminCaller(r.Context()).Name, user.Name, user.Role)
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"id":     user.ID,
+					"name":   user.Name,
+					"role":   user.Role,
+					"apiKey": apiKey,
+				})
+			})
+
+			asAdmin.Delete("/admin/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+				id := chi.URLParam(r, "id")
+				if err := db.RemoveAdminUser(id); errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unknown admin user", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to remove admin user", http.StatusInternalServerError)
+					log.Printf("Error removing admin user %s: %v", id, err)
+					return
+				}
+				log.Printf("%s removed admin user %s", adminCaller(r.Context()).Name, id)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r.Get("/pairings", func(w http.ResponseWriter, r *http.Request) {
+				pendingServers, err := db.GetAllPendingServers()
+				if err != nil {
+					http.Error(w, "Failed to retrieve pending servers", http.StatusInternalServerError)
+					log.Printf("Error retrieving pending servers: %v", err)
+					return
+				}
+
+				pairings := []map[string]interface{}{}
+				for _, pending := range pendingServers {
+					if pending.Approved() {
+						continue
+					}
+					pairings = append(pairings, map[string]interface{}{
+						"code":        pending.Code,
+						"server":      pending.Server,
+						"requestedAt": pending.RequestedAt.Unix(),
+						"expiresAt":   pending.ExpiresAt.Unix(),
+					})
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"pairings": pairings,
+				})
+			})
+
+			asOperator.Post("/pairings/{code}/approve", func(w http.ResponseWriter, r *http.Request) {
+				if !requireTOTP(w, r) {
+					return
+				}
+				pending, ok := findPairing(w, chi.URLParam(r, "code"))
+				if !ok {
+					return
+				}
+
+				// The proxy gets its own credential, so the server it registers from now on is owned by it
+				// and does not need pairing again, e.g. after its lease ran out
+				apiKey, credential, err := newProxyCredential(pending.Server.ProxyURL)
+				if err != nil {
+					http.Error(w, "Failed to create credential", http.StatusInternalServerError)
+					return
+				}
+				// The state was decided at registration, a server taken out of service stays out
+				server := pending.Server
+				server.Owner = credential.ID
+				server.State = cmp.Or(server.State, common.ServerStateActive)
+				if _, err := server.GenerateRevocationToken(); err != nil {
+					http.Error(w, "Failed to generate revocation token", http.StatusInternalServerError)
+					return
+				}
+				if _, err := server.GenerateID(); err != nil {
+					http.Error(w, "Failed to generate server ID", http.StatusInternalServerError)
+					return
+				}
+				approved, err := db.ApprovePendingServer(pending.TokenHash, &server, apiKey)
+				if err != nil {
+					http.Error(w, "Failed to approve server", http.StatusInternalServerError)
+					log.Printf("Error approving pending server %s: %v", pending.Code, err)
+					return
+				}
+				if !approved {
+					http.Error(w, "Unknown pairing code", http.StatusNotFound)
+					return
+				}
+				if err := db.PutProxyCredential(credential); err != nil {
+					http.Error(w, "Failed to store credential", http.StatusInternalServerError)
+					log.Printf("Error storing proxy credential %s: %v", credential.ID, err)
+					return
+				}
+				if err := db.AddServer(&server, cfg.serverLease()); err != nil {
+					http.Error(w, "Failed to add server", http.StatusInternalServerError)
+					log.Printf("Error adding approved server %s: %v", server.ProxyURL, err)
+					return
+				}
+				log.Printf("Approved server %s with pairing code %s as proxy %s", server.ProxyURL, pending.Code, credential.ID)
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(server)
+			})
+
+			asOperator.Post("/pairings/{code}/reject", func(w http.ResponseWriter, r *http.Request) {
+				if !requireTOTP(w, r) {
+					return
+				}
+				pending, ok := findPairing(w, chi.URLParam(r, "code"))
+				if !ok {
+					return
+				}
+				if err := db.RemovePendingServer(pending.TokenHash); err != nil {
+					http.Error(w, "Failed to reject server", http.StatusInternalServerError)
+					log.Printf("Error removing pending server %s: %v", pending.Code, err)
+					return
+				}
+				log.Printf("Rejected server %s with pairing code %s", pending.Server.ProxyURL, pending.Code)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			asOperator.Post("/enrollment-tokens", func(w http.ResponseWriter, r *http.Request) {
+				var request struct {
+					Name      string `json:"name"`
+					ExpiresIn int    `json:"expiresIn"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+					http.Error(w, "Invalid request payload", http.StatusBadRequest)
+					return
+				}
+				validFor := defaultEnrollmentTokenLifetime
+				if request.ExpiresIn > 0 {
+					validFor = time.Duration(request.ExpiresIn) * time.Second
+				}
+
+				token, enrollment, err := newEnrollmentToken(request.Name, validFor)
+				if err != nil {
+					http.Error(w, "Failed to create enrollment token", http.StatusInternalServerError)
+					return
+				}
+				if err := db.PutEnrollmentToken(enrollment); err != nil {
+					http.Error(w, "Failed to store enrollment token", http.StatusInternalServerError)
+					log.Printf("Error storing enrollment token for %s: %v", request.Name, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"token":     token,
+					"expiresIn": int(validFor.Seconds()),
+				})
+			})
+
+			r.Get("/proxies", func(w http.ResponseWriter, r *http.Request) {
+				credentials, err := db.GetAllProxyCredentials()
+				if err != nil {
+					http.Error(w, "Failed to retrieve proxies", http.StatusInternalServerError)
+					log.Printf("Error retrieving proxy credentials: %v", err)
+					return
+				}
+
+				proxies := []map[string]interface{}{}
+				for _, credential := range credentials {
+					proxies = append(proxies, map[string]interface{}{
+						"id":        credential.ID,
+						"name":      credential.Name,
+						"createdAt": credential.CreatedAt.Unix(),
+					})
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"proxies": proxies,
+				})
+			})
+
+			// Revokes the credential of a proxy, the servers it registered are removed with it
+			asOperator.Delete("/proxies/{id}", func(w http.ResponseWriter, r *http.Request) {
+				id := chi.URLParam(r, "id")
+				if err := db.RemoveProxyCredential(id); errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unknown proxy", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to revoke credential", http.StatusInternalServerError)
+					log.Printf("Error revoking proxy credential %s: %v", id, err)
+					return
+				}
+
+				servers, err := db.GetAllServers()
+				if err != nil {
+					http.Error(w, "Failed to retrieve servers", http.StatusInternalServerError)
+					log.Printf("Error retrieving servers: %v", err)
+					return
+				}
+				for _, server := range servers {
+					if server.Owner != id {
+						continue
+					}
+					if err := db.RemoveServerByToken(server.RevocationToken); err != nil {
+						http.Error(w, "Failed to remove server", http.StatusInternalServerError)
+						log.Printf("Error removing server %s of revoked proxy %s: %v", server.ProxyURL, id, err)
+						return
+					}
+				}
+				log.Printf("Revoked proxy credential %s", id)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r.Get("/tiers", func(w http.ResponseWriter, r *http.Request) {
+				tiers, err := db.GetAllTiers()
+				if err != nil {
+					http.Error(w, "Failed to retrieve tiers", http.StatusInternalServerError)
+					log.Printf("Error retrieving tiers: %v", err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"tiers": tiers,
+				})
+			})
+
+			asAdmin.Put("/tiers/{name}", func(w http.ResponseWriter, r *http.Request) {
+				var tier common.Tier
+				if err := json.NewDecoder(r.Body).Decode(&tier); err != nil {
+					http.Error(w, "Invalid request payload", http.StatusBadRequest)
+					return
+				}
+				tier.Name = chi.URLParam(r, "name")
+
+				if valid, message := tier.IsValid(); !valid {
+					http.Error(w, message, http.StatusBadRequest)
+					return
+				}
+
+				if err := db.PutTier(&tier); err != nil {
+					http.Error(w, "Failed to store tier", http.StatusInternalServerError)
+					log.Printf("Error storing tier %s: %v", tier.Name, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(tier)
+			})
+
+			asAdmin.Put("/users/{subject}/tier", func(w http.ResponseWriter, r *http.Request) {
+				var assignment struct {
+					Tier string `json:"tier"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil || assignment.Tier == "" {
+					http.Error(w, "Invalid request payload", http.StatusBadRequest)
+					return
+				}
+
+				if _, err := db.GetTier(assignment.Tier); errors.Is(err, ErrNotFound) {
+					http.Error(w, "Unknown tier", http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, "Failed to retrieve tier", http.StatusInternalServerError)
+					log.Printf("Error retrieving tier %s: %v", assignment.Tier, err)
+					return
+				}
+
+				subject := chi.URLParam(r, "subject")
+				if err := db.SetUserTier(subject, assignment.Tier); err != nil {
+					http.Error(w, "Failed to assign tier", http.StatusInternalServerError)
+					log.Printf("Error assigning tier %s to %s: %v", assignment.Tier, subject, err)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Token revocation (RFC 7009)
+			asOperator.Post("/token/revoke", func(w http.ResponseWriter, r *http.Request) {
+				token, err := tokenValidator.ValidateToken(r.PostFormValue("token"))
+				if err != nil {
+					// Invalid and expired tokens are unusable anyway
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				claims := token.Claims.(jwt.MapClaims)
+				jti := auth.TokenID(claims)
+				exp, err := claims.GetExpirationTime()
+				if jti == "" || err != nil || exp == nil {
+					http.Error(w, "Token cannot be revoked", http.StatusBadRequest)
+					return
+				}
+				if err := db.RevokeToken(jti, exp.Time); err != nil {
+					http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+					log.Printf("Error revoking token %s: %v", jti, err)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+		})
+	})
+
+	return r
+}
+
+// adminServer is a server with the metadata only admins see, the revocation token stays secret
+type adminServer struct {
+	*common.Server
+	Owner             string `json:"owner,omitempty"`
+	LastHeartbeat     int64  `json:"lastHeartbeat,omitempty"`
+	ActiveConnections int    `json:"activeConnections"`
+}
+
+func newAdminServer(server *common.Server) adminServer {
+	return adminServer{
+		Server:            server,
+		Owner:             server.Owner,
+		LastHeartbeat:     server.LastHeartbeat,
+		ActiveConnections: server.ActiveConnections,
+	}
+}
+
+// setIfPresent overwrites target with the value of a field present in a partial update
+func setIfPresent[T any](target *T, value *T) {
+	if value != nil {
+		*target = *value
+	}
+}
+
+// tokenGrant describes the tokens to issue for a token or refresh request
+type tokenGrant struct {
+	// Subject of the authenticated user, empty for anonymous tokens
+	Subject string
+	// Server or Group optionally bind the token to a single server or a fleet group
+	Server string
+	Group  string
+	// Confirmation binds the token to a DPoP key thumbprint
+	Confirmation string
+	// MaxUses limits how often the token may be used, 0 means no limit
+	MaxUses int
+	// RefreshFamily continues a refresh token family on rotation, empty starts a new one
+	RefreshFamily string
+}
+
+// tokenAudience resolves the aud claim of a token bound to a server or group the tier allows.
+// On failure it returns the HTTP status and an error meant for the client.
+func tokenAudience(db Database, tier *common.Tier, serverRef, group string) ([]string, int, error) {
+	if serverRef != "" {
+		server, err := db.GetServer(serverRef)
+		if errors.Is(err, ErrNotFound) {
+			return nil, http.StatusNotFound, errors.New("Unknown server")
+		}
+		if err != nil {
+			log.Printf("Error retrieving server %s: %v", serverRef, err)
+			return nil, http.StatusInternalServerError, errors.New("Failed to retrieve server")
+		}
+		if !tier.AllowsGroup(server.Group) {
+			return nil, http.StatusForbidden, errors.New("Server not included in tier")
+		}
+		if server.State != common.ServerStateActive {
+			return nil, http.StatusConflict, errors.New("Server does not accept new clients")
+		}
+		return []string{server.ProxyURL}, http.StatusOK, nil
+	}
+	if group != "" {
+		servers, err := db.GetAllServers()
+		if err != nil {
+			log.Printf("Error retrieving servers: %v", err)
+			return nil, http.StatusInternalServerError, errors.New("Failed to retrieve servers")
+		}
+		if !slices.ContainsFunc(servers, func(s *common.Server) bool { return s.Group == group }) {
+			return nil, http.StatusNotFound, errors.New("Unknown server group")
+		}
+		if !slices.ContainsFunc(servers, func(s *common.Server) bool {
+			return s.Group == group && s.State == common.ServerStateActive
+		}) {
+			return nil, http.StatusConflict, errors.New("No server of the group accepts new clients")
+		}
+		if !tier.AllowsGroup(group) {
+			return nil, http.StatusForbidden, errors.New("Server group not included in tier")
+		}
+		return []string{group}, http.StatusOK, nil
+	}
+	// Tiers limited to fleet groups bind all their tokens to them
+	return tier.AllowedGroups, http.StatusOK, nil
+}
+
+// isThumbprint reports whether s looks like a base64url encoded SHA-256 JWK thumbprint
+func isThumbprint(s string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(decoded) == sha256.Size
 }
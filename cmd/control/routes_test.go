@@ -5,26 +5,89 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+	"github.com/strseb/zdvv/pkg/common/privacypass"
 )
 
 // MockDatabase is a mock implementation of the Database interface.
-type MockDatabase struct{}
+type MockDatabase struct {
+	jwtKeys       []*common.JWTKey
+	privateJWTKey map[string]*EncryptedKey
+	keyRoles      map[string]string
+	retained      map[string]time.Time
+	locks         map[string]string
+	revokedTokens map[string]time.Time
+	tiers         map[string]*common.Tier
+	userTiers     map[string]string
+	refreshTokens map[string]*RefreshToken
+	usedRefresh   map[string]bool
+	revokedFamily map[string]bool
+	privateKeys   []*PrivateTokenKey
+	challenges    map[string]bool
+	rateLimits    map[string]int64
+	pending       map[string]*PendingServer
+	addedServers  []*common.Server
+	leases        map[string]time.Duration
+	enrollments   map[string]*EnrollmentToken
+	credentials   map[string]*ProxyCredential
+	adminUsers    map[string]*AdminUser
+	// states survive expireLease like the serverstate keys in Redis
+	states map[string]common.ServerState
+}
 
-func (m *MockDatabase) AddServer(val *common.Server) error {
+func (m *MockDatabase) AddServer(val *common.Server, lease time.Duration) error {
+	if m.leases == nil {
+		m.leases = make(map[string]time.Duration)
+	}
+	m.addedServers = append(m.addedServers, val)
+	m.leases[val.RevocationToken] = lease
 	return nil
 }
 
+func (m *MockDatabase) RenewServerLease(revocationToken string, activeConnections int, lease time.Duration) error {
+	for _, server := range m.addedServers {
+		if server.RevocationToken == revocationToken {
+			server.LastHeartbeat = time.Now().Unix()
+			server.ActiveConnections = activeConnections
+			m.leases[revocationToken] = lease
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// expireLease drops a server like Redis does once its lease ran out
+func (m *MockDatabase) expireLease(revocationToken string) {
+	m.addedServers = slices.DeleteFunc(m.addedServers, func(server *common.Server) bool {
+		return server.RevocationToken == revocationToken
+	})
+	delete(m.leases, revocationToken)
+}
+
 func (m *MockDatabase) GetAllServers() ([]*common.Server, error) {
-	return []*common.Server{
+	return append([]*common.Server{
 		{
+			ID:                 "test-id",
 			ProxyURL:           "http://example.com",
+			Group:              "test-group",
 			Latitude:           12.34,
 			Longitude:          56.78,
 			City:               "TestCity",
@@ -33,29 +96,403 @@ func (m *MockDatabase) GetAllServers() ([]*common.Server, error) {
 			SupportsConnectUDP: false,
 			SupportsConnectIP:  true,
 			RevocationToken:    "test-token",
+			State:              common.ServerStateActive,
 		},
-	}, nil
+	}, m.addedServers...), nil
+}
+
+func (m *MockDatabase) GetServerByRevocationToken(revocationToken string) (*common.Server, error) {
+	servers, _ := m.GetAllServers()
+	for _, server := range servers {
+		if server.RevocationToken == revocationToken {
+			return server, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MockDatabase) SetServerState(id string, state common.ServerState) error {
+	for _, server := range m.addedServers {
+		if server.ID == id {
+			if m.states == nil {
+				m.states = make(map[string]common.ServerState)
+			}
+			server.State = state
+			m.states[server.ProxyURL] = state
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MockDatabase) GetServerState(proxyURL string) (common.ServerState, error) {
+	if state, ok := m.states[proxyURL]; ok {
+		return state, nil
+	}
+	return common.ServerStateActive, nil
+}
+
+func (m *MockDatabase) UpdateServer(updated *common.Server) error {
+	for i, server := range m.addedServers {
+		if server.ID == updated.ID {
+			m.addedServers[i] = updated
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MockDatabase) GetServer(ref string) (*common.Server, error) {
+	servers, _ := m.GetAllServers()
+	for _, server := range servers {
+		if server.ID == ref || server.ProxyURL == ref {
+			return server, nil
+		}
+	}
+	return nil, ErrNotFound
 }
 
 func (m *MockDatabase) PutJWTKey(val *common.JWTKey) error {
+	m.jwtKeys = append(m.jwtKeys, val)
 	return nil
 }
 
 func (m *MockDatabase) GetAllActiveJWTKeys() ([]*common.JWTKey, error) {
-	return []*common.JWTKey{
-		{
-			Kty:       "RSA",
-			PublicKey: "test-public-key",
-			Kid:       "123",
-			ExpiresAt: 9999999999,
-		},
-	}, nil
+	return m.jwtKeys, nil
+}
+
+func (m *MockDatabase) GetJWTKey(kid string) (*common.JWTKey, error) {
+	for _, key := range m.jwtKeys {
+		if key.Kid == kid {
+			// Like the database, only return the public part
+			return &common.JWTKey{Kty: key.Kty, Alg: key.Alg, PublicKey: key.PublicKey, Kid: key.Kid,
+				ExpiresAt: key.ExpiresAt, PublishedAt: key.PublishedAt}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MockDatabase) RemoveJWTKey(kid string) error {
+	for i, key := range m.jwtKeys {
+		if key.Kid == kid {
+			m.jwtKeys = slices.Delete(m.jwtKeys, i, i+1)
+			delete(m.privateJWTKey, kid)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MockDatabase) PutJWTPrivateKey(kid string, key *EncryptedKey) error {
+	if m.privateJWTKey == nil {
+		m.privateJWTKey = make(map[string]*EncryptedKey)
+	}
+	m.privateJWTKey[kid] = key
+	return nil
+}
+
+func (m *MockDatabase) GetJWTPrivateKey(kid string) (*EncryptedKey, error) {
+	key, ok := m.privateJWTKey[kid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return key, nil
+}
+
+func (m *MockDatabase) RetainJWTKey(kid string, until time.Time) error {
+	if m.retained == nil {
+		m.retained = make(map[string]time.Time)
+	}
+	m.retained[kid] = until
+	return nil
+}
+
+func (m *MockDatabase) SetJWTKeyID(role string, kid string, until time.Time) error {
+	if m.keyRoles == nil {
+		m.keyRoles = make(map[string]string)
+	}
+	if kid == "" {
+		delete(m.keyRoles, role)
+	} else {
+		m.keyRoles[role] = kid
+	}
+	return nil
+}
+
+func (m *MockDatabase) GetJWTKeyID(role string) (string, error) {
+	kid, ok := m.keyRoles[role]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return kid, nil
+}
+
+func (m *MockDatabase) AcquireLock(name string, owner string, ttl time.Duration) (bool, error) {
+	if m.locks == nil {
+		m.locks = make(map[string]string)
+	}
+	if _, held := m.locks[name]; held {
+		return false, nil
+	}
+	m.locks[name] = owner
+	return true, nil
+}
+
+func (m *MockDatabase) ReleaseLock(name string, owner string) error {
+	if m.locks[name] == owner {
+		delete(m.locks, name)
+	}
+	return nil
+}
+
+func (m *MockDatabase) RevokeToken(jti string, expiresAt time.Time) error {
+	if m.revokedTokens == nil {
+		m.revokedTokens = make(map[string]time.Time)
+	}
+	m.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (m *MockDatabase) IsTokenRevoked(jti string) (bool, error) {
+	_, ok := m.revokedTokens[jti]
+	return ok, nil
+}
+
+func (m *MockDatabase) PutTier(tier *common.Tier) error {
+	if m.tiers == nil {
+		m.tiers = make(map[string]*common.Tier)
+	}
+	m.tiers[tier.Name] = tier
+	return nil
+}
+
+func (m *MockDatabase) GetTier(name string) (*common.Tier, error) {
+	tier, ok := m.tiers[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return tier, nil
+}
+
+func (m *MockDatabase) GetAllTiers() ([]*common.Tier, error) {
+	var tiers []*common.Tier
+	for _, tier := range m.tiers {
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+func (m *MockDatabase) SetUserTier(subject string, tier string) error {
+	if m.userTiers == nil {
+		m.userTiers = make(map[string]string)
+	}
+	m.userTiers[subject] = tier
+	return nil
+}
+
+func (m *MockDatabase) PutRefreshToken(token *RefreshToken) error {
+	if m.refreshTokens == nil {
+		m.refreshTokens = make(map[string]*RefreshToken)
+	}
+	m.refreshTokens[token.Hash] = token
+	return nil
+}
+
+func (m *MockDatabase) ConsumeRefreshToken(hash string) (*RefreshToken, error) {
+	token, ok := m.refreshTokens[hash]
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	if m.revokedFamily[token.FamilyID] || m.usedRefresh[hash] {
+		return token, ErrRefreshTokenReused
+	}
+	if m.usedRefresh == nil {
+		m.usedRefresh = make(map[string]bool)
+	}
+	m.usedRefresh[hash] = true
+	return token, nil
+}
+
+func (m *MockDatabase) RevokeRefreshTokenFamily(familyID string, until time.Time) error {
+	if m.revokedFamily == nil {
+		m.revokedFamily = make(map[string]bool)
+	}
+	m.revokedFamily[familyID] = true
+	return nil
+}
+
+func (m *MockDatabase) PutPrivateTokenKey(key *PrivateTokenKey) error {
+	m.privateKeys = append(m.privateKeys, key)
+	return nil
+}
+
+func (m *MockDatabase) GetAllPrivateTokenKeys() ([]*PrivateTokenKey, error) {
+	return m.privateKeys, nil
+}
+
+func (m *MockDatabase) UseChallenge(id string, expiresAt time.Time) (bool, error) {
+	if m.challenges == nil {
+		m.challenges = make(map[string]bool)
+	}
+	if m.challenges[id] {
+		return false, nil
+	}
+	m.challenges[id] = true
+	return true, nil
+}
+
+func (m *MockDatabase) IncrementRateLimit(key string, window time.Duration) (int64, time.Duration, error) {
+	if m.rateLimits == nil {
+		m.rateLimits = make(map[string]int64)
+	}
+	m.rateLimits[key]++
+	return m.rateLimits[key], window, nil
+}
+
+func (m *MockDatabase) PutPendingServer(pending *PendingServer) error {
+	if m.pending == nil {
+		m.pending = make(map[string]*PendingServer)
+	}
+	stored := *pending
+	m.pending[pending.TokenHash] = &stored
+	return nil
+}
+
+func (m *MockDatabase) GetPendingServer(tokenHash string) (*PendingServer, error) {
+	pending, ok := m.pending[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	stored := *pending
+	return &stored, nil
+}
+
+func (m *MockDatabase) GetAllPendingServers() ([]*PendingServer, error) {
+	var pendingServers []*PendingServer
+	for _, pending := range m.pending {
+		stored := *pending
+		pendingServers = append(pendingServers, &stored)
+	}
+	return pendingServers, nil
+}
+
+func (m *MockDatabase) ApprovePendingServer(tokenHash string, server *common.Server, apiKey string) (bool, error) {
+	pending, ok := m.pending[tokenHash]
+	if !ok || pending.Approved() {
+		return false, nil
+	}
+	pending.ServerID, pending.RevocationToken, pending.Server.Owner, pending.APIKey = server.ID, server.RevocationToken, server.Owner, apiKey
+	return true, nil
+}
+
+func (m *MockDatabase) RemovePendingServer(tokenHash string) error {
+	delete(m.pending, tokenHash)
+	return nil
+}
+
+func (m *MockDatabase) PutEnrollmentToken(token *EnrollmentToken) error {
+	if m.enrollments == nil {
+		m.enrollments = make(map[string]*EnrollmentToken)
+	}
+	m.enrollments[token.Hash] = token
+	return nil
+}
+
+func (m *MockDatabase) ConsumeEnrollmentToken(hash string) (*EnrollmentToken, error) {
+	token, ok := m.enrollments[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(m.enrollments, hash)
+	return token, nil
+}
+
+func (m *MockDatabase) PutProxyCredential(credential *ProxyCredential) error {
+	if m.credentials == nil {
+		m.credentials = make(map[string]*ProxyCredential)
+	}
+	m.credentials[credential.Hash] = credential
+	return nil
+}
+
+func (m *MockDatabase) GetProxyCredential(hash string) (*ProxyCredential, error) {
+	credential, ok := m.credentials[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return credential, nil
+}
+
+func (m *MockDatabase) GetAllProxyCredentials() ([]*ProxyCredential, error) {
+	var credentials []*ProxyCredential
+	for _, credential := range m.credentials {
+		credentials = append(credentials, credential)
+	}
+	return credentials, nil
+}
+
+func (m *MockDatabase) RemoveProxyCredential(id string) error {
+	for hash, credential := range m.credentials {
+		if credential.ID == id {
+			delete(m.credentials, hash)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MockDatabase) PutAdminUser(user *AdminUser) error {
+	if m.adminUsers == nil {
+		m.adminUsers = make(map[string]*AdminUser)
+	}
+	m.adminUsers[user.Hash] = user
+	return nil
+}
+
+func (m *MockDatabase) GetAdminUser(hash string) (*AdminUser, error) {
+	user, ok := m.adminUsers[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
+func (m *MockDatabase) GetAllAdminUsers() ([]*AdminUser, error) {
+	var users []*AdminUser
+	for _, user := range m.adminUsers {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (m *MockDatabase) RemoveAdminUser(id string) error {
+	for hash, user := range m.adminUsers {
+		if user.ID == id {
+			delete(m.adminUsers, hash)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MockDatabase) GetUserTier(subject string) (string, error) {
+	tier, ok := m.userTiers[subject]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return tier, nil
 }
 
 func (m *MockDatabase) RemoveServerByToken(revocationToken string) error {
 	if revocationToken == "test-token" {
 		return nil
 	}
+	for i, server := range m.addedServers {
+		if server.RevocationToken == revocationToken {
+			m.addedServers = slices.Delete(m.addedServers, i, i+1)
+			return nil
+		}
+	}
 	return fmt.Errorf("server with revocation token not found")
 }
 
@@ -78,41 +515,792 @@ func TestHeartbeatEndpoint(t *testing.T) {
 	}
 }
 
-func TestJWKSJsonEndpoint(t *testing.T) {
-	mockDB := &MockDatabase{}
+func TestJWKSJsonEndpoint(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr: "localhost:8080",
+		AuthSecret: "my-secret-key",
+	}
+	r := createRouter(mockDB, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK, got %v", resp.Status)
+	}
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/token", nil)
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK, got %v", resp.Status)
+	}
+}
+
+func TestTokenEndpointAudience(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedAud    []string
+	}{
+		{"No audience", "", http.StatusOK, nil},
+		{"Server by ID", "?server=test-id", http.StatusOK, []string{"http://example.com"}},
+		{"Server by URL", "?server=http://example.com", http.StatusOK, []string{"http://example.com"}},
+		{"Server group", "?group=test-group", http.StatusOK, []string{"test-group"}},
+		{"Unknown server", "?server=unknown", http.StatusNotFound, nil},
+		{"Unknown group", "?group=unknown", http.StatusNotFound, nil},
+		{"Server and group", "?server=test-id&group=test-group", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/token"+tc.query, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			token, _, err := jwt.NewParser().ParseUnverified(body.Token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatalf("failed to parse token: %v", err)
+			}
+			aud, err := token.Claims.GetAudience()
+			if err != nil {
+				t.Fatalf("failed to read aud claim: %v", err)
+			}
+			if !slices.Equal([]string(aud), tc.expectedAud) {
+				t.Errorf("expected aud %v, got %v", tc.expectedAud, aud)
+			}
+		})
+	}
+}
+
+func TestTokenEndpointDPoP(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	jkt := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/token?dpop_jkt="+jkt, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(body.Token, claims); err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if got := auth.ConfirmationThumbprint(claims); got != jkt {
+		t.Errorf("expected cnf.jkt %s, got %q", jkt, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/token?dpop_jkt=not-a-thumbprint", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid thumbprint, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestTokenEndpointSingleUse(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedStatus  int
+		expectedMaxUses int
+	}{
+		{"Default", "", http.StatusOK, 0},
+		{"Single use", "?single_use=true", http.StatusOK, 1},
+		{"Explicitly reusable", "?single_use=false", http.StatusOK, 0},
+		{"Invalid flag", "?single_use=maybe", http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/token"+tc.query, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(body.Token, claims); err != nil {
+				t.Fatalf("failed to parse token: %v", err)
+			}
+			if got := auth.MaxUses(claims); got != tc.expectedMaxUses {
+				t.Errorf("expected maxUses %d, got %d", tc.expectedMaxUses, got)
+			}
+		})
+	}
+}
+
+func TestIntrospectionEndpoint(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AdminSecret:          "my-admin-secret",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/token", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+
+	introspect := func(token, secret string) (int, map[string]interface{}) {
+		form := url.Values{"token": {token}}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/introspect", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	if code, _ := introspect(body.Token, "wrong-secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without valid secret, got %d", http.StatusUnauthorized, code)
+	}
+
+	code, response := introspect(body.Token, cfg.AuthSecret)
+	if code != http.StatusOK {
+		t.Fatalf("expected status OK, got %d", code)
+	}
+	if response["active"] != true {
+		t.Errorf("expected active token, got %v", response)
+	}
+	if response["iss"] != cfg.issuer() {
+		t.Errorf("expected iss %s, got %v", cfg.issuer(), response["iss"])
+	}
+	if response["scope"] != string(auth.PERMISSION_CONNECT_TCP) {
+		t.Errorf("expected %s scope, got %v", auth.PERMISSION_CONNECT_TCP, response)
+	}
+
+	if _, response := introspect("not-a-token", cfg.AuthSecret); response["active"] != false {
+		t.Errorf("expected invalid token to be inactive, got %v", response)
+	}
+
+	// Revoke the token
+	form := url.Values{"token": {body.Token}}
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/token/revoke", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminSecret)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK for revocation, got %d", w.Code)
+	}
+	if len(mockDB.revokedTokens) != 1 {
+		t.Errorf("expected one revoked token, got %d", len(mockDB.revokedTokens))
+	}
+
+	if _, response := introspect(body.Token, cfg.AuthSecret); response["active"] != false {
+		t.Errorf("expected revoked token to be inactive, got %v", response)
+	}
+}
+
+func TestSigningKeyRevocation(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AdminSecret:          "my-admin-secret",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	do := func(method, target, credential string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+credential)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	active := func(token string) bool {
+		w := do(http.MethodPost, "/api/v1/introspect", cfg.AuthSecret, strings.NewReader(url.Values{"token": {token}}.Encode()))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response["active"] == true
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(do(http.MethodGet, "/api/v1/token", "", nil).Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	unverified, _, err := jwt.NewParser().ParseUnverified(body.Token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	kid := fmt.Sprint(unverified.Header["kid"])
+
+	// A proxy validating tokens locally with the published key set
+	validator := auth.NewMultiKeyJWTValidator(auth.NewHTTPKeyProvider(server.URL+"/.well-known/jwks.json"), nil,
+		auth.WithKeyCacheTTL(50*time.Millisecond))
+	if _, err := validator.ValidateToken(body.Token); err != nil {
+		t.Fatalf("expected the token to validate before revocation: %v", err)
+	}
+	if !active(body.Token) {
+		t.Fatalf("expected the token to be active before revocation")
+	}
+
+	if w := do(http.MethodDelete, "/api/v1/admin/keys/"+kid, cfg.AdminSecret, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK revoking the key, got %d", w.Code)
+	}
+	if active(body.Token) {
+		t.Errorf("expected a token signed with a revoked key to be inactive")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := validator.ValidateToken(body.Token); err == nil {
+		t.Errorf("expected a token signed with a revoked key to fail validation once the key cache expired")
+	}
+}
+
+func TestTokenEndpointLegacyPermissionClaims(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("legacy=%v", legacy), func(t *testing.T) {
+			cfg := &Config{
+				ListenAddr:             "localhost:8080",
+				AuthSecret:             "my-secret-key",
+				LegacyPermissionClaims: legacy,
+				AllowAnonymousTokens:   true,
+			}
+			r := createRouter(&MockDatabase{}, cfg)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/token", nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(body.Token, claims); err != nil {
+				t.Fatalf("failed to parse token: %v", err)
+			}
+			if claims["scope"] != string(auth.PERMISSION_CONNECT_TCP) {
+				t.Errorf("expected scope %s, got %v", auth.PERMISSION_CONNECT_TCP, claims["scope"])
+			}
+			if _, ok := claims["connect-tcp"]; ok != legacy {
+				t.Errorf("expected legacy claim present=%v, got %v", legacy, claims)
+			}
+		})
+	}
+}
+
+func TestTokenEndpointOIDC(t *testing.T) {
+	idp := newStubIdP(t)
+	for _, anonymous := range []bool{false, true} {
+		t.Run(fmt.Sprintf("anonymous=%v", anonymous), func(t *testing.T) {
+			cfg := &Config{
+				ListenAddr:           "localhost:8080",
+				AuthSecret:           "my-secret-key",
+				OIDCDiscoveryURL:     idp.discoveryURL(),
+				OIDCClientID:         "zdvv-client",
+				AllowAnonymousTokens: anonymous,
+			}
+			r := createRouter(&MockDatabase{}, cfg)
+
+			request := func(authorization string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/api/v1/token", nil)
+				if authorization != "" {
+					req.Header.Set("Authorization", authorization)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				return w
+			}
+
+			w := request("Bearer " + idp.token(t, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(body.Token, claims); err != nil {
+				t.Fatalf("failed to parse token: %v", err)
+			}
+			if claims["sub"] != "user-123" {
+				t.Errorf("expected sub user-123, got %v", claims["sub"])
+			}
+
+			// A rejected identity token never falls back to an anonymous one
+			w = request("Bearer " + idp.token(t, jwt.MapClaims{"aud": "other-client"}))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d for invalid identity token, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			w = request("")
+			want := http.StatusUnauthorized
+			if anonymous {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("expected status %d without identity token, got %d", want, w.Code)
+			}
+		})
+	}
+}
+
+func TestTokenEndpointTiers(t *testing.T) {
+	idp := newStubIdP(t)
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AdminSecret:          "my-admin-secret",
+		OIDCDiscoveryURL:     idp.discoveryURL(),
+		OIDCClientID:         "zdvv-client",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	admin := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminSecret)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	issue := func(subject, query string) (int, jwt.MapClaims) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/token"+query, nil)
+		if subject != "" {
+			req.Header.Set("Authorization", "Bearer "+idp.token(t, jwt.MapClaims{"sub": subject}))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		claims := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(body.Token, claims); err != nil {
+			t.Fatalf("failed to parse token: %v", err)
+		}
+		return w.Code, claims
+	}
+	lifetime := func(claims jwt.MapClaims) time.Duration {
+		exp, _ := claims.GetExpirationTime()
+		return time.Until(exp.Time).Round(time.Minute)
+	}
+
+	// Anonymous and unassigned users get the default free tier
+	for _, subject := range []string{"", "new-user"} {
+		_, claims := issue(subject, "")
+		if claims["scope"] != string(auth.PERMISSION_CONNECT_TCP) {
+			t.Errorf("expected free scope for %q, got %v", subject, claims["scope"])
+		}
+		if got := auth.BandwidthLimit(claims); got != 1250000 {
+			t.Errorf("expected free bandwidth limit for %q, got %d", subject, got)
+		}
+		if got := lifetime(claims); got != time.Hour {
+			t.Errorf("expected free token lifetime of 1h for %q, got %v", subject, got)
+		}
+	}
+
+	if code := admin(http.MethodPut, "/api/v1/users/pro-user/tier", `{"tier":"pro"}`); code != http.StatusOK {
+		t.Fatalf("expected status %d assigning tier, got %d", http.StatusOK, code)
+	}
+	_, claims := issue("pro-user", "")
+	if claims["scope"] != string(auth.PERMISSION_PROXY_ALL) {
+		t.Errorf("expected pro scope, got %v", claims["scope"])
+	}
+	if _, ok := claims["constraints"]; ok {
+		t.Errorf("expected no constraints for pro tier, got %v", claims["constraints"])
+	}
+	if got := lifetime(claims); got != 4*time.Hour {
+		t.Errorf("expected pro token lifetime of 4h, got %v", got)
+	}
+
+	// Tiers limited to fleet groups bind tokens to them
+	tier := `{"permissions":["connect-tcp"],"tokenTtl":600,"allowedGroups":["eu-west"]}`
+	if code := admin(http.MethodPut, "/api/v1/tiers/regional", tier); code != http.StatusOK {
+		t.Fatalf("expected status %d storing tier, got %d", http.StatusOK, code)
+	}
+	if code := admin(http.MethodPut, "/api/v1/users/regional-user/tier", `{"tier":"regional"}`); code != http.StatusOK {
+		t.Fatalf("expected status %d assigning tier, got %d", http.StatusOK, code)
+	}
+	_, claims = issue("regional-user", "")
+	if claims["aud"] != "eu-west" {
+		t.Errorf("expected aud eu-west, got %v", claims["aud"])
+	}
+	if code, _ := issue("regional-user", "?group=test-group"); code != http.StatusForbidden {
+		t.Errorf("expected status %d for group outside tier, got %d", http.StatusForbidden, code)
+	}
+	if code, _ := issue("regional-user", "?server=test-id"); code != http.StatusForbidden {
+		t.Errorf("expected status %d for server outside tier, got %d", http.StatusForbidden, code)
+	}
+
+	if code := admin(http.MethodPut, "/api/v1/tiers/broken", `{"permissions":[],"tokenTtl":600}`); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid tier, got %d", http.StatusBadRequest, code)
+	}
+	if code := admin(http.MethodPut, "/api/v1/users/someone/tier", `{"tier":"missing"}`); code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown tier, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	idp := newStubIdP(t)
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		OIDCDiscoveryURL:     idp.discoveryURL(),
+		OIDCClientID:         "zdvv-client",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(&MockDatabase{}, cfg)
+
+	type tokenResponse struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	decode := func(w *httptest.ResponseRecorder) tokenResponse {
+		var body tokenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return body
+	}
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		form := url.Values{"refresh_token": {refreshToken}}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/token/refresh", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Anonymous tokens come without a refresh token
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/token", nil))
+	if body := decode(w); body.RefreshToken != "" {
+		t.Errorf("expected no refresh token for anonymous request")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/token?group=test-group", nil)
+	req.Header.Set("Authorization", "Bearer "+idp.token(t, nil))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	initial := decode(w)
+	if initial.RefreshToken == "" {
+		t.Fatalf("expected a refresh token, got %s", w.Body.String())
+	}
+	if initial.ExpiresIn != 3600 {
+		t.Errorf("expected expires_in 3600, got %d", initial.ExpiresIn)
+	}
+
+	w = refresh(initial.RefreshToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d refreshing, got %d", http.StatusOK, w.Code)
+	}
+	rotated := decode(w)
+	if rotated.RefreshToken == "" || rotated.RefreshToken == initial.RefreshToken {
+		t.Fatalf("expected a rotated refresh token")
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(rotated.Token, claims); err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if claims["sub"] != "user-123" || claims["aud"] != "test-group" {
+		t.Errorf("expected refreshed token for user-123 bound to test-group, got %v", claims)
+	}
+
+	// Reusing a rotated token revokes the whole family
+	if w := refresh(initial.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d reusing a refresh token, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := refresh(rotated.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d after family revocation, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if w := refresh("unknown"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for unknown refresh token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+// solveChallenge finds a nonce for a proof-of-work challenge by brute force
+func solveChallenge(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		nonce := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+nonce))) >= difficulty {
+			return nonce
+		}
+	}
+}
+
+func TestTokenEndpointProofOfWork(t *testing.T) {
+	cfg := &Config{
+		ListenAddr:            "localhost:8080",
+		AuthSecret:            "my-secret-key",
+		AllowAnonymousTokens:  true,
+		ProofOfWork:           true,
+		ProofOfWorkDifficulty: 8,
+	}
+	r := createRouter(&MockDatabase{}, cfg)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/api/v1/token/challenge")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK for a challenge, got %d", w.Code)
+	}
+	var challenge struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+		ExpiresIn  int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatalf("failed to decode challenge: %v", err)
+	}
+	if challenge.Difficulty != 8 || challenge.ExpiresIn <= 0 {
+		t.Fatalf("unexpected challenge %+v", challenge)
+	}
+	nonce := solveChallenge(challenge.Challenge, challenge.Difficulty)
+	solved := "/api/v1/token?pow_challenge=" + challenge.Challenge + "&pow_nonce=" + nonce
+
+	if w := get("/api/v1/token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without a solution, got %d", http.StatusUnauthorized, w.Code)
+	}
+	tampered := []byte(challenge.Challenge)
+	tampered[len(tampered)-1] ^= 1
+	if w := get("/api/v1/token?pow_challenge=" + string(tampered) + "&pow_nonce=" + nonce); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a tampered challenge, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := get(solved); w.Code != http.StatusOK {
+		t.Errorf("expected status OK with a solution, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := get(solved); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d reusing a solution, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
 	cfg := &Config{
-		ListenAddr: "localhost:8080",
-		AuthSecret: "my-secret-key",
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AllowAnonymousTokens: true,
+		RateLimitIssuance:    2,
+		RateLimitServers:     -1,
+		ClientIPHeader:       "X-Forwarded-For",
 	}
-	r := createRouter(mockDB, cfg)
+	r := createRouter(&MockDatabase{}, cfg)
 
-	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
-	w := httptest.NewRecorder()
+	get := func(target string, clientIP string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, "+clientIP)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
 
-	r.ServeHTTP(w, req)
+	for i, remaining := range []string{"1", "0"} {
+		w := get("/api/v1/token", "198.51.100.1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status OK for request %d, got %d", i+1, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != remaining {
+			t.Errorf("expected RateLimit-Remaining %s, got %q", remaining, got)
+		}
+		if got := w.Header().Get("RateLimit-Policy"); got != "2;w=60" {
+			t.Errorf("expected RateLimit-Policy 2;w=60, got %q", got)
+		}
+	}
 
-	resp := w.Result()
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected status OK, got %v", resp.Status)
+	w := get("/api/v1/token", "198.51.100.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d over the limit, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" || w.Header().Get("RateLimit-Reset") != "60" {
+		t.Errorf("expected Retry-After and RateLimit-Reset of 60, got %q and %q",
+			w.Header().Get("Retry-After"), w.Header().Get("RateLimit-Reset"))
+	}
+
+	// Limits are counted per client and per policy
+	if w := get("/api/v1/token", "198.51.100.2"); w.Code != http.StatusOK {
+		t.Errorf("expected status OK for another client, got %d", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		w := get("/api/v1/servers", "198.51.100.1")
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("expected an unlimited server list, got status %d and limit %q", w.Code, w.Header().Get("RateLimit-Limit"))
+		}
 	}
 }
 
-func TestTokenEndpoint(t *testing.T) {
-	mockDB := &MockDatabase{}
+func TestPrivateTokenIssuance(t *testing.T) {
 	cfg := &Config{
-		ListenAddr: "localhost:8080",
-		AuthSecret: "my-secret-key",
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AllowAnonymousTokens: true,
 	}
-	r := createRouter(mockDB, cfg)
+	server := httptest.NewServer(createRouter(&MockDatabase{}, cfg))
+	defer server.Close()
 
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/token", nil)
-	w := httptest.NewRecorder()
+	resp, err := http.Get(server.URL + privacypass.DirectoryPath)
+	if err != nil {
+		t.Fatalf("failed to fetch issuer directory: %v", err)
+	}
+	var directory privacypass.Directory
+	err = json.NewDecoder(resp.Body).Decode(&directory)
+	resp.Body.Close()
+	if err != nil || len(directory.TokenKeys) != 1 {
+		t.Fatalf("expected one issuer key, got %+v (%v)", directory, err)
+	}
+	der, _ := base64.RawURLEncoding.DecodeString(directory.TokenKeys[0].TokenKey)
+	issuerKey, err := privacypass.ParsePublicKey(der)
+	if err != nil {
+		t.Fatalf("failed to parse issuer key: %v", err)
+	}
 
-	r.ServeHTTP(w, req)
+	challenge := privacypass.TokenChallenge{
+		TokenType:  privacypass.TokenTypeBlindRSA,
+		IssuerName: "control.example.com",
+		OriginInfo: "proxy.example.com",
+	}
+	tokenRequest, state, err := privacypass.NewTokenRequest(issuerKey, &challenge)
+	if err != nil {
+		t.Fatalf("failed to create token request: %v", err)
+	}
+	resp, err = http.Post(server.URL+directory.IssuerRequestURI, privacypass.TokenRequestMediaType, bytes.NewReader(tokenRequest.Marshal()))
+	if err != nil {
+		t.Fatalf("failed to request token: %v", err)
+	}
+	blindSignature, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != privacypass.TokenResponseMediaType {
+		t.Fatalf("expected token response, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	token, err := state.Finalize(blindSignature)
+	if err != nil {
+		t.Fatalf("failed to finalize token: %v", err)
+	}
 
-	resp := w.Result()
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected status OK, got %v", resp.Status)
+	// The proxy side redeems the token using the published directory
+	authenticator := auth.NewPrivacyPassAuthenticator(auth.PrivacyPassConfig{
+		DirectoryURL: server.URL + privacypass.DirectoryPath,
+		IssuerName:   challenge.IssuerName,
+		OriginInfo:   challenge.OriginInfo,
+		Permissions:  []auth.Permission{auth.PERMISSION_CONNECT_TCP},
+		Required:     auth.ProtocolPermissions,
+	})
+	redeem := func() error {
+		req := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+		req.Header.Set("Proxy-Authorization", "PrivateToken token="+base64.RawURLEncoding.EncodeToString(token.Marshal()))
+		_, err := authenticator.Authenticate(req)
+		return err
+	}
+	if err := redeem(); err != nil {
+		t.Errorf("expected token to be redeemable, got %v", err)
+	}
+	if err := redeem(); !errors.Is(err, auth.ErrTokenSpent) {
+		t.Errorf("expected double spend to fail, got %v", err)
+	}
+
+	resp, err = http.Post(server.URL+directory.IssuerRequestURI, "application/json", bytes.NewReader(tokenRequest.Marshal()))
+	if err != nil {
+		t.Fatalf("failed to request token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status %d for wrong content type, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
 	}
 }
 
@@ -214,6 +1402,604 @@ func TestAddServerEndpoint(t *testing.T) {
 	})
 }
 
+func TestServerPairing(t *testing.T) {
+	mockDB := &MockDatabase{}
+	totpKey := []byte("12345678901234567890")
+	cfg := &Config{
+		ListenAddr:      "localhost:8080",
+		AuthSecret:      "my-secret-key",
+		AdminSecret:     "my-admin-secret",
+		ServerPairing:   true,
+		AdminTOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	}
+	r := createRouter(mockDB, cfg)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		// Pairings and enrollments are handled by an admin, everything else by the proxy
+		if strings.HasPrefix(target, "/api/v1/pairings") || target == "/api/v1/enrollment-tokens" {
+			req.Header.Set("Authorization", "Bearer "+cfg.AdminSecret)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+cfg.AuthSecret)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	totp := func() string {
+		return `{"totp": "` + totpCode(totpKey, uint64(time.Now().Unix()/30)) + `"}`
+	}
+	register := func(proxyURL string) (string, string) {
+		w := do(http.MethodPost, "/api/v1/server", `{"proxyUrl": "`+proxyURL+`", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected status Accepted, got %d: %s", w.Code, w.Body.String())
+		}
+		var body struct {
+			PairingCode  string `json:"pairingCode"`
+			PairingToken string `json:"pairingToken"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.PairingCode == "" || body.PairingToken == "" {
+			t.Fatalf("expected a pairing code and token, got %+v, %v", body, err)
+		}
+		return body.PairingCode, body.PairingToken
+	}
+
+	code, token := register("http://paired.example.com")
+	if len(mockDB.addedServers) != 0 {
+		t.Fatal("expected the server not to be added before approval")
+	}
+	if w := do(http.MethodGet, "/api/v1/server/pairing/"+token, ""); w.Code != http.StatusAccepted {
+		t.Errorf("expected the pairing to be pending, got %d", w.Code)
+	}
+	var listed struct {
+		Pairings []struct {
+			Code   string        `json:"code"`
+			Server common.Server `json:"server"`
+		} `json:"pairings"`
+	}
+	json.NewDecoder(do(http.MethodGet, "/api/v1/pairings", "").Body).Decode(&listed)
+	if len(listed.Pairings) != 1 || listed.Pairings[0].Code != code || listed.Pairings[0].Server.ProxyURL != "http://paired.example.com" {
+		t.Errorf("expected the pending pairing to be listed, got %+v", listed.Pairings)
+	}
+
+	if w := do(http.MethodPost, "/api/v1/pairings/"+code+"/approve", `{"totp": "000000"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden for a wrong TOTP code, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/v1/pairings/ABCD-EFGH/approve", totp()); w.Code != http.StatusNotFound {
+		t.Errorf("expected status NotFound for an unknown code, got %d", w.Code)
+	}
+	// Codes may be typed without the dash and in lower case
+	if w := do(http.MethodPost, "/api/v1/pairings/"+strings.ToLower(strings.ReplaceAll(code, "-", ""))+"/approve", totp()); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK approving, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(mockDB.addedServers) != 1 || mockDB.addedServers[0].ID == "" {
+		t.Fatalf("expected the approved server to be added, got %+v", mockDB.addedServers)
+	}
+	if w := do(http.MethodPost, "/api/v1/pairings/"+code+"/approve", totp()); w.Code != http.StatusNotFound {
+		t.Errorf("expected status NotFound approving twice, got %d", w.Code)
+	}
+
+	w := do(http.MethodGet, "/api/v1/server/pairing/"+token, "")
+	var credentials struct {
+		ID              string `json:"id"`
+		RevocationToken string `json:"revocationToken"`
+		ProxyID         string `json:"proxyId"`
+		APIKey          string `json:"apiKey"`
+	}
+	json.NewDecoder(w.Body).Decode(&credentials)
+	if w.Code != http.StatusOK || credentials.ID != mockDB.addedServers[0].ID ||
+		credentials.RevocationToken != mockDB.addedServers[0].RevocationToken {
+		t.Errorf("expected the credentials of the approved server, got %d %+v", w.Code, credentials)
+	}
+	// The approved proxy gets its own credential, which owns the server
+	if credentials.APIKey == "" || credentials.ProxyID == "" || mockDB.addedServers[0].Owner != credentials.ProxyID {
+		t.Errorf("expected the approved server to be owned by a new proxy credential, got %+v owned by %q", credentials, mockDB.addedServers[0].Owner)
+	}
+	if stored, err := mockDB.GetProxyCredential(hashCredential(credentials.APIKey)); err != nil || stored.ID != credentials.ProxyID {
+		t.Errorf("expected the proxy credential to be stored, got %+v, %v", stored, err)
+	}
+	if w := do(http.MethodGet, "/api/v1/server/pairing/"+token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the credentials to be handed out once, got %d", w.Code)
+	}
+
+	// The paired proxy registers again with its credential, e.g. after its lease ran out, without pairing
+	paired := `{"proxyUrl": "http://paired.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`
+	mockDB.expireLease(credentials.RevocationToken)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/server", strings.NewReader(paired))
+	req.Header.Set("Authorization", "Bearer "+credentials.APIKey)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(mockDB.addedServers) != 1 || mockDB.addedServers[0].Owner != credentials.ProxyID {
+		t.Errorf("expected the paired proxy to register again without pairing, got %d", w.Code)
+	}
+	// The shared secret cannot take the paired server over
+	if w := do(http.MethodPost, "/api/v1/server", paired); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden registering a paired server with the shared secret, got %d", w.Code)
+	}
+
+	// With the shared secret only the holder of the current revocation token registers a listed server again unpaired
+	reregister := func(revocationToken string) int {
+		return do(http.MethodPost, "/api/v1/server", `{"proxyUrl": "http://example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true, "revocationToken": "`+revocationToken+`"}`).Code
+	}
+	if status := reregister(""); status != http.StatusAccepted {
+		t.Errorf("expected registering a listed server again without its token to need pairing, got %d", status)
+	}
+	if status := reregister("wrong-token"); status != http.StatusAccepted {
+		t.Errorf("expected registering a listed server again with a wrong token to need pairing, got %d", status)
+	}
+	if status := reregister("test-token"); status != http.StatusOK {
+		t.Errorf("expected status OK registering a listed server again with its token, got %d", status)
+	}
+
+	// Proxies with their own credential were vetted at enrollment
+	var enrollment struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(do(http.MethodPost, "/api/v1/enrollment-tokens", `{"name": "proxy"}`).Body).Decode(&enrollment)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/enroll", nil)
+	req.Header.Set("Authorization", "Bearer "+enrollment.Token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var credential struct {
+		APIKey string `json:"apiKey"`
+	}
+	json.NewDecoder(w.Body).Decode(&credential)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/server", strings.NewReader(
+		`{"proxyUrl": "http://enrolled.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`))
+	req.Header.Set("Authorization", "Bearer "+credential.APIKey)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status OK registering with an enrolled credential, got %d", w.Code)
+	}
+
+	code, token = register("http://rejected.example.com")
+	if w := do(http.MethodPost, "/api/v1/pairings/"+code+"/reject", totp()); w.Code != http.StatusOK {
+		t.Errorf("expected status OK rejecting, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/v1/server/pairing/"+token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected a rejected pairing to be gone, got %d", w.Code)
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:  "localhost:8080",
+		AuthSecret:  "my-secret-key",
+		AdminSecret: "my-admin-secret",
+	}
+	r := createRouter(mockDB, cfg)
+
+	do := func(method, target, credential, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+credential)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	enroll := func(name string) (string, string) {
+		w := do(http.MethodPost, "/api/v1/enrollment-tokens", "my-admin-secret", `{"name": "`+name+`"}`)
+		var enrollment struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil || enrollment.Token == "" {
+			t.Fatalf("failed to create enrollment token: %d %v", w.Code, err)
+		}
+		w = do(http.MethodPost, "/api/v1/enroll", enrollment.Token, "")
+		var credential struct {
+			ID     string `json:"id"`
+			APIKey string `json:"apiKey"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&credential); err != nil || credential.APIKey == "" {
+			t.Fatalf("failed to enroll: %d %v", w.Code, err)
+		}
+		if w := do(http.MethodPost, "/api/v1/enroll", enrollment.Token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected an enrollment token to be usable once, got %d", w.Code)
+		}
+		return credential.ID, credential.APIKey
+	}
+	server := func(proxyURL string) string {
+		return `{"proxyUrl": "` + proxyURL + `", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`
+	}
+
+	firstID, firstKey := enroll("first")
+	_, secondKey := enroll("second")
+	if w := do(http.MethodPost, "/api/v1/server", firstKey, server("http://first.example.com")); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK registering with a proxy credential, got %d", w.Code)
+	}
+	if len(mockDB.addedServers) != 1 || mockDB.addedServers[0].Owner != firstID {
+		t.Fatalf("expected the server to be owned by %s, got %+v", firstID, mockDB.addedServers)
+	}
+	revocationToken := mockDB.addedServers[0].RevocationToken
+
+	// Proxy credentials are limited to the proxy's own servers and the proxy routes
+	if w := do(http.MethodPost, "/api/v1/server", secondKey, server("http://first.example.com")); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden taking over another proxy's server, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/server/"+revocationToken, secondKey, ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden removing another proxy's server, got %d", w.Code)
+	}
+	// The shared secret does not open the servers of enrolled proxies either
+	if w := do(http.MethodPost, "/api/v1/server", "my-secret-key", server("http://first.example.com")); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden taking over an enrolled proxy's server with the shared secret, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/server/"+revocationToken, "my-secret-key", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden removing an enrolled proxy's server with the shared secret, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/v1/server/"+revocationToken+"/heartbeat", "my-secret-key", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden renewing an enrolled proxy's server with the shared secret, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/v1/server/"+revocationToken+"/state", "my-secret-key", `{"state": "draining"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden changing an enrolled proxy's server with the shared secret, got %d", w.Code)
+	}
+	if len(mockDB.addedServers) != 1 || mockDB.addedServers[0].State != common.ServerStateActive {
+		t.Errorf("expected the enrolled proxy's server to be untouched, got %+v", mockDB.addedServers)
+	}
+	if w := do(http.MethodGet, "/api/v1/tiers", firstKey, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized on admin routes, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/v1/server", "wrong-key", server("http://other.example.com")); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an unknown credential, got %d", w.Code)
+	}
+
+	var listed struct {
+		Proxies []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"proxies"`
+	}
+	json.NewDecoder(do(http.MethodGet, "/api/v1/proxies", "my-admin-secret", "").Body).Decode(&listed)
+	if len(listed.Proxies) != 2 {
+		t.Errorf("expected two enrolled proxies, got %+v", listed.Proxies)
+	}
+
+	// Revoking a credential removes the servers registered with it
+	if w := do(http.MethodDelete, "/api/v1/proxies/"+firstID, "my-admin-secret", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK revoking, got %d", w.Code)
+	}
+	if len(mockDB.addedServers) != 0 {
+		t.Errorf("expected the servers of the revoked proxy to be removed, got %+v", mockDB.addedServers)
+	}
+	if w := do(http.MethodPost, "/api/v1/server", firstKey, server("http://first.example.com")); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized with a revoked credential, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/proxies/"+firstID, "my-admin-secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status NotFound revoking twice, got %d", w.Code)
+	}
+}
+
+func TestServerLease(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:         "localhost:8080",
+		AuthSecret:         "my-secret-key",
+		ServerLeaseSeconds: 60,
+	}
+	r := createRouter(mockDB, cfg)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer my-secret-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/v1/server", `{"proxyUrl": "http://leased.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`)
+	var registration struct {
+		RevocationToken string `json:"revocationToken"`
+		LeaseSeconds    int    `json:"leaseSeconds"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&registration); err != nil || registration.LeaseSeconds != 60 {
+		t.Fatalf("expected a registration with a 60 second lease, got %d %+v %v", w.Code, registration, err)
+	}
+	if lease := mockDB.leases[registration.RevocationToken]; lease != time.Minute {
+		t.Errorf("expected the server to be stored with a one minute lease, got %v", lease)
+	}
+
+	w = do(http.MethodPost, "/api/v1/server/"+registration.RevocationToken+"/heartbeat", `{"activeConnections": 7}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status OK for a heartbeat, got %d", w.Code)
+	}
+	if server := mockDB.addedServers[0]; server.ActiveConnections != 7 || server.LastHeartbeat == 0 {
+		t.Errorf("expected the heartbeat to be recorded, got %+v", server)
+	}
+	if w := do(http.MethodPost, "/api/v1/server/"+registration.RevocationToken+"/heartbeat", ""); w.Code != http.StatusOK {
+		t.Errorf("expected status OK for a heartbeat without load, got %d", w.Code)
+	}
+
+	// Once the lease ran out the proxy has to register again
+	if w := do(http.MethodPost, "/api/v1/server/unknown-token/heartbeat", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown server, got %d", w.Code)
+	}
+	mockDB.expireLease(registration.RevocationToken)
+	if w := do(http.MethodPost, "/api/v1/server/"+registration.RevocationToken+"/heartbeat", `{"activeConnections": 3}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for a heartbeat after the lease ran out, got %d", w.Code)
+	}
+	if strings.Contains(do(http.MethodGet, "/api/v1/servers", "").Body.String(), "http://leased.example.com") {
+		t.Errorf("expected a late heartbeat not to bring the expired server back")
+	}
+}
+
+func TestServerStates(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:           "localhost:8080",
+		AuthSecret:           "my-secret-key",
+		AdminSecret:          "my-admin-secret",
+		AllowAnonymousTokens: true,
+	}
+	r := createRouter(mockDB, cfg)
+
+	do := func(method, target, credential, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+credential)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	listed := func() []string {
+		var response struct {
+			Servers []common.Server `json:"servers"`
+		}
+		json.NewDecoder(do(http.MethodGet, "/api/v1/servers", "", "").Body).Decode(&response)
+		var urls []string
+		for _, server := range response.Servers {
+			urls = append(urls, server.ProxyURL)
+		}
+		return urls
+	}
+
+	var enrollment struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(do(http.MethodPost, "/api/v1/enrollment-tokens", "my-admin-secret", `{"name": "proxy"}`).Body).Decode(&enrollment)
+	var credential struct {
+		APIKey string `json:"apiKey"`
+	}
+	json.NewDecoder(do(http.MethodPost, "/api/v1/enroll", enrollment.Token, "").Body).Decode(&credential)
+
+	w := do(http.MethodPost, "/api/v1/server", credential.APIKey,
+		`{"proxyUrl": "http://maintenance.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true, "state": "disabled"}`)
+	var registration struct {
+		ID              string             `json:"id"`
+		RevocationToken string             `json:"revocationToken"`
+		State           common.ServerState `json:"state"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&registration); err != nil || registration.State != common.ServerStateActive {
+		t.Fatalf("expected new servers to be active whatever they ask for, got %d %+v %v", w.Code, registration, err)
+	}
+	if !slices.Contains(listed(), "http://maintenance.example.com") {
+		t.Errorf("expected the active server to be listed, got %v", listed())
+	}
+
+	stateURL := "/api/v1/server/" + registration.RevocationToken + "/state"
+	if w := do(http.MethodPut, stateURL, credential.APIKey, `{"state": "pending"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for a state a server cannot be moved to, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, stateURL, credential.APIKey, `{"state": "draining"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK draining, got %d", w.Code)
+	}
+	if slices.Contains(listed(), "http://maintenance.example.com") {
+		t.Errorf("expected the draining server to be hidden, got %v", listed())
+	}
+	if w := do(http.MethodGet, "/api/v1/token?server="+registration.ID, "", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected status Conflict for a token bound to a draining server, got %d", w.Code)
+	}
+	w = do(http.MethodPost, "/api/v1/server/"+registration.RevocationToken+"/heartbeat", credential.APIKey, "")
+	var heartbeat struct {
+		State common.ServerState `json:"state"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&heartbeat); err != nil || heartbeat.State != common.ServerStateDraining {
+		t.Errorf("expected heartbeats to report the state, got %+v %v", heartbeat, err)
+	}
+
+	// Restarting the proxy during maintenance keeps the server drained
+	w = do(http.MethodPost, "/api/v1/server", credential.APIKey,
+		`{"proxyUrl": "http://maintenance.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`)
+	if err := json.NewDecoder(w.Body).Decode(&registration); err != nil || registration.State != common.ServerStateDraining {
+		t.Fatalf("expected a drained server to stay draining when registering again, got %d %+v %v", w.Code, registration, err)
+	}
+	if slices.Contains(listed(), "http://maintenance.example.com") {
+		t.Errorf("expected the re-registered draining server to stay hidden, got %v", listed())
+	}
+	stateURL = "/api/v1/server/" + registration.RevocationToken + "/state"
+
+	// Only an admin brings back a disabled server
+	if w := do(http.MethodPut, "/api/v1/admin/servers/"+registration.ID+"/state", "my-admin-secret", `{"state": "disabled"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK disabling, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, stateURL, credential.APIKey, `{"state": "active"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden enabling a disabled server as a proxy, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/v1/admin/servers/"+registration.ID+"/state", credential.APIKey, `{"state": "active"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized on the admin route, got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/api/v1/admin/servers/unknown/state", "my-admin-secret", `{"state": "active"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown server, got %d", w.Code)
+	}
+
+	// The state outlives the lease, a proxy that was down for longer comes back disabled
+	expire := func() {
+		for _, server := range slices.Clone(mockDB.addedServers) {
+			if server.ProxyURL == "http://maintenance.example.com" {
+				mockDB.expireLease(server.RevocationToken)
+			}
+		}
+	}
+	register := func() {
+		w := do(http.MethodPost, "/api/v1/server", credential.APIKey,
+			`{"proxyUrl": "http://maintenance.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`)
+		if err := json.NewDecoder(w.Body).Decode(&registration); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("failed to register again: %d %v", w.Code, err)
+		}
+	}
+	expire()
+	register()
+	if registration.State != common.ServerStateDisabled || slices.Contains(listed(), "http://maintenance.example.com") {
+		t.Errorf("expected a disabled server to stay disabled after its lease ran out, got %+v", registration)
+	}
+
+	if w := do(http.MethodPut, "/api/v1/admin/servers/"+registration.ID+"/state", "my-admin-secret", `{"state": "active"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK enabling, got %d", w.Code)
+	}
+	if !slices.Contains(listed(), "http://maintenance.example.com") {
+		t.Errorf("expected the enabled server to be listed again, got %v", listed())
+	}
+	expire()
+	register()
+	if registration.State != common.ServerStateActive {
+		t.Errorf("expected an enabled server to register as active after its lease ran out, got %+v", registration)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	mockDB := &MockDatabase{}
+	cfg := &Config{
+		ListenAddr:  "localhost:8080",
+		AuthSecret:  "my-secret-key",
+		AdminSecret: "my-admin-secret",
+	}
+	r := createRouter(mockDB, cfg)
+
+	do := func(method, target, credential, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+credential)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	createUser := func(role string) (string, string) {
+		var user struct {
+			ID     string `json:"id"`
+			APIKey string `json:"apiKey"`
+		}
+		w := do(http.MethodPost, "/api/v1/admin/users", "my-admin-secret", `{"name": "`+role+`", "role": "`+role+`"}`)
+		if err := json.NewDecoder(w.Body).Decode(&user); err != nil || user.APIKey == "" {
+			t.Fatalf("failed to create %s: %d %v", role, w.Code, err)
+		}
+		return user.ID, user.APIKey
+	}
+	_, viewer := createUser("viewer")
+	operatorID, operator := createUser("operator")
+	_, admin := createUser("admin")
+	if w := do(http.MethodPost, "/api/v1/admin/users", "my-admin-secret", `{"name": "root", "role": "root"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an unknown role, got %d", w.Code)
+	}
+	// The secret shared with proxies does not open the admin routes
+	if w := do(http.MethodGet, "/api/v1/admin/users", "my-secret-key", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized with the proxy secret, got %d", w.Code)
+	}
+
+	w := do(http.MethodPost, "/api/v1/server", "my-secret-key",
+		`{"proxyUrl": "http://fleet.example.com", "city": "TestCity", "country": "TestCountry", "supportsConnectTcp": true}`)
+	var registration struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&registration); err != nil {
+		t.Fatalf("failed to register server: %d %v", w.Code, err)
+	}
+	serverURL := "/api/v1/admin/servers/" + registration.ID
+
+	// Every role reads the fleet, including servers hidden from clients and without revocation tokens
+	if w := do(http.MethodPut, serverURL+"/state", operator, `{"state": "disabled"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK disabling as operator, got %d", w.Code)
+	}
+	w = do(http.MethodGet, "/api/v1/admin/servers", viewer, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "test-token") {
+		t.Fatalf("expected the servers without revocation tokens, got %d %s", w.Code, w.Body.String())
+	}
+	var listed struct {
+		Servers []common.Server `json:"servers"`
+	}
+	json.NewDecoder(w.Body).Decode(&listed)
+	if !slices.ContainsFunc(listed.Servers, func(s common.Server) bool {
+		return s.ID == registration.ID && s.State == common.ServerStateDisabled
+	}) {
+		t.Errorf("expected the disabled server to be listed, got %+v", listed)
+	}
+
+	// Viewers cannot change anything
+	for _, request := range []struct{ method, target, body string }{
+		{http.MethodPatch, serverURL, `{"city": "Elsewhere"}`},
+		{http.MethodDelete, serverURL, ""},
+		{http.MethodPut, serverURL + "/state", `{"state": "active"}`},
+		{http.MethodPut, "/api/v1/tiers/free", `{"tokenTtl": 60}`},
+	} {
+		if w := do(request.method, request.target, viewer, request.body); w.Code != http.StatusForbidden {
+			t.Errorf("expected status Forbidden for %s %s as viewer, got %d", request.method, request.target, w.Code)
+		}
+	}
+	if w := do(http.MethodGet, "/api/v1/admin/servers", "unknown-key", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an unknown API key, got %d", w.Code)
+	}
+
+	// Operators edit servers, partial updates keep the other fields
+	if w := do(http.MethodPatch, serverURL, operator, `{"latitude": 100}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for an invalid latitude, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, "/api/v1/admin/servers/unknown", operator, `{"city": "Elsewhere"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown server, got %d", w.Code)
+	}
+	if w := do(http.MethodPatch, serverURL, operator, `{"city": "Elsewhere", "supportsConnectUdp": true}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK editing, got %d", w.Code)
+	}
+	var edited common.Server
+	json.NewDecoder(do(http.MethodGet, serverURL, viewer, "").Body).Decode(&edited)
+	if edited.City != "Elsewhere" || !edited.SupportsConnectUDP || !edited.SupportsConnectTCP || edited.Country != "TestCountry" {
+		t.Errorf("expected only the given fields to change, got %+v", edited)
+	}
+	if w := do(http.MethodPost, "/api/v1/admin/users", operator, `{"name": "other", "role": "admin"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden creating admin users as operator, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, serverURL, operator, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK removing, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, serverURL, viewer, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected the removed server to be gone, got %d", w.Code)
+	}
+
+	// Admins revoke signing keys, a new key takes over
+	type listedKey struct {
+		Kid  string `json:"kid"`
+		Role string `json:"role"`
+	}
+	var keys struct {
+		Keys []listedKey `json:"keys"`
+	}
+	json.NewDecoder(do(http.MethodGet, "/api/v1/admin/keys", viewer, "").Body).Decode(&keys)
+	i := slices.IndexFunc(keys.Keys, func(k listedKey) bool { return k.Role == keyRoleActive })
+	if i < 0 {
+		t.Fatalf("expected an active key, got %+v", keys)
+	}
+	revoked := keys.Keys[i].Kid
+	if w := do(http.MethodDelete, "/api/v1/admin/keys/"+revoked, operator, ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status Forbidden revoking keys as operator, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/admin/keys/"+revoked, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK revoking, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/admin/keys/"+revoked, admin, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for a revoked key, got %d", w.Code)
+	}
+	json.NewDecoder(do(http.MethodGet, "/api/v1/admin/keys", viewer, "").Body).Decode(&keys)
+	if len(keys.Keys) == 0 || slices.ContainsFunc(keys.Keys, func(k listedKey) bool { return k.Kid == revoked }) {
+		t.Errorf("expected the key to be replaced, got %+v", keys)
+	}
+	if _, err := mockDB.GetJWTKey(revoked); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the key to be removed from the key set, got %v", err)
+	}
+
+	// Removed admin users lose access
+	if w := do(http.MethodDelete, "/api/v1/admin/users/"+operatorID, admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status OK removing the operator, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/v1/admin/servers", operator, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for a removed admin user, got %d", w.Code)
+	}
+}
+
 func TestRemoveServerEndpoint(t *testing.T) {
 	mockDB := &MockDatabase{}
 	cfg := &Config{
@@ -235,4 +2021,11 @@ func TestRemoveServerEndpoint(t *testing.T) {
 	if body := w.Body.String(); body != "Server removed successfully" {
 		t.Errorf("expected body 'Server removed successfully', got %v", body)
 	}
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/server/unknown-token", nil)
+	req.Header.Set("Authorization", "Bearer my-secret-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown server, got %d", w.Code)
+	}
 }
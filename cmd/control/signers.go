@@ -0,0 +1,199 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/strseb/zdvv/pkg/common"
+)
+
+// Signer backends selectable with ZDVV_SIGNER_BACKEND
+const (
+	signerBackendMemory = "memory"
+	signerBackendFile   = "file"
+	signerBackendPKCS11 = "pkcs11"
+)
+
+// SignerBackend holds the private keys tokens are signed with. Private keys never leave backends
+// like HSMs, tokens are signed through the crypto.Signer they return.
+type SignerBackend interface {
+	// Generate creates a key pair for the algorithm, stored under kid
+	Generate(kid string, alg string) (crypto.Signer, error)
+	// Signer returns the signer of a key generated before, returning ErrNotFound if the backend does not hold it
+	Signer(kid string) (crypto.Signer, error)
+	// Shared reports whether all replicas reach the keys, only then they sign with the same key
+	Shared() bool
+}
+
+// newSignerBackend creates the backend selected in the config
+func newSignerBackend(cfg *Config, db Database) (SignerBackend, error) {
+	switch cfg.SignerBackend {
+	case signerBackendMemory, "":
+		masterKey, err := loadMasterKey(cfg.KeyEncryptionKey, cfg.KeyEncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key encryption key: %w", err)
+		}
+		if masterKey == nil {
+			return memorySigners{}, nil
+		}
+		encrypter, err := newKeyEncrypter(masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key encryption key: %w", err)
+		}
+		return &databaseSigners{db: db, encrypter: encrypter}, nil
+	case signerBackendFile:
+		if cfg.SignerKeyDir == "" {
+			return nil, errors.New("ZDVV_SIGNER_KEY_DIR is required for the file signer backend")
+		}
+		return &fileSigners{dir: cfg.SignerKeyDir}, nil
+	case signerBackendPKCS11:
+		return newPKCS11Signers(cfg.PKCS11Module, cfg.PKCS11TokenLabel, cfg.PKCS11PIN)
+	default:
+		return nil, fmt.Errorf("unknown signer backend %q", cfg.SignerBackend)
+	}
+}
+
+// memorySigners generates keys in process memory. The keys are not kept by the backend,
+// the key store holds on to the keys of its instance.
+type memorySigners struct{}
+
+func (memorySigners) Generate(kid string, alg string) (crypto.Signer, error) {
+	return common.GenerateSigner(alg)
+}
+
+func (memorySigners) Signer(kid string) (crypto.Signer, error) {
+	return nil, ErrNotFound
+}
+
+func (memorySigners) Shared() bool {
+	return false
+}
+
+// databaseSigners generates keys in process memory and stores them envelope encrypted in the database
+type databaseSigners struct {
+	db        Database
+	encrypter *keyEncrypter
+}
+
+func (d *databaseSigners) Generate(kid string, alg string) (crypto.Signer, error) {
+	signer, err := common.GenerateSigner(alg)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := d.encrypter.seal(kid, der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt JWT key: %w", err)
+	}
+	if err := d.db.PutJWTPrivateKey(kid, sealed); err != nil {
+		return nil, fmt.Errorf("failed to store JWT private key: %w", err)
+	}
+	return signer, nil
+}
+
+func (d *databaseSigners) Signer(kid string) (crypto.Signer, error) {
+	sealed, err := d.db.GetJWTPrivateKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	der, err := d.encrypter.open(kid, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt JWT key %s: %w", kid, err)
+	}
+	return parsePrivateKey(der)
+}
+
+func (d *databaseSigners) Shared() bool {
+	return true
+}
+
+// fileSigners keeps keys as PKCS #8 PEM files named after their kid in a directory,
+// e.g. a volume mounted into all replicas
+type fileSigners struct {
+	dir string
+}
+
+func (f *fileSigners) Generate(kid string, alg string) (crypto.Signer, error) {
+	path, err := f.path(kid)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := common.GenerateSigner(alg)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return signer, nil
+}
+
+func (f *fileSigners) Signer(kid string) (crypto.Signer, error) {
+	path, err := f.path(kid)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("key file %s holds no PKCS #8 private key", path)
+	}
+	return parsePrivateKey(block.Bytes)
+}
+
+func (f *fileSigners) Shared() bool {
+	return true
+}
+
+// path returns the key file of a kid, which must not leave the key directory
+func (f *fileSigners) path(kid string) (string, error) {
+	if kid == "" || strings.ContainsAny(kid, `/\.`) {
+		return "", fmt.Errorf("invalid kid %q", kid)
+	}
+	return filepath.Join(f.dir, kid+".pem"), nil
+}
+
+// parsePrivateKey parses a PKCS #8 private key usable for signing
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return signer, nil
+}
@@ -0,0 +1,14 @@
+//go:build !pkcs11
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import "errors"
+
+// newPKCS11Signers fails, PKCS #11 support needs cgo and is only built with the pkcs11 build tag
+func newPKCS11Signers(module string, tokenLabel string, pin string) (SignerBackend, error) {
+	return nil, errors.New("the control server was built without PKCS #11 support, build with -tags pkcs11")
+}
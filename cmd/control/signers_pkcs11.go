@@ -0,0 +1,66 @@
+//go:build pkcs11
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// pkcs11Signers generates and keeps keys in a PKCS #11 token, e.g. an HSM or SoftHSM for local testing.
+// Keys are found by their CKA_ID, which is the kid.
+type pkcs11Signers struct {
+	ctx *crypto11.Context
+}
+
+// newPKCS11Signers logs into the token with the given label of a PKCS #11 module
+func newPKCS11Signers(module string, tokenLabel string, pin string) (SignerBackend, error) {
+	if module == "" || tokenLabel == "" {
+		return nil, errors.New("ZDVV_PKCS11_MODULE and ZDVV_PKCS11_TOKEN_LABEL are required for the pkcs11 signer backend")
+	}
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       module,
+		TokenLabel: tokenLabel,
+		Pin:        pin,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PKCS #11 token: %w", err)
+	}
+	return &pkcs11Signers{ctx: ctx}, nil
+}
+
+func (p *pkcs11Signers) Generate(kid string, alg string) (crypto.Signer, error) {
+	label := []byte("zdvv-" + kid)
+	switch alg {
+	case auth.AlgorithmRS256:
+		return p.ctx.GenerateRSAKeyPairWithLabel([]byte(kid), label, 2048)
+	case auth.AlgorithmES256:
+		return p.ctx.GenerateECDSAKeyPairWithLabel([]byte(kid), label, elliptic.P256())
+	default:
+		return nil, fmt.Errorf("signing algorithm %q is not supported with PKCS #11", alg)
+	}
+}
+
+func (p *pkcs11Signers) Signer(kid string) (crypto.Signer, error) {
+	signer, err := p.ctx.FindKeyPair([]byte(kid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find key %s: %w", kid, err)
+	}
+	if signer == nil {
+		return nil, ErrNotFound
+	}
+	return signer, nil
+}
+
+func (p *pkcs11Signers) Shared() bool {
+	return true
+}
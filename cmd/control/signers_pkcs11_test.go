@@ -0,0 +1,33 @@
+//go:build pkcs11
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// TestPKCS11Signers runs against an initialized token, e.g. of SoftHSM:
+//
+//	softhsm2-util --init-token --free --label zdvv-test --pin 1234 --so-pin 1234
+//	ZDVV_TEST_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so go test -tags pkcs11 ./cmd/control
+func TestPKCS11Signers(t *testing.T) {
+	module := os.Getenv("ZDVV_TEST_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("ZDVV_TEST_PKCS11_MODULE not set")
+	}
+	signers, err := newPKCS11Signers(module, "zdvv-test", "1234")
+	if err != nil {
+		t.Fatalf("failed to open token: %v", err)
+	}
+	testSignerBackend(t, signers, auth.AlgorithmRS256, auth.AlgorithmES256)
+	if _, err := signers.Generate("10009", auth.AlgorithmEdDSA); err == nil {
+		t.Error("expected an error for EdDSA")
+	}
+}
@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// testSignerBackend generates keys for every algorithm and checks they are found again
+func testSignerBackend(t *testing.T, signers SignerBackend, algs ...string) {
+	t.Helper()
+	for i, alg := range algs {
+		kid := strconv.Itoa(10000 + i)
+		signer, err := signers.Generate(kid, alg)
+		if err != nil {
+			t.Fatalf("failed to generate %s key: %v", alg, err)
+		}
+		key, err := common.NewJWTKeyFromSigner(kid, alg, signer)
+		if err != nil {
+			t.Fatalf("generated %s key does not match the algorithm: %v", alg, err)
+		}
+
+		found, err := signers.Signer(kid)
+		if err != nil {
+			t.Fatalf("failed to find %s key: %v", alg, err)
+		}
+		restored := *key
+		if err := restored.SetSigner(found); err != nil {
+			t.Fatalf("found another %s key: %v", alg, err)
+		}
+		if _, err := restored.Sign(common.TokenRequest{Issuer: "test", ValidFor: time.Hour}); err != nil {
+			t.Errorf("failed to sign with %s key: %v", alg, err)
+		}
+	}
+	if _, err := signers.Signer("99999"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown key, got %v", err)
+	}
+}
+
+func TestFileSigners(t *testing.T) {
+	dir := t.TempDir()
+	signers := &fileSigners{dir: dir}
+	testSignerBackend(t, signers, auth.AlgorithmRS256, auth.AlgorithmES256, auth.AlgorithmEdDSA)
+
+	info, err := os.Stat(filepath.Join(dir, "10000.pem"))
+	if err != nil {
+		t.Fatalf("expected a key file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected key file mode 0600, got %v", info.Mode().Perm())
+	}
+	if _, err := signers.Generate("10000", auth.AlgorithmES256); err == nil {
+		t.Error("expected an error overwriting a key")
+	}
+	if _, err := signers.Signer("../10000"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an error for a kid outside the key directory, got %v", err)
+	}
+}
+
+func TestDatabaseSigners(t *testing.T) {
+	db := &MockDatabase{}
+	testSignerBackend(t, &databaseSigners{db: db, encrypter: newTestEncrypter(t, 1)},
+		auth.AlgorithmRS256, auth.AlgorithmES256, auth.AlgorithmEdDSA)
+}
@@ -0,0 +1,420 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+const (
+	// rotationCheckInterval is how often the rotation scheduler runs
+	rotationCheckInterval = time.Minute
+	// rotationMargin is how long before the active key expires the next key takes over,
+	// so replicas never find the active key expired
+	rotationMargin = 5 * rotationCheckInterval
+	// rotationLockTTL bounds how long a crashed replica can block rotation
+	rotationLockTTL = 30 * time.Second
+	// retentionSkew is added to the token lifetime when retiring keys, for clock differences
+	retentionSkew = 5 * time.Minute
+	// defaultTokenLifetime is the longest token lifetime assumed while there are no tiers
+	defaultTokenLifetime = 24 * time.Hour
+	// ownKeyCacheTTL is how long introspection uses the keys read from the database, so a key
+	// revoked on another replica stops validating tokens soon
+	ownKeyCacheTTL = 10 * time.Second
+)
+
+// Roles of the keys tracked by the rotation
+const (
+	keyRoleActive = "active"
+	keyRoleNext   = "next"
+)
+
+// signingKeyStore provides the key tokens are signed with and rotates keys in the background.
+// The next key is published in the key set prepublish before it starts signing, and keys stay
+// published until the longest token lifetime has passed after they stopped signing.
+//
+// With a shared signer backend all replicas sign with the same active key, which survives restarts,
+// and only one replica at a time rotates. Otherwise every instance rotates its own keys in memory.
+type signingKeyStore struct {
+	db      Database
+	signers SignerBackend
+	alg     string
+	// lifetime is how long a key signs tokens
+	lifetime time.Duration
+	// prepublish is how long the next key is published before it signs tokens
+	prepublish time.Duration
+	// owner identifies this instance when holding the rotation lock
+	owner string
+
+	// mutex guards the signing key cached for Sign
+	mutex sync.RWMutex
+	key   *common.JWTKey
+
+	// rotationMutex serializes rotations of this instance and guards the in-memory keys
+	rotationMutex sync.Mutex
+	localActive   *common.JWTKey
+	localNext     *common.JWTKey
+}
+
+// newSigningKeyStore creates a key store generating private keys in the signer backend
+func newSigningKeyStore(db Database, signers SignerBackend, alg string, lifetime, prepublish time.Duration) (*signingKeyStore, error) {
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, err
+	}
+	if alg == "" {
+		alg = auth.AlgorithmRS256
+	}
+	return &signingKeyStore{
+		db:         db,
+		signers:    signers,
+		alg:        alg,
+		lifetime:   lifetime,
+		prepublish: prepublish,
+		owner:      hex.EncodeToString(owner),
+	}, nil
+}
+
+// Sign signs a token with the active key
+func (s *signingKeyStore) Sign(req common.TokenRequest) (string, error) {
+	key, err := s.activeKey()
+	if err != nil {
+		return "", err
+	}
+	return key.Sign(req)
+}
+
+// activeKey returns the key to sign with. The key is cached until it expires, by then the
+// scheduler has made the next key active.
+func (s *signingKeyStore) activeKey() (*common.JWTKey, error) {
+	s.mutex.RLock()
+	key := s.key
+	s.mutex.RUnlock()
+	if key != nil && !key.IsExpired() {
+		return key, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.key != nil && !s.key.IsExpired() {
+		return s.key, nil
+	}
+	key, err := s.current(keyRoleActive)
+	if errors.Is(err, ErrNotFound) {
+		// Rotation fell behind or never ran, e.g. on the first start
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+		key, err = s.current(keyRoleActive)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load active JWT key: %w", err)
+	}
+	s.key = key
+	return key, nil
+}
+
+// run rotates keys every rotationCheckInterval for the lifetime of the process
+func (s *signingKeyStore) run() {
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.dropRevoked(); err != nil {
+			log.Printf("Error checking for revoked JWT keys: %v", err)
+		}
+		if err := s.rotate(); err != nil {
+			log.Printf("Error rotating JWT keys: %v", err)
+		}
+	}
+}
+
+// rotate publishes the next key once the active key is about to expire, makes it active when it
+// was published long enough, and extends how long old keys are kept. With shared keys it does
+// nothing while another replica holds the rotation lock.
+func (s *signingKeyStore) rotate() error {
+	s.rotationMutex.Lock()
+	defer s.rotationMutex.Unlock()
+
+	if s.signers.Shared() {
+		locked, err := s.db.AcquireLock("keyrotation", s.owner, rotationLockTTL)
+		if err != nil {
+			return fmt.Errorf("failed to acquire rotation lock: %w", err)
+		}
+		if !locked {
+			return nil
+		}
+		defer func() {
+			if err := s.db.ReleaseLock("keyrotation", s.owner); err != nil {
+				log.Printf("Error releasing rotation lock: %v", err)
+			}
+		}()
+	}
+
+	active, err := s.currentOptionalLocked(keyRoleActive)
+	if err != nil {
+		return err
+	}
+	next, err := s.currentOptionalLocked(keyRoleNext)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case active == nil || active.IsExpired():
+		// Without a usable key there is nothing to wait for
+		active, next = next, nil
+	case next != nil && !now.Before(time.Unix(next.PublishedAt, 0).Add(s.prepublish)) &&
+		!now.Before(time.Unix(active.ExpiresAt, 0).Add(-rotationMargin)):
+		active, next = next, nil
+	}
+	if active == nil || active.IsExpired() {
+		if active, err = s.create(now.Add(s.lifetime)); err != nil {
+			return err
+		}
+	}
+	if next == nil && !now.Before(time.Unix(active.ExpiresAt, 0).Add(-rotationMargin-s.prepublish)) {
+		if next, err = s.create(time.Unix(active.ExpiresAt, 0).Add(s.lifetime)); err != nil {
+			return err
+		}
+		log.Printf("Published next JWT key %s", next.Kid)
+	}
+
+	if err := s.setRole(keyRoleActive, active); err != nil {
+		return err
+	}
+	if err := s.setRole(keyRoleNext, next); err != nil {
+		return err
+	}
+	return s.retain()
+}
+
+// revoke removes a key from the key set, so tokens signed with it no longer validate. A revoked
+// active or next key is replaced right away, other replicas stop signing with it at their next
+// rotation check.
+func (s *signingKeyStore) revoke(kid string) error {
+	s.rotationMutex.Lock()
+	roles, err := s.keyRolesLocked()
+	if err == nil {
+		err = s.db.RemoveJWTKey(kid)
+	}
+	if err == nil && roles[kid] != "" {
+		err = s.setRole(roles[kid], nil)
+	}
+	s.rotationMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked JWT key %s", kid)
+
+	s.mutex.Lock()
+	if s.key != nil && s.key.Kid == kid {
+		s.key = nil
+	}
+	s.mutex.Unlock()
+	return s.rotate()
+}
+
+// dropRevoked forgets keys another replica revoked, rotate replaces them
+func (s *signingKeyStore) dropRevoked() error {
+	s.mutex.RLock()
+	cached := s.key
+	s.mutex.RUnlock()
+	if cached != nil {
+		if _, err := s.db.GetJWTKey(cached.Kid); errors.Is(err, ErrNotFound) {
+			s.mutex.Lock()
+			if s.key == cached {
+				s.key = nil
+			}
+			s.mutex.Unlock()
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if s.signers.Shared() {
+		// Roles of removed keys are not found by currentOptionalLocked anymore
+		return nil
+	}
+	s.rotationMutex.Lock()
+	defer s.rotationMutex.Unlock()
+	for _, current := range []**common.JWTKey{&s.localActive, &s.localNext} {
+		if *current == nil {
+			continue
+		}
+		if _, err := s.db.GetJWTKey((*current).Kid); errors.Is(err, ErrNotFound) {
+			log.Printf("JWT key %s was revoked", (*current).Kid)
+			*current = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyRoles maps the kids of the active and next key to their role
+func (s *signingKeyStore) keyRoles() (map[string]string, error) {
+	s.rotationMutex.Lock()
+	defer s.rotationMutex.Unlock()
+	return s.keyRolesLocked()
+}
+
+func (s *signingKeyStore) keyRolesLocked() (map[string]string, error) {
+	roles := map[string]string{}
+	if !s.signers.Shared() {
+		if s.localActive != nil {
+			roles[s.localActive.Kid] = keyRoleActive
+		}
+		if s.localNext != nil {
+			roles[s.localNext.Kid] = keyRoleNext
+		}
+		return roles, nil
+	}
+	for _, role := range []string{keyRoleActive, keyRoleNext} {
+		kid, err := s.db.GetJWTKeyID(role)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		roles[kid] = role
+	}
+	return roles, nil
+}
+
+// create generates and stores a key signing until expiresAt, it is published right away
+func (s *signingKeyStore) create(expiresAt time.Time) (*common.JWTKey, error) {
+	kid, err := common.NewKeyID()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := s.signers.Generate(kid, s.alg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWT key: %w", err)
+	}
+	key, err := common.NewJWTKeyFromSigner(kid, s.alg, signer)
+	if err != nil {
+		return nil, err
+	}
+	key.ExpiresAt = expiresAt.Unix()
+	if err := s.db.PutJWTKey(key); err != nil {
+		return nil, fmt.Errorf("failed to store JWT key: %w", err)
+	}
+	return key, nil
+}
+
+// setRole points a role at a key, or clears it for a nil key
+func (s *signingKeyStore) setRole(role string, key *common.JWTKey) error {
+	if !s.signers.Shared() {
+		current := &s.localActive
+		if role == keyRoleNext {
+			current = &s.localNext
+		}
+		if key != nil && (*current == nil || (*current).Kid != key.Kid) {
+			log.Printf("JWT key %s is now %s", key.Kid, role)
+		}
+		*current = key
+		return nil
+	}
+
+	if key == nil {
+		return s.db.SetJWTKeyID(role, "", time.Time{})
+	}
+	if current, err := s.db.GetJWTKeyID(role); err != nil || current != key.Kid {
+		log.Printf("JWT key %s is now %s", key.Kid, role)
+	}
+	return s.db.SetJWTKeyID(role, key.Kid, time.Unix(key.ExpiresAt, 0))
+}
+
+// retain keeps every key published until tokens signed with it can no longer be valid
+func (s *signingKeyStore) retain() error {
+	tokenLifetime, err := s.longestTokenLifetime()
+	if err != nil {
+		return err
+	}
+	keys, err := s.db.GetAllActiveJWTKeys()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve JWT keys: %w", err)
+	}
+	for _, key := range keys {
+		until := time.Unix(key.ExpiresAt, 0).Add(tokenLifetime + retentionSkew)
+		if err := s.db.RetainJWTKey(key.Kid, until); err != nil {
+			return fmt.Errorf("failed to retain JWT key %s: %w", key.Kid, err)
+		}
+	}
+	return nil
+}
+
+// longestTokenLifetime returns the longest lifetime of tokens any tier mints
+func (s *signingKeyStore) longestTokenLifetime() (time.Duration, error) {
+	tiers, err := s.db.GetAllTiers()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve tiers: %w", err)
+	}
+	if len(tiers) == 0 {
+		return defaultTokenLifetime, nil
+	}
+	var longest time.Duration
+	for _, tier := range tiers {
+		longest = max(longest, time.Duration(tier.TokenTTL)*time.Second)
+	}
+	return longest, nil
+}
+
+// current returns the key in a role, returning ErrNotFound if there is none
+func (s *signingKeyStore) current(role string) (*common.JWTKey, error) {
+	s.rotationMutex.Lock()
+	defer s.rotationMutex.Unlock()
+	return s.currentLocked(role)
+}
+
+// currentOptionalLocked returns the key in a role, or nil if there is none
+func (s *signingKeyStore) currentOptionalLocked(role string) (*common.JWTKey, error) {
+	key, err := s.currentLocked(role)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return key, err
+}
+
+// currentLocked returns the key in a role with its private key, returning ErrNotFound if there is none
+func (s *signingKeyStore) currentLocked(role string) (*common.JWTKey, error) {
+	if !s.signers.Shared() {
+		key := s.localActive
+		if role == keyRoleNext {
+			key = s.localNext
+		}
+		if key == nil {
+			return nil, ErrNotFound
+		}
+		return key, nil
+	}
+
+	kid, err := s.db.GetJWTKeyID(role)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.db.GetJWTKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := s.signers.Signer(kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.SetSigner(signer); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
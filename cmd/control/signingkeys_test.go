@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+func newTestEncrypter(t *testing.T, fill byte) *keyEncrypter {
+	t.Helper()
+	encrypter, err := newKeyEncrypter(bytes.Repeat([]byte{fill}, masterKeySize))
+	if err != nil {
+		t.Fatalf("failed to create key encrypter: %v", err)
+	}
+	return encrypter
+}
+
+func TestKeyEncrypter(t *testing.T) {
+	encrypter := newTestEncrypter(t, 1)
+	plaintext := []byte("private key")
+	sealed, err := encrypter.seal("kid-1", plaintext)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if bytes.Contains([]byte(sealed.Ciphertext+sealed.WrappedKey), plaintext) {
+		t.Error("sealed key contains the plaintext")
+	}
+
+	opened, err := encrypter.open("kid-1", sealed)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("expected to open the sealed key, got %q, %v", opened, err)
+	}
+	if _, err := encrypter.open("kid-2", sealed); err == nil {
+		t.Error("expected an error opening the key under another kid")
+	}
+	if _, err := newTestEncrypter(t, 2).open("kid-1", sealed); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("expected ErrWrongMasterKey, got %v", err)
+	}
+	if _, err := newKeyEncrypter([]byte("short")); err == nil {
+		t.Error("expected an error for a short master key")
+	}
+}
+
+// newTestKeyStore creates a key store signing with 24 hour keys published an hour ahead
+func newTestKeyStore(t *testing.T, db Database, signers SignerBackend) *signingKeyStore {
+	t.Helper()
+	store, err := newSigningKeyStore(db, signers, auth.AlgorithmES256, 24*time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create key store: %v", err)
+	}
+	return store
+}
+
+func TestSigningKeyStoreShared(t *testing.T) {
+	db := &MockDatabase{}
+	first := newTestKeyStore(t, db, &databaseSigners{db: db, encrypter: newTestEncrypter(t, 1)})
+	firstKey, err := first.activeKey()
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	// Another replica, or the same one after a restart, signs with the same key
+	second := newTestKeyStore(t, db, &databaseSigners{db: db, encrypter: newTestEncrypter(t, 1)})
+	secondKey, err := second.activeKey()
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+	if secondKey.Kid != firstKey.Kid || len(db.jwtKeys) != 1 {
+		t.Errorf("expected a single shared key, got %s and %s", firstKey.Kid, secondKey.Kid)
+	}
+	if _, err := second.Sign(common.TokenRequest{Issuer: "test", ValidFor: time.Hour}); err != nil {
+		t.Errorf("failed to sign with the loaded key: %v", err)
+	}
+
+	other := newTestKeyStore(t, db, &databaseSigners{db: db, encrypter: newTestEncrypter(t, 2)})
+	if _, err := other.activeKey(); !errors.Is(err, ErrWrongMasterKey) {
+		t.Errorf("expected ErrWrongMasterKey with another master key, got %v", err)
+	}
+
+	// Without a master key nothing is shared
+	local := newTestKeyStore(t, db, memorySigners{})
+	localKey, err := local.activeKey()
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	if localKey.Kid == firstKey.Kid || db.privateJWTKey[localKey.Kid] != nil {
+		t.Error("expected an unshared in-memory key without a master key")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	db := &MockDatabase{}
+	db.PutTier(&common.Tier{Name: "long", Permissions: []string{"proxy:*"}, TokenTTL: 4 * 3600})
+	store := newTestKeyStore(t, db, &databaseSigners{db: db, encrypter: newTestEncrypter(t, 1)})
+	// jwtKey returns the stored key with the given kid, its times can be moved to simulate time passing
+	jwtKey := func(kid string) *common.JWTKey {
+		for _, key := range db.jwtKeys {
+			if key.Kid == kid {
+				return key
+			}
+		}
+		t.Fatalf("key %s not found", kid)
+		return nil
+	}
+
+	active, err := store.activeKey()
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	if _, ok := db.keyRoles[keyRoleNext]; ok {
+		t.Fatal("expected no next key while the active key is fresh")
+	}
+
+	// An hour and the rotation margin before the active key expires, the next key is published
+	jwtKey(active.Kid).ExpiresAt = time.Now().Add(time.Hour).Unix()
+	if err := store.rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	nextKid, ok := db.keyRoles[keyRoleNext]
+	if !ok || db.keyRoles[keyRoleActive] != active.Kid {
+		t.Fatalf("expected a published next key next to active key %s, got %v", active.Kid, db.keyRoles)
+	}
+	keys, _ := db.GetAllActiveJWTKeys()
+	if len(keys) != 2 {
+		t.Errorf("expected the next key in the key set, got %d keys", len(keys))
+	}
+	next := jwtKey(nextKid)
+	if next.ExpiresAt != jwtKey(active.Kid).ExpiresAt+int64((24*time.Hour).Seconds()) {
+		t.Error("expected the next key to sign for a full lifetime after the active key")
+	}
+
+	// It does not sign before it was published for the pre-publication time
+	jwtKey(active.Kid).ExpiresAt = time.Now().Add(time.Minute).Unix()
+	if err := store.rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if db.keyRoles[keyRoleActive] != active.Kid {
+		t.Error("expected the next key to wait for the pre-publication time")
+	}
+
+	next.PublishedAt = time.Now().Add(-time.Hour).Unix()
+	if err := store.rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if db.keyRoles[keyRoleActive] != nextKid {
+		t.Errorf("expected key %s to be active, got %v", nextKid, db.keyRoles)
+	}
+
+	// Keys are kept until the longest token lifetime passed after they stopped signing
+	retainedUntil := time.Unix(jwtKey(active.Kid).ExpiresAt, 0).Add(4*time.Hour + retentionSkew)
+	if !db.retained[active.Kid].Equal(retainedUntil) {
+		t.Errorf("expected key %s to be retained until %v, got %v", active.Kid, retainedUntil, db.retained[active.Kid])
+	}
+
+	// Only the replica holding the lock rotates
+	db.locks = map[string]string{"keyrotation": "other-replica"}
+	jwtKey(nextKid).ExpiresAt = time.Now().Add(time.Minute).Unix()
+	if err := store.rotate(); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if _, ok := db.keyRoles[keyRoleNext]; ok {
+		t.Error("expected no rotation while another replica holds the lock")
+	}
+}
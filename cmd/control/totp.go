@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// totpStep is the time step of RFC 6238 codes, as used by authenticator apps
+	totpStep = 30 * time.Second
+	// totpDigits is the length of a code
+	totpDigits = 6
+	// totpSkew is how many steps a code may be off, for clock differences and typing time
+	totpSkew = 1
+)
+
+// decodeTOTPSecret decodes a base32 secret as shown by authenticator apps,
+// ignoring case, spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("TOTP secret is not base32 encoded: %w", err)
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("TOTP secret must be at least 80 bits, got %d", len(key)*8)
+	}
+	return key, nil
+}
+
+// totpCode returns the HOTP code (RFC 4226) of the given counter
+func totpCode(key []byte, counter uint64) string {
+	h := hmac.New(sha1.New, key)
+	binary.Write(h, binary.BigEndian, counter)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// verifyTOTP checks a code against the steps around now
+func verifyTOTP(key []byte, code string, now time.Time) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	counter := now.Unix() / int64(totpStep/time.Second)
+	valid := false
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		expected := totpCode(key, uint64(counter+int64(skew)))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
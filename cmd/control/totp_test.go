@@ -0,0 +1,45 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors of RFC 6238, appendix B, truncated to 6 digits
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, code := range vectors {
+		if got := totpCode(key, uint64(unix/30)); got != code {
+			t.Errorf("expected code %s at %d, got %s", code, unix, got)
+		}
+		if !verifyTOTP(key, code, time.Unix(unix+30, 0)) {
+			t.Errorf("expected code %s to be accepted a step later", code)
+		}
+		if verifyTOTP(key, code, time.Unix(unix+90, 0)) {
+			t.Errorf("expected code %s to be rejected three steps later", code)
+		}
+	}
+	if verifyTOTP(key, "", time.Unix(59, 0)) || verifyTOTP(key, "2870820", time.Unix(59, 0)) {
+		t.Error("expected malformed codes to be rejected")
+	}
+
+	secret := base32.StdEncoding.EncodeToString(key)
+	decoded, err := decodeTOTPSecret("  " + secret[:8] + " " + secret[8:])
+	if err != nil || string(decoded) != string(key) {
+		t.Errorf("failed to decode secret: %q, %v", decoded, err)
+	}
+	if _, err := decodeTOTPSecret("MZXW6==="); err == nil {
+		t.Error("expected an error for a short secret")
+	}
+}
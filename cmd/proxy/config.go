@@ -6,12 +6,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+	"github.com/strseb/zdvv/pkg/common/privacypass"
 )
 
 // Config holds all application configuration settings
@@ -20,6 +25,9 @@ type ProxyConfig struct {
 	// Control server settings
 	ControlServerURL    string `env:"ZDVV_CONTROL_SERVER_URL"`
 	ControlServerSecret string `env:"ZDVV_CONTROL_SERVER_SHARED_SECRET"`
+	// Per-proxy credential, used instead of the shared secret
+	ControlServerEnrollmentToken string `env:"ZDVV_CONTROL_SERVER_ENROLLMENT_TOKEN"` // One-time token exchanged for this proxy's own API key
+	ControlServerCredentialFile  string `env:"ZDVV_CONTROL_SERVER_CREDENTIAL_FILE"`  // Keeps the API key across restarts
 	// Server information for registration
 	Latitude           float64 `env:"ZDVV_LATITUDE,default=0"`
 	Longitude          float64 `env:"ZDVV_LONGITUDE,default=0"`
@@ -29,6 +37,41 @@ type ProxyConfig struct {
 	SupportsConnectUDP bool    `env:"ZDVV_SUPPORTS_CONNECT_UDP,default=false"`
 	SupportsConnectIP  bool    `env:"ZDVV_SUPPORTS_CONNECT_IP,default=false"`
 	ProxyEndpointURL   string  `env:"ZDVV_PROXY_ENDPOINT_URL,default=https://proxy.example.com"`
+	FleetGroup         string  `env:"ZDVV_FLEET_GROUP"`
+	// Token audience settings
+	RequireAudience bool `env:"ZDVV_REQUIRE_AUDIENCE,default=false"` // Reject tokens that are not bound to this proxy or its group
+	JTIMaxUses      int  `env:"ZDVV_JTI_MAX_USES,default=0"`         // How often a token may be used, 0 means unlimited unless the token says otherwise
+	// Additional authentication strategies
+	APIKeysFile string `env:"ZDVV_API_KEYS_FILE"` // JSON file of hashed static API keys
+	// Offline key sources
+	JWKSFile      string `env:"ZDVV_JWKS_FILE"`       // Static JWKS file used instead of the control server
+	JWKSCacheFile string `env:"ZDVV_JWKS_CACHE_FILE"` // Last good key set, used while the control server is unreachable
+	// Federation settings
+	ControlServerIssuer string `env:"ZDVV_CONTROL_SERVER_ISSUER,default=zdvv-control-server"` // iss of tokens from our own control server
+	TrustedIssuersFile  string `env:"ZDVV_TRUSTED_ISSUERS_FILE"`                              // JSON file of additional trusted issuers
+	// Token validation mode
+	AuthMode                  string `env:"ZDVV_AUTH_MODE,default=jwt"`                  // "jwt" validates tokens locally, "introspection" asks the control server
+	IntrospectionURL          string `env:"ZDVV_INTROSPECTION_URL"`                      // Defaults to the control server's introspection endpoint
+	IntrospectionCacheSeconds int    `env:"ZDVV_INTROSPECTION_CACHE_SECONDS,default=30"` // How long introspection results are reused
+	// Privacy Pass redemption
+	PrivacyPass            bool   `env:"ZDVV_PRIVACY_PASS,default=false"`                         // Accept unlinkable Privacy Pass tokens
+	PrivacyPassIssuerURL   string `env:"ZDVV_PRIVACY_PASS_ISSUER_URL"`                            // Defaults to the control server
+	PrivacyPassPermissions string `env:"ZDVV_PRIVACY_PASS_PERMISSIONS,default=proxy:connect-tcp"` // Comma separated permissions a token grants
+}
+
+// Supported token validation modes
+const (
+	AuthModeJWT           = "jwt"
+	AuthModeIntrospection = "introspection"
+)
+
+// trustedIssuer is an entry of the trusted issuers file
+type trustedIssuer struct {
+	Issuer      string   `json:"issuer"`
+	JWKSURL     string   `json:"jwksUrl"`
+	JWKSFile    string   `json:"jwksFile"`
+	CacheFile   string   `json:"cacheFile"`
+	Permissions []string `json:"permissions"`
 }
 
 // NewConfig creates and returns a new Config struct with values from environment variables
@@ -52,7 +95,11 @@ func (c *ProxyConfig) LogSettings() {
 	}
 	if c.ControlServerURL != "" {
 		log.Printf("Control Server URL: %s", c.ControlServerURL)
-		log.Println("Control Server Shared Secret: [SET]")
+		if c.ControlServerCredentialFile != "" || c.ControlServerEnrollmentToken != "" {
+			log.Printf("Control Server Credential File: %s", c.ControlServerCredentialFile)
+		} else {
+			log.Println("Control Server Shared Secret: [SET]")
+		}
 	} else {
 		log.Println("Control Server integration: DISABLED")
 	}
@@ -61,15 +108,79 @@ func (c *ProxyConfig) LogSettings() {
 		c.City, c.Country, c.Latitude, c.Longitude)
 	log.Printf("Capabilities: TCP=%v, UDP=%v, IP=%v",
 		c.SupportsConnectTCP, c.SupportsConnectUDP, c.SupportsConnectIP)
+	if c.FleetGroup != "" {
+		log.Printf("Fleet Group: %s", c.FleetGroup)
+	}
+	log.Printf("Require Token Audience: %v", c.RequireAudience)
+	if c.JTIMaxUses > 0 {
+		log.Printf("Token Max Uses: %d", c.JTIMaxUses)
+	}
+	if c.APIKeysFile != "" {
+		log.Printf("Static API Keys File: %s", c.APIKeysFile)
+	}
+	if c.TrustedIssuersFile != "" {
+		log.Printf("Trusted Issuers File: %s (control server issuer: %s)", c.TrustedIssuersFile, c.ControlServerIssuer)
+	}
+	if c.AuthMode == AuthModeIntrospection {
+		log.Printf("Token Validation: introspection at %s (cache %ds)", c.introspectionURL(), c.IntrospectionCacheSeconds)
+	}
+	if c.PrivacyPass {
+		log.Printf("Privacy Pass: issuer %s, granting %s", c.privacyPassIssuerURL(), c.PrivacyPassPermissions)
+	}
+	if c.JWKSFile != "" {
+		log.Printf("Static JWKS File: %s", c.JWKSFile)
+	} else if c.JWKSCacheFile != "" {
+		log.Printf("JWKS Cache File: %s", c.JWKSCacheFile)
+	}
 
 }
 
+// LoadControlServerCredential replaces the shared secret with this proxy's own API key, read from the
+// credential file or obtained by redeeming the enrollment token with enroll and stored in the file.
+// Without either the shared secret is kept, a pairing approval hands out the API key then.
+func (c *ProxyConfig) LoadControlServerCredential(enroll func(enrollmentToken string) (string, error)) error {
+	if c.ControlServerCredentialFile != "" {
+		data, err := os.ReadFile(c.ControlServerCredentialFile)
+		if err == nil && strings.TrimSpace(string(data)) != "" {
+			c.ControlServerSecret = strings.TrimSpace(string(data))
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read credential file: %w", err)
+		}
+	}
+	if c.ControlServerEnrollmentToken == "" {
+		if c.ControlServerSecret != "" {
+			return nil
+		}
+		return fmt.Errorf("no credential in %s and no ZDVV_CONTROL_SERVER_ENROLLMENT_TOKEN to enroll with", c.ControlServerCredentialFile)
+	}
+
+	apiKey, err := enroll(c.ControlServerEnrollmentToken)
+	if err != nil {
+		return err
+	}
+	return c.StoreControlServerCredential(apiKey)
+}
+
+// StoreControlServerCredential uses apiKey instead of the shared secret and keeps it in the credential file
+func (c *ProxyConfig) StoreControlServerCredential(apiKey string) error {
+	if c.ControlServerCredentialFile == "" {
+		log.Println("Warning: ZDVV_CONTROL_SERVER_CREDENTIAL_FILE is not set, the proxy loses its credential on restart")
+	} else if err := os.WriteFile(c.ControlServerCredentialFile, []byte(apiKey+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to store credential: %w", err)
+	}
+	c.ControlServerSecret = apiKey
+	return nil
+}
+
 // CreateServer creates a common.Server object from the current configuration
 func (c *ProxyConfig) CreateServer(hostname string) common.Server {
 	// If ProxyURL isn't set, construct it using the hostname
 
 	return common.Server{
 		ProxyURL:           c.ProxyEndpointURL,
+		Group:              c.FleetGroup,
 		Latitude:           c.Latitude,
 		Longitude:          c.Longitude,
 		City:               c.City,
@@ -80,17 +191,161 @@ func (c *ProxyConfig) CreateServer(hostname string) common.Server {
 	}
 }
 
+// KeyProvider returns the source of token verification keys for this proxy
+func (c *ProxyConfig) KeyProvider(controlServer ControlServer) auth.KeyProvider {
+	if c.JWKSFile != "" {
+		return auth.NewFileKeyProvider(c.JWKSFile)
+	}
+	if c.JWKSCacheFile != "" {
+		return auth.NewCachingKeyProvider(controlServer, c.JWKSCacheFile)
+	}
+	return controlServer
+}
+
+// TrustedIssuers returns the issuers whose tokens this proxy accepts.
+// It returns nil if no trusted issuers file is configured, in which case tokens of any issuer
+// are validated with the keys of our own control server.
+func (c *ProxyConfig) TrustedIssuers(controlServer ControlServer) ([]auth.Issuer, error) {
+	if c.TrustedIssuersFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(c.TrustedIssuersFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted issuers file: %w", err)
+	}
+	var file struct {
+		Issuers []trustedIssuer `json:"issuers"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse trusted issuers file: %w", err)
+	}
+
+	var issuers []auth.Issuer
+	if c.ControlServerURL != "" || c.JWKSFile != "" {
+		issuers = append(issuers, auth.Issuer{
+			Name: c.ControlServerIssuer,
+			Keys: c.KeyProvider(controlServer),
+		})
+	}
+
+	for _, entry := range file.Issuers {
+		if entry.Issuer == "" {
+			return nil, fmt.Errorf("trusted issuer without issuer name")
+		}
+
+		var keys auth.KeyProvider
+		switch {
+		case entry.JWKSFile != "":
+			keys = auth.NewFileKeyProvider(entry.JWKSFile)
+		case entry.JWKSURL != "":
+			keys = auth.NewHTTPKeyProvider(entry.JWKSURL)
+		default:
+			return nil, fmt.Errorf("trusted issuer %s needs a jwksUrl or jwksFile", entry.Issuer)
+		}
+		if entry.CacheFile != "" {
+			keys = auth.NewCachingKeyProvider(keys, entry.CacheFile)
+		}
+
+		permissions := make([]auth.Permission, len(entry.Permissions))
+		for i, p := range entry.Permissions {
+			permissions[i] = auth.ParsePermission(p)
+		}
+
+		issuers = append(issuers, auth.Issuer{
+			Name:        entry.Issuer,
+			Keys:        keys,
+			Permissions: permissions,
+		})
+	}
+
+	return issuers, nil
+}
+
+// IntrospectionConfig returns the settings for validating tokens by introspection
+func (c *ProxyConfig) IntrospectionConfig(permissions auth.PermissionSelector) (auth.IntrospectionConfig, error) {
+	endpoint := c.introspectionURL()
+	if endpoint == "" {
+		return auth.IntrospectionConfig{}, fmt.Errorf("introspection requires ZDVV_INTROSPECTION_URL or ZDVV_CONTROL_SERVER_URL")
+	}
+	return auth.IntrospectionConfig{
+		URL:             endpoint,
+		ClientSecret:    c.ControlServerSecret,
+		Permissions:     permissions,
+		Audiences:       c.TokenAudiences(),
+		RequireAudience: c.RequireAudience,
+		CacheTTL:        time.Duration(c.IntrospectionCacheSeconds) * time.Second,
+		MaxTokenUses:    c.JTIMaxUses,
+	}, nil
+}
+
+// introspectionURL returns the configured introspection endpoint or the one of the control server
+func (c *ProxyConfig) introspectionURL() string {
+	if c.IntrospectionURL != "" {
+		return c.IntrospectionURL
+	}
+	if c.ControlServerURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.ControlServerURL, "/") + "/api/v1/introspect"
+}
+
+// PrivacyPassConfig returns the settings for redeeming Privacy Pass tokens
+func (c *ProxyConfig) PrivacyPassConfig(required auth.PermissionSelector) (auth.PrivacyPassConfig, error) {
+	issuerURL, err := url.Parse(c.privacyPassIssuerURL())
+	if err != nil || issuerURL.Host == "" {
+		return auth.PrivacyPassConfig{}, fmt.Errorf("privacy pass requires ZDVV_PRIVACY_PASS_ISSUER_URL or ZDVV_CONTROL_SERVER_URL")
+	}
+	origin, err := url.Parse(c.ProxyEndpointURL)
+	if err != nil || origin.Host == "" {
+		return auth.PrivacyPassConfig{}, fmt.Errorf("privacy pass requires a valid ZDVV_PROXY_ENDPOINT_URL")
+	}
+
+	var permissions []auth.Permission
+	for _, p := range strings.Split(c.PrivacyPassPermissions, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			permissions = append(permissions, auth.ParsePermission(p))
+		}
+	}
+
+	return auth.PrivacyPassConfig{
+		DirectoryURL: strings.TrimSuffix(issuerURL.String(), "/") + privacypass.DirectoryPath,
+		IssuerName:   issuerURL.Host,
+		OriginInfo:   origin.Host,
+		Permissions:  permissions,
+		Required:     required,
+	}, nil
+}
+
+// privacyPassIssuerURL returns the configured Privacy Pass issuer or the control server
+func (c *ProxyConfig) privacyPassIssuerURL() string {
+	if c.PrivacyPassIssuerURL != "" {
+		return c.PrivacyPassIssuerURL
+	}
+	return c.ControlServerURL
+}
+
+// TokenAudiences returns the aud values a token may carry to be accepted by this proxy
+func (c *ProxyConfig) TokenAudiences() []string {
+	audiences := []string{c.ProxyEndpointURL}
+	if c.FleetGroup != "" {
+		audiences = append(audiences, c.FleetGroup)
+	}
+	return audiences
+}
+
 // HTTPConfig holds HTTP server specific configuration settings
 type HTTPConfig struct {
-	HTTPAddr       string   `env:"ZDVV_HTTP_ADDR"`        // Address for the plain HTTP listener
-	HTTPSAddr      string   `env:"ZDVV_HTTPS_ADDR"`       // Address for the HTTPS listener
-	CertFile       string   `env:"ZDVV_HTTPS_CERT_FILE"`  // Path to the TLS certificate file
-	KeyFile        string   `env:"ZDVV_HTTPS_KEY_FILE"`   // Path to the TLS key file
-	Hostname       string   `env:"ZDVV_HTTPS_HOSTNAME"`   // Hostname for TLS certificate (Let's Encrypt)
-	HTTPEnabled    bool     `env:"ZDVV_HTTP_ENABLED"`     // Flag to enable the plain HTTP listener
-	HTTPSV1Enabled bool     `env:"ZDVV_HTTPS_V1_ENABLED"` // Enable HTTPS/1.1 support
-	HTTPSV2Enabled bool     `env:"ZDVV_HTTPS_V2_ENABLED"` // Enable HTTPS/2 support
-	HTTPSV3Enabled bool     `env:"ZDVV_HTTPS_V3_ENABLED"` // Enable HTTPS/3 support
+	HTTPAddr       string   `env:"ZDVV_HTTP_ADDR"`            // Address for the plain HTTP listener
+	HTTPSAddr      string   `env:"ZDVV_HTTPS_ADDR"`           // Address for the HTTPS listener
+	CertFile       string   `env:"ZDVV_HTTPS_CERT_FILE"`      // Path to the TLS certificate file
+	KeyFile        string   `env:"ZDVV_HTTPS_KEY_FILE"`       // Path to the TLS key file
+	ClientCAFile   string   `env:"ZDVV_HTTPS_CLIENT_CA_FILE"` // CA bundle for verifying client certificates (mTLS)
+	Hostname       string   `env:"ZDVV_HTTPS_HOSTNAME"`       // Hostname for TLS certificate (Let's Encrypt)
+	HTTPEnabled    bool     `env:"ZDVV_HTTP_ENABLED"`         // Flag to enable the plain HTTP listener
+	HTTPSV1Enabled bool     `env:"ZDVV_HTTPS_V1_ENABLED"`     // Enable HTTPS/1.1 support
+	HTTPSV2Enabled bool     `env:"ZDVV_HTTPS_V2_ENABLED"`     // Enable HTTPS/2 support
+	HTTPSV3Enabled bool     `env:"ZDVV_HTTPS_V3_ENABLED"`     // Enable HTTPS/3 support
 	AllowedOrigins []string // No tag, handled manually
 }
 
@@ -162,6 +417,9 @@ func (c *HTTPConfig) LogSettings() {
 	}
 	log.Printf("TLS Certificate File: %s", c.CertFile)
 	log.Printf("TLS Key File: %s", c.KeyFile)
+	if c.ClientCAFile != "" {
+		log.Printf("TLS Client CA File (mTLS): %s", c.ClientCAFile)
+	}
 	if c.Hostname != "" {
 		log.Printf("TLS Hostname (Let's Encrypt): %s", c.Hostname)
 	}
@@ -6,43 +6,68 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
 )
 
+// ErrServerUnknown is returned by heartbeats once the control server no longer lists this server
+var ErrServerUnknown = errors.New("server is not registered with the control server")
+
+// Registration is what the control server handed out for a registered server
+type Registration struct {
+	ID              string
+	RevocationToken string
+	// Lease is how long the registration lasts without a heartbeat, 0 if it does not expire
+	Lease time.Duration
+	// State is the lifecycle state as of the last registration or heartbeat
+	State common.ServerState
+}
+
 /**
  * The ControlServer may live in the same process as the server or in a different process.
  */
 type ControlServer interface {
 	Alive() bool
-	RegisterProxyServer(common.Server) error
-	DeregisterProxyServer(common.Server) error
+	// RegisterProxyServer registers a server, it gives up waiting for a pairing approval once ctx is done
+	RegisterProxyServer(ctx context.Context, server common.Server) (*Registration, error)
+	// Heartbeat renews a registration, updating its lease and state
+	Heartbeat(registration *Registration, activeConnections int) error
+	DeregisterProxyServer(*Registration) error
 	Servers() ([]common.Server, error)
 
 	// PublicKeys retrieves all available JWT public keys from the control server
-	// Returns a map of key IDs to RSA public keys
-	PublicKeys() (map[string]*rsa.PublicKey, error)
+	// Returns a map of key IDs to public keys and their signing algorithm
+	PublicKeys() (map[string]auth.PublicKey, error)
 }
 
 type HTTPControlServer struct {
-	ServerURL    string
+	ServerURL string
+	// SharedSecret authenticates the proxy, it is replaced by the API key a pairing approval hands out
 	SharedSecret string
-	client       *http.Client
+	// PairingPollInterval is how often a registration waiting for approval is checked
+	PairingPollInterval time.Duration
+	// StoreCredential, if set, keeps the API key handed out on pairing approval across restarts
+	StoreCredential func(apiKey string) error
+	client          *http.Client
+	jwks            *auth.HTTPKeyProvider
 }
 
 func NewHTTPControlServer(serverURL, sharedSecret string) *HTTPControlServer {
 	return &HTTPControlServer{
-		ServerURL:    serverURL,
-		SharedSecret: sharedSecret,
-		client:       &http.Client{Timeout: 10 * time.Second},
+		ServerURL:           serverURL,
+		SharedSecret:        sharedSecret,
+		PairingPollInterval: 5 * time.Second,
+		client:              &http.Client{Timeout: 10 * time.Second},
+		jwks:                auth.NewHTTPKeyProvider(fmt.Sprintf("%s/.well-known/jwks.json", serverURL)),
 	}
 }
 
@@ -57,6 +82,36 @@ func (h *HTTPControlServer) Alive() bool {
 	return resp.StatusCode == http.StatusOK
 }
 
+// Enroll exchanges a one-time enrollment token for this proxy's own API key
+func (h *HTTPControlServer) Enroll(enrollmentToken string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v1/enroll", h.ServerURL), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", enrollmentToken))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to enroll: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("enrollment failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var response struct {
+		ID     string `json:"id"`
+		APIKey string `json:"apiKey"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to parse enrollment response: %w", err)
+	}
+	log.Printf("Enrolled with the control server as %s", response.ID)
+	return response.APIKey, nil
+}
+
 // Servers retrieves the list of servers from the control server
 func (h *HTTPControlServer) Servers() ([]common.Server, error) {
 	resp, err := h.client.Get(fmt.Sprintf("%s/api/v1/servers", h.ServerURL))
@@ -81,114 +136,220 @@ func (h *HTTPControlServer) Servers() ([]common.Server, error) {
 }
 
 // PublicKeys retrieves the public keys from the control server's JWKS endpoint
-func (h *HTTPControlServer) PublicKeys() (map[string]*rsa.PublicKey, error) {
-	resp, err := h.client.Get(fmt.Sprintf("%s/.well-known/jwks.json", h.ServerURL))
+func (h *HTTPControlServer) PublicKeys() (map[string]auth.PublicKey, error) {
+	return h.jwks.PublicKeys()
+}
+
+// RegisterProxyServer registers the proxy server with the control server. If the control server
+// requires pairing, it logs the pairing code and waits until an admin approved it, ctx is done or
+// the pairing expired. The approval comes with the proxy's own API key, which is used from then on.
+func (h *HTTPControlServer) RegisterProxyServer(ctx context.Context, server common.Server) (*Registration, error) {
+	serverJSON, err := json.Marshal(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal server data: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/api/v1/server", h.ServerURL),
+		bytes.NewBuffer(serverJSON),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.SharedSecret))
+
+	resp, err := h.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve JWKS: %w", err)
+		return nil, fmt.Errorf("failed to register server: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code from JWKS endpoint: %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("server registration failed with status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
-	var jwks struct {
-		Keys []struct {
-			Kty       string `json:"kty"`
-			K         string `json:"k"`
-			Kid       string `json:"kid"`
-			ExpiresAt int64  `json:"expiresAt"`
-		} `json:"keys"`
+	var response struct {
+		registrationResponse
+		PairingCode  string `json:"pairingCode"`
+		PairingToken string `json:"pairingToken"`
+		ExpiresIn    int    `json:"expiresIn"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
-		return nil, fmt.Errorf("failed to parse JWKS response: %w", err)
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse registration response: %w", err)
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		log.Printf("Pairing code %s: waiting for an admin to approve this server", response.PairingCode)
+		registration, err := h.awaitPairing(ctx, response.PairingToken, time.Duration(response.ExpiresIn)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Pairing approved, server registered with the control server")
+		return registration, nil
 	}
 
-	publicKeys := make(map[string]*rsa.PublicKey)
+	return response.registration(), nil
+}
 
-	for _, key := range jwks.Keys {
-		if key.Kty != "RSA" {
-			continue
+// registrationResponse is the part of the registration and pairing responses describing the registration
+type registrationResponse struct {
+	ID              string             `json:"id"`
+	RevocationToken string             `json:"revocationToken"`
+	LeaseSeconds    int                `json:"leaseSeconds"`
+	State           common.ServerState `json:"state"`
+}
+
+func (r registrationResponse) registration() *Registration {
+	return &Registration{
+		ID:              r.ID,
+		RevocationToken: r.RevocationToken,
+		Lease:           time.Duration(r.LeaseSeconds) * time.Second,
+		State:           r.State,
+	}
+}
+
+// awaitPairing polls a pending registration until it was approved. It gives up once ctx is done or
+// the pairing expired after expiresIn, if given.
+func (h *HTTPControlServer) awaitPairing(ctx context.Context, pairingToken string, expiresIn time.Duration) (*Registration, error) {
+	parent := ctx
+	if expiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, expiresIn)
+		defer cancel()
+	}
+	wait := func() error {
+		select {
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				return parent.Err()
+			}
+			return fmt.Errorf("pairing was not approved within %v", expiresIn)
+		case <-time.After(h.PairingPollInterval):
+			return nil
 		}
+	}
 
-		// Decode the base64 key
-		keyBytes, err := base64.StdEncoding.DecodeString(key.K)
+	for {
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			fmt.Sprintf("%s/api/v1/server/pairing/%s", h.ServerURL, pairingToken),
+			nil,
+		)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode key %s: %w", key.Kid, err)
+			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.SharedSecret))
 
-		// Parse the key bytes into a public key
-		pubKey, err := x509.ParsePKIXPublicKey(keyBytes)
+		resp, err := h.client.Do(req)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse key %s: %w", key.Kid, err)
+			// The control server may restart while an admin takes their time
+			if ctx.Err() == nil {
+				log.Printf("Warning: Failed to check pairing status: %v", err)
+			}
+			if err := wait(); err != nil {
+				return nil, err
+			}
+			continue
 		}
-
-		rsaKey, ok := pubKey.(*rsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("key %s is not an RSA key", key.Kid)
+		switch resp.StatusCode {
+		case http.StatusAccepted:
+			resp.Body.Close()
+			if err := wait(); err != nil {
+				return nil, err
+			}
+		case http.StatusOK:
+			var response struct {
+				registrationResponse
+				ProxyID string `json:"proxyId"`
+				APIKey  string `json:"apiKey"`
+			}
+			err := json.NewDecoder(resp.Body).Decode(&response)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse pairing response: %w", err)
+			}
+			if response.APIKey != "" {
+				h.SharedSecret = response.APIKey
+				log.Printf("Paired with the control server as proxy %s", response.ProxyID)
+				if h.StoreCredential != nil {
+					if err := h.StoreCredential(response.APIKey); err != nil {
+						log.Printf("Warning: Failed to store the control server credential, the proxy has to pair again after a restart: %v", err)
+					}
+				}
+			}
+			return response.registration(), nil
+		default:
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("pairing failed with status %d: %s", resp.StatusCode, string(bodyBytes))
 		}
-
-		publicKeys[key.Kid] = rsaKey
 	}
-
-	return publicKeys, nil
 }
 
-// RegisterProxyServer registers the proxy server with the control server
-func (h *HTTPControlServer) RegisterProxyServer(server common.Server) error {
-	serverJSON, err := json.Marshal(server)
-	if err != nil {
-		return fmt.Errorf("failed to marshal server data: %w", err)
+// Heartbeat renews the lease of a registration, reporting the number of open tunnels, and updates its
+// lease and state. It returns ErrServerUnknown once the lease ran out or the server was removed.
+func (h *HTTPControlServer) Heartbeat(registration *Registration, activeConnections int) error {
+	if registration == nil || registration.RevocationToken == "" {
+		return fmt.Errorf("cannot send heartbeat without revocation token")
 	}
 
+	body, err := json.Marshal(map[string]int{"activeConnections": activeConnections})
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
 	req, err := http.NewRequest(
 		http.MethodPost,
-		fmt.Sprintf("%s/api/v1/server", h.ServerURL),
-		bytes.NewBuffer(serverJSON),
+		fmt.Sprintf("%s/api/v1/server/%s/heartbeat", h.ServerURL, registration.RevocationToken),
+		bytes.NewBuffer(body),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
-
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.SharedSecret))
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to register server: %w", err)
+		return fmt.Errorf("failed to send heartbeat: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrServerUnknown
+	default:
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server registration failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return fmt.Errorf("heartbeat failed with status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
 	var response struct {
-		RevocationToken string `json:"revocationToken"`
+		LeaseSeconds int                `json:"leaseSeconds"`
+		State        common.ServerState `json:"state"`
 	}
-
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("failed to parse registration response: %w", err)
+		return fmt.Errorf("failed to parse heartbeat response: %w", err)
 	}
-
-	// Let the caller handle storing the revocation token if needed
-	server.RevocationToken = response.RevocationToken
-
-	// Make a copy available for DeregisterProxyServer
+	registration.Lease = time.Duration(response.LeaseSeconds) * time.Second
+	registration.State = response.State
 	return nil
 }
 
 // DeregisterProxyServer removes the proxy server from the control server
-func (h *HTTPControlServer) DeregisterProxyServer(server common.Server) error {
-	if server.RevocationToken == "" {
+func (h *HTTPControlServer) DeregisterProxyServer(registration *Registration) error {
+	if registration == nil || registration.RevocationToken == "" {
 		return fmt.Errorf("cannot deregister server without revocation token")
 	}
 
 	req, err := http.NewRequest(
 		http.MethodDelete,
-		fmt.Sprintf("%s/api/v1/server/%s", h.ServerURL, server.RevocationToken),
+		fmt.Sprintf("%s/api/v1/server/%s", h.ServerURL, registration.RevocationToken),
 		nil,
 	)
 	if err != nil {
@@ -0,0 +1,222 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+)
+
+func TestRegisterProxyServerPairing(t *testing.T) {
+	polls := 0
+	approveAfter := 2
+	rejected := false
+	expiresIn := 3600
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" && r.Header.Get("Authorization") != "Bearer proxy-key" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/server":
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"pairingCode":  "ABCD-EFGH",
+				"pairingToken": "pairing-token",
+				"expiresIn":    expiresIn,
+			})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/server/pairing/pairing-token":
+			polls++
+			if rejected {
+				http.Error(w, "Unknown or expired pairing", http.StatusNotFound)
+				return
+			}
+			if polls <= approveAfter {
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(map[string]string{"status": "pending"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":          "approved",
+				"id":              "server-id",
+				"revocationToken": "revocation-token",
+				"proxyId":         "proxy-id",
+				"apiKey":          "proxy-key",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer control.Close()
+
+	credentialFile := filepath.Join(t.TempDir(), "credential")
+	cfg := &ProxyConfig{ControlServerSecret: "secret", ControlServerCredentialFile: credentialFile}
+	controlServer := NewHTTPControlServer(control.URL, "secret")
+	controlServer.PairingPollInterval = time.Millisecond
+	controlServer.StoreCredential = cfg.StoreControlServerCredential
+	server := common.Server{ProxyURL: "http://proxy.example.com", SupportsConnectTCP: true}
+	registration, err := controlServer.RegisterProxyServer(context.Background(), server)
+	if err != nil {
+		t.Fatalf("expected the pairing to be approved, got %v", err)
+	}
+	if registration.ID != "server-id" || registration.RevocationToken != "revocation-token" {
+		t.Errorf("expected the credentials of the approved pairing, got %+v", registration)
+	}
+	if polls != approveAfter+1 {
+		t.Errorf("expected %d polls until approval, got %d", approveAfter+1, polls)
+	}
+	// The approval hands out the proxy's own API key, it replaces the shared secret and survives restarts
+	if controlServer.SharedSecret != "proxy-key" {
+		t.Errorf("expected the API key of the approval to be used, got %q", controlServer.SharedSecret)
+	}
+	restarted := &ProxyConfig{ControlServerSecret: "secret", ControlServerCredentialFile: credentialFile}
+	if err := restarted.LoadControlServerCredential(nil); err != nil || restarted.ControlServerSecret != "proxy-key" {
+		t.Errorf("expected the stored API key after a restart, got %q, %v", restarted.ControlServerSecret, err)
+	}
+
+	// A rejected or expired pairing ends the registration
+	polls, rejected = 0, true
+	_, err = controlServer.RegisterProxyServer(context.Background(), server)
+	if err == nil || !strings.Contains(err.Error(), "pairing failed with status 404") {
+		t.Errorf("expected the registration to fail, got %v", err)
+	}
+
+	// Waiting ends when the proxy shuts down
+	polls, rejected, approveAfter = 0, false, math.MaxInt
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := controlServer.RegisterProxyServer(ctx, server); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the registration to end with the context, got %v", err)
+	}
+
+	// and once the pairing expired
+	expiresIn = 1
+	if _, err := controlServer.RegisterProxyServer(context.Background(), server); err == nil || !strings.Contains(err.Error(), "not approved within") {
+		t.Errorf("expected the registration to end once the pairing expired, got %v", err)
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	enrollments := 0
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/enroll" || r.Header.Get("Authorization") != "Bearer enrollment-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		enrollments++
+		json.NewEncoder(w).Encode(map[string]string{"id": "proxy-id", "apiKey": "api-key"})
+	}))
+	defer control.Close()
+	controlServer := NewHTTPControlServer(control.URL, "")
+
+	credentialFile := filepath.Join(t.TempDir(), "credential")
+	cfg := &ProxyConfig{
+		ControlServerEnrollmentToken: "enrollment-token",
+		ControlServerCredentialFile:  credentialFile,
+	}
+	if err := cfg.LoadControlServerCredential(controlServer.Enroll); err != nil {
+		t.Fatalf("failed to enroll: %v", err)
+	}
+	if cfg.ControlServerSecret != "api-key" {
+		t.Errorf("expected the API key as credential, got %q", cfg.ControlServerSecret)
+	}
+	if info, err := os.Stat(credentialFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the credential file with mode 0600, got %v", err)
+	}
+
+	// After a restart the stored credential is used, the enrollment token is spent
+	restarted := &ProxyConfig{
+		ControlServerEnrollmentToken: "enrollment-token",
+		ControlServerCredentialFile:  credentialFile,
+	}
+	if err := restarted.LoadControlServerCredential(controlServer.Enroll); err != nil || restarted.ControlServerSecret != "api-key" {
+		t.Errorf("expected the stored API key, got %q, %v", restarted.ControlServerSecret, err)
+	}
+	if enrollments != 1 {
+		t.Errorf("expected a single enrollment, got %d", enrollments)
+	}
+
+	// Without enrollment token the shared secret is used until a pairing approval hands out the API key
+	pairing := &ProxyConfig{ControlServerSecret: "secret", ControlServerCredentialFile: filepath.Join(t.TempDir(), "credential")}
+	if err := pairing.LoadControlServerCredential(controlServer.Enroll); err != nil || pairing.ControlServerSecret != "secret" {
+		t.Errorf("expected the shared secret to be kept, got %q, %v", pairing.ControlServerSecret, err)
+	}
+
+	invalid := &ProxyConfig{ControlServerEnrollmentToken: "wrong-token"}
+	if err := invalid.LoadControlServerCredential(controlServer.Enroll); err == nil {
+		t.Error("expected an error enrolling with an invalid token")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	var reported []int
+	registered := true
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/server":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":              "server-id",
+				"revocationToken": "revocation-token",
+				"leaseSeconds":    90,
+				"state":           "active",
+			})
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/server/revocation-token/heartbeat":
+			if !registered {
+				http.Error(w, "Unknown server", http.StatusNotFound)
+				return
+			}
+			var heartbeat struct {
+				ActiveConnections int `json:"activeConnections"`
+			}
+			json.NewDecoder(r.Body).Decode(&heartbeat)
+			reported = append(reported, heartbeat.ActiveConnections)
+			json.NewEncoder(w).Encode(map[string]interface{}{"leaseSeconds": 30, "state": "draining"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer control.Close()
+
+	controlServer := NewHTTPControlServer(control.URL, "secret")
+	if err := controlServer.Heartbeat(&Registration{}, 0); err == nil {
+		t.Error("expected heartbeats to fail without a revocation token")
+	}
+	registration, err := controlServer.RegisterProxyServer(context.Background(), common.Server{ProxyURL: "http://proxy.example.com"})
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if registration.RevocationToken != "revocation-token" || registration.Lease != 90*time.Second ||
+		registration.State != common.ServerStateActive {
+		t.Errorf("expected the revocation token, lease and state of the registration, got %+v", registration)
+	}
+
+	if err := controlServer.Heartbeat(registration, 3); err != nil {
+		t.Fatalf("expected the heartbeat to succeed, got %v", err)
+	}
+	if len(reported) != 1 || reported[0] != 3 {
+		t.Errorf("expected the active connections to be reported, got %v", reported)
+	}
+	if registration.Lease != 30*time.Second || registration.State != common.ServerStateDraining {
+		t.Errorf("expected the lease and state to follow the control server, got %+v", registration)
+	}
+
+	registered = false
+	if err := controlServer.Heartbeat(registration, 0); !errors.Is(err, ErrServerUnknown) {
+		t.Errorf("expected ErrServerUnknown once the lease ran out, got %v", err)
+	}
+}
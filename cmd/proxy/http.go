@@ -6,6 +6,8 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -38,6 +40,20 @@ func getTLSConfig(cfg *HTTPConfig) (*tls.Config, bool, error) {
 	if cfg.HTTPSV3Enabled {
 		tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h3")
 	}
+
+	// Client certificates are optional, they are one of several ways to authenticate
+	if cfg.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, false, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 	// Check if certificate files exist
 	_, certErr := os.Stat(cfg.CertFile)
 	_, keyErr := os.Stat(cfg.KeyFile)
@@ -66,7 +82,9 @@ func getTLSConfig(cfg *HTTPConfig) (*tls.Config, bool, error) {
 	}
 
 	tlsConfig.GetCertificate = certManager.GetCertificate
-	tlsConfig.ClientAuth = tls.NoClientCert                             // For HTTP-01 challenge
+	if tlsConfig.ClientCAs == nil {
+		tlsConfig.ClientAuth = tls.NoClientCert // For HTTP-01 challenge
+	}
 	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto) // For TLS-ALPN-01 challenge
 
 	log.Println("Configured automatic TLS certificates via Let's Encrypt for HTTP/S")
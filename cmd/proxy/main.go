@@ -39,33 +39,93 @@ func main() {
 	proxyCfg.LogSettings()
 	httpCfg.LogSettings()
 
-	var controlServer ControlServer = NewHTTPControlServer(
+	httpControlServer := NewHTTPControlServer(
 		proxyCfg.ControlServerURL,
 		proxyCfg.ControlServerSecret,
 	)
+	if proxyCfg.ControlServerCredentialFile != "" || proxyCfg.ControlServerEnrollmentToken != "" {
+		if err := proxyCfg.LoadControlServerCredential(httpControlServer.Enroll); err != nil {
+			log.Fatalf("Failed to load control server credential: %v", err)
+		}
+		httpControlServer.SharedSecret = proxyCfg.ControlServerSecret
+	}
+	httpControlServer.StoreCredential = proxyCfg.StoreControlServerCredential
+	var controlServer ControlServer = httpControlServer
 
-	var server common.Server = proxyCfg.CreateServer(httpCfg.Hostname)
+	// Each request requires the permission for the protocol it tunnels
+	requiredConnectPermissions := auth.PermissionSelector(auth.ProtocolPermissions)
+	var proxyAuthenticator auth.Authenticator
 
-	if err := controlServer.RegisterProxyServer(server); err != nil {
-		log.Printf("Warning: Failed to register with control server: %v", err)
-	}
-	defer func() {
-		if err := controlServer.DeregisterProxyServer(server); err != nil {
-			log.Printf("Warning: Failed to deregister from control server: %v", err)
+	var strategies []auth.Strategy
+	switch proxyCfg.AuthMode {
+	case AuthModeJWT:
+		// Fetch keys once at startup so the key cache is populated or loaded from disk early
+		keyProvider := proxyCfg.KeyProvider(controlServer)
+		if keys, err := keyProvider.PublicKeys(); err != nil {
+			log.Printf("Warning: No token verification keys available at startup: %v", err)
+		} else {
+			log.Printf("Loaded %d token verification keys at startup", len(keys))
 		}
-	}()
 
-	requiredConnectPermissions := []auth.Permission{auth.PERMISSION_CONNECT_TCP}
-	var proxyAuthenticator auth.Authenticator
+		validatorOptions := []auth.ValidatorOption{
+			auth.WithAudiences(proxyCfg.TokenAudiences(), proxyCfg.RequireAudience),
+			auth.WithReplayDetection(proxyCfg.JTIMaxUses),
+		}
+		issuers, err := proxyCfg.TrustedIssuers(controlServer)
+		if err != nil {
+			log.Fatalf("Failed to load trusted issuers: %v", err)
+		}
+		if issuers != nil {
+			// Only the configured issuers are trusted, each with its own keys
+			keyProvider = nil
+			validatorOptions = append(validatorOptions, auth.WithIssuers(issuers...))
+		}
 
-	log.Println("Operating in SECURE mode. JWTs will be validated using multiple keys.")
-	proxyAuthenticator = auth.NewMultiKeyJWTValidator(controlServer, requiredConnectPermissions)
+		log.Println("Operating in SECURE mode. JWTs will be validated using multiple keys.")
+		strategies = append(strategies, auth.NewMultiKeyJWTValidator(keyProvider, requiredConnectPermissions, validatorOptions...))
+	case AuthModeIntrospection:
+		introspectionCfg, err := proxyCfg.IntrospectionConfig(requiredConnectPermissions)
+		if err != nil {
+			log.Fatalf("Introspection configuration error: %v", err)
+		}
+		log.Println("Operating in SECURE mode. Tokens will be validated by the control server.")
+		strategies = append(strategies, auth.NewIntrospectionAuthenticator(introspectionCfg))
+	default:
+		log.Fatalf("Unknown auth mode %q, expected %q or %q", proxyCfg.AuthMode, AuthModeJWT, AuthModeIntrospection)
+	}
+	if proxyCfg.APIKeysFile != "" {
+		apiKeys, err := auth.LoadAPIKeys(proxyCfg.APIKeysFile, requiredConnectPermissions)
+		if err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+		strategies = append(strategies, apiKeys)
+	}
+	if proxyCfg.PrivacyPass {
+		privacyPassCfg, err := proxyCfg.PrivacyPassConfig(requiredConnectPermissions)
+		if err != nil {
+			log.Fatalf("Privacy Pass configuration error: %v", err)
+		}
+		strategies = append(strategies, auth.NewPrivacyPassAuthenticator(privacyPassCfg))
+	}
+	if httpCfg.ClientCAFile != "" {
+		strategies = append(strategies, auth.NewClientCertAuthenticator())
+	}
+	proxyAuthenticator = auth.NewChainAuthenticator(strategies...)
 
 	proxyService := NewProxyService(controlServer)
 	authenticatedProxyService := proxyAuthenticator.Middleware(proxyService)
 
+	// Registration may wait for an admin to approve the pairing, which must not hold up serving
+	registration := NewRegistrationSupervisor(controlServer, proxyCfg.CreateServer(httpCfg.Hostname), proxyService.ActiveConnections)
+	go registration.Run()
+	defer func() {
+		if err := registration.Stop(); err != nil {
+			log.Printf("Warning: Failed to deregister from control server: %v", err)
+		}
+	}()
+
 	log.Println("Starting ZDVV Proxy Service...")
-	CreateHTTPServers(httpCfg, authenticatedProxyService, proxyCfg.Insecure)
+	CreateHTTPServers(httpCfg, registration.Middleware(authenticatedProxyService), proxyCfg.Insecure)
 
 	log.Println("ZDVV Proxy Service has shut down.")
 }
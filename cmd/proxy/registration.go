@@ -0,0 +1,257 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+)
+
+// Registration states reported in the health output
+const (
+	RegistrationStateRegistering  = "registering"
+	RegistrationStateRegistered   = "registered"
+	RegistrationStateRetrying     = "retrying"
+	RegistrationStateDeregistered = "deregistered"
+)
+
+// unleasedHeartbeatInterval is how often a registration without a lease is checked, so the proxy
+// notices when the control server lost it
+const unleasedHeartbeatInterval = time.Minute
+
+// RegistrationStatus describes the registration with the control server
+type RegistrationStatus struct {
+	State    string `json:"state"`
+	ServerID string `json:"serverId,omitempty"`
+	// ServerState is the lifecycle state the control server has for the server
+	ServerState common.ServerState `json:"serverState,omitempty"`
+	// Failures counts the failed attempts since the last successful registration or heartbeat
+	Failures      int   `json:"failures,omitempty"`
+	RegisteredAt  int64 `json:"registeredAt,omitempty"`
+	LastHeartbeat int64 `json:"lastHeartbeat,omitempty"`
+}
+
+// RegistrationSupervisor keeps the server registered with the control server. Failed attempts are
+// retried with exponential backoff and jitter, and the server registers again whenever the control
+// server no longer knows it, e.g. after its lease ran out or the database was wiped.
+type RegistrationSupervisor struct {
+	controlServer     ControlServer
+	server            common.Server
+	activeConnections func() int
+	// MinBackoff and MaxBackoff bound the delay between failed attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// ctx is cancelled by Stop, ending a registration waiting for pairing approval too
+	ctx  context.Context
+	stop context.CancelFunc
+
+	// mutex guards the registration and status
+	mutex        sync.Mutex
+	registration *Registration
+	status       RegistrationStatus
+}
+
+// NewRegistrationSupervisor creates a supervisor for server, activeConnections reports the load with every heartbeat
+func NewRegistrationSupervisor(cs ControlServer, server common.Server, activeConnections func() int) *RegistrationSupervisor {
+	ctx, stop := context.WithCancel(context.Background())
+	return &RegistrationSupervisor{
+		controlServer:     cs,
+		server:            server,
+		activeConnections: activeConnections,
+		MinBackoff:        time.Second,
+		MaxBackoff:        5 * time.Minute,
+		ctx:               ctx,
+		stop:              stop,
+		status:            RegistrationStatus{State: RegistrationStateRegistering},
+	}
+}
+
+// Run registers the server and renews the registration until Stop is called
+func (s *RegistrationSupervisor) Run() {
+	failures := 0
+	for {
+		var wait time.Duration
+		registration := s.current()
+		if registration == nil {
+			var err error
+			registration, err = s.controlServer.RegisterProxyServer(s.ctx, s.server)
+			if err != nil && s.ctx.Err() != nil {
+				// Stopped while waiting for pairing approval
+				return
+			} else if err != nil {
+				failures++
+				wait = s.backoff(failures)
+				log.Printf("Warning: Failed to register with control server, retrying in %v: %v", wait.Round(time.Second), err)
+				s.update(func(status *RegistrationStatus) {
+					status.State = RegistrationStateRetrying
+					status.Failures = failures
+				})
+			} else if !s.registered(registration) {
+				return
+			} else {
+				failures = 0
+				wait = heartbeatInterval(registration.Lease)
+			}
+		} else {
+			renewed := *registration
+			err := s.controlServer.Heartbeat(&renewed, s.activeConnections())
+			switch {
+			case errors.Is(err, ErrServerUnknown):
+				log.Println("Warning: The control server no longer knows this server, registering again")
+				failures = 0
+				s.forget()
+			case err != nil:
+				// Keep the registration, it is still valid if the control server comes back within the lease
+				failures++
+				wait = min(s.backoff(failures), heartbeatInterval(registration.Lease))
+				log.Printf("Warning: Failed to send heartbeat: %v", err)
+				s.update(func(status *RegistrationStatus) { status.Failures = failures })
+			default:
+				failures = 0
+				wait = heartbeatInterval(renewed.Lease)
+				if renewed.State != registration.State {
+					log.Printf("The control server moved this server to state %s", renewed.State)
+				}
+				s.update(func(status *RegistrationStatus) {
+					s.registration = &renewed
+					status.Failures = 0
+					status.LastHeartbeat = time.Now().Unix()
+					status.ServerState = renewed.State
+				})
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Stop ends the supervision and deregisters the server
+func (s *RegistrationSupervisor) Stop() error {
+	s.mutex.Lock()
+	s.stop()
+	registration := s.registration
+	s.registration = nil
+	s.status = RegistrationStatus{State: RegistrationStateDeregistered}
+	s.mutex.Unlock()
+	if registration == nil {
+		return nil
+	}
+	return s.controlServer.DeregisterProxyServer(registration)
+}
+
+// Status returns the current registration state
+func (s *RegistrationSupervisor) Status() RegistrationStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+// Middleware answers GET /health with the registration status and refuses tunnels while the control
+// server has the server disabled. Other requests are passed on to next.
+func (s *RegistrationSupervisor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/health" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":       "ok",
+				"registration": s.Status(),
+			})
+			return
+		}
+		// Draining servers still serve the clients holding tokens for them
+		if r.Method == http.MethodConnect && s.Status().ServerState == common.ServerStateDisabled {
+			http.Error(w, "Server is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *RegistrationSupervisor) current() *Registration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.registration
+}
+
+// registered stores a new registration. It returns false if the supervisor was stopped meanwhile,
+// the registration is removed again then.
+func (s *RegistrationSupervisor) registered(registration *Registration) bool {
+	s.mutex.Lock()
+	if s.stoppedLocked() {
+		s.mutex.Unlock()
+		if err := s.controlServer.DeregisterProxyServer(registration); err != nil {
+			log.Printf("Warning: Failed to deregister from control server: %v", err)
+		}
+		return false
+	}
+	now := time.Now().Unix()
+	s.registration = registration
+	s.status = RegistrationStatus{
+		State:         RegistrationStateRegistered,
+		ServerID:      registration.ID,
+		ServerState:   registration.State,
+		RegisteredAt:  now,
+		LastHeartbeat: now,
+	}
+	s.mutex.Unlock()
+
+	log.Printf("Registered with the control server as %s", registration.ID)
+	return true
+}
+
+func (s *RegistrationSupervisor) forget() {
+	s.update(func(status *RegistrationStatus) {
+		s.registration = nil
+		*status = RegistrationStatus{State: RegistrationStateRegistering}
+	})
+}
+
+// update changes the status unless the supervisor was stopped
+func (s *RegistrationSupervisor) update(change func(status *RegistrationStatus)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.stoppedLocked() {
+		change(&s.status)
+	}
+}
+
+func (s *RegistrationSupervisor) stoppedLocked() bool {
+	return s.ctx.Err() != nil
+}
+
+// backoff returns the delay after the given number of consecutive failures: it doubles with
+// every failure up to MaxBackoff, and a random half of it is jitter so proxies spread out
+func (s *RegistrationSupervisor) backoff(failures int) time.Duration {
+	delay := s.MinBackoff
+	for i := 1; i < failures && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, s.MaxBackoff)
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// heartbeatInterval renews a lease three times before it runs out
+func heartbeatInterval(lease time.Duration) time.Duration {
+	if lease <= 0 {
+		return unleasedHeartbeatInterval
+	}
+	return lease / 3
+}
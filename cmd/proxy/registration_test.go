@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// fakeControlServer fails the first registrations and can forget the registered server
+type fakeControlServer struct {
+	mutex         sync.Mutex
+	failures      int
+	registrations int
+	heartbeats    int
+	forgotten     bool
+	state         common.ServerState
+	deregistered  []*Registration
+}
+
+func (f *fakeControlServer) Alive() bool { return true }
+
+func (f *fakeControlServer) RegisterProxyServer(ctx context.Context, server common.Server) (*Registration, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("control server unavailable")
+	}
+	f.registrations++
+	f.forgotten = false
+	return &Registration{
+		ID:              fmt.Sprintf("server-%d", f.registrations),
+		RevocationToken: fmt.Sprintf("token-%d", f.registrations),
+		Lease:           30 * time.Millisecond,
+		State:           common.ServerStateActive,
+	}, nil
+}
+
+func (f *fakeControlServer) Heartbeat(registration *Registration, activeConnections int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.forgotten {
+		return ErrServerUnknown
+	}
+	f.heartbeats++
+	if f.state != "" {
+		registration.State = f.state
+	}
+	return nil
+}
+
+func (f *fakeControlServer) DeregisterProxyServer(registration *Registration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deregistered = append(f.deregistered, registration)
+	return nil
+}
+
+func (f *fakeControlServer) Servers() ([]common.Server, error) { return nil, nil }
+
+func (f *fakeControlServer) PublicKeys() (map[string]auth.PublicKey, error) { return nil, nil }
+
+// waitFor polls condition until it holds or a second passed
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRegistrationSupervisor(t *testing.T) {
+	control := &fakeControlServer{failures: 2}
+	supervisor := NewRegistrationSupervisor(control, common.Server{ProxyURL: "http://proxy.example.com"}, func() int { return 0 })
+	supervisor.MinBackoff = time.Millisecond
+	supervisor.MaxBackoff = 4 * time.Millisecond
+	go supervisor.Run()
+
+	// Failed registrations are retried
+	waitFor(t, "the registration", func() bool { return supervisor.Status().State == RegistrationStateRegistered })
+	waitFor(t, "heartbeats", func() bool {
+		control.mutex.Lock()
+		defer control.mutex.Unlock()
+		return control.heartbeats >= 2
+	})
+	if status := supervisor.Status(); status.ServerID != "server-1" || status.Failures != 0 {
+		t.Errorf("expected the first registration without failures, got %+v", status)
+	}
+
+	// The server registers again once the control server no longer knows it
+	control.mutex.Lock()
+	control.forgotten = true
+	control.mutex.Unlock()
+	waitFor(t, "the registration to be renewed", func() bool { return supervisor.Status().ServerID == "server-2" })
+
+	handler := supervisor.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health struct {
+		Status       string             `json:"status"`
+		Registration RegistrationStatus `json:"registration"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil || health.Registration.State != RegistrationStateRegistered {
+		t.Errorf("expected the registration state in the health output, got %+v %v", health, err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected other requests to be passed on, got %d", w.Code)
+	}
+
+	// Draining servers keep serving tunnels, disabled ones refuse them
+	for _, state := range []common.ServerState{common.ServerStateDraining, common.ServerStateDisabled} {
+		control.mutex.Lock()
+		control.state = state
+		control.mutex.Unlock()
+		waitFor(t, "the state "+string(state), func() bool { return supervisor.Status().ServerState == state })
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected tunnels to be refused while disabled, got %d", w.Code)
+	}
+
+	// Stopping deregisters with the credentials of the current registration
+	if err := supervisor.Stop(); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	if len(control.deregistered) != 1 || control.deregistered[0].RevocationToken != "token-2" {
+		t.Errorf("expected the current registration to be removed, got %+v", control.deregistered)
+	}
+	if state := supervisor.Status().State; state != RegistrationStateDeregistered {
+		t.Errorf("expected state %s, got %s", RegistrationStateDeregistered, state)
+	}
+}
+
+func TestRegistrationBackoff(t *testing.T) {
+	supervisor := NewRegistrationSupervisor(&fakeControlServer{}, common.Server{}, func() int { return 0 })
+	supervisor.MinBackoff = time.Second
+	supervisor.MaxBackoff = 8 * time.Second
+	for failures, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		delay := supervisor.backoff(failures + 1)
+		if delay < limit/2 || delay > limit {
+			t.Errorf("expected a delay between %v and %v after %d failures, got %v", limit/2, limit, failures+1, delay)
+		}
+	}
+}
@@ -7,11 +7,14 @@ package main
 import (
 	"log"
 	"net/http"
+	"sync/atomic"
 )
 
 // Proxy handles HTTP requests for the proxy service.
 type Proxy struct {
 	controlServer ControlServer
+	// activeConnections counts the tunnels currently open
+	activeConnections atomic.Int64
 	// Potentially add other dependencies here, like a logger or config
 }
 
@@ -32,9 +35,16 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// For example, to authorize the request based on control server data,
 		// or to register/deregister connections.
 		log.Printf("[ProxyService] Handling CONNECT request for %s", r.URL.Host)
+		p.activeConnections.Add(1)
+		defer p.activeConnections.Add(-1)
 		HandleConnectRequest(w, r) // Use the new function
 	} else {
 		// Handle other requests or return an error
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// ActiveConnections returns the number of tunnels currently open
+func (p *Proxy) ActiveConnections() int {
+	return int(p.activeConnections.Load())
+}
@@ -7,6 +7,7 @@ module github.com/strseb/zdvv
 go 1.24
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/quic-go/quic-go v0.52.0
 	golang.org/x/crypto v0.38.0
@@ -15,6 +16,9 @@ require (
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/miekg/pkcs11 v1.1.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
 )
 
 require (
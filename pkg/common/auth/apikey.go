@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const apiKeyScheme = "ApiKey"
+
+// APIKey is a static credential, only the SHA-256 hash of the key is stored
+type APIKey struct {
+	// Name identifies the key holder, e.g. "uptime-probe"
+	Name string `json:"name"`
+	// Hex encoded SHA-256 hash of the key
+	Hash        string   `json:"hash"`
+	Permissions []string `json:"permissions"`
+
+	hash []byte
+}
+
+// APIKeyAuthenticator authenticates requests presenting a static key
+// with "Proxy-Authorization: ApiKey <key>"
+type APIKeyAuthenticator struct {
+	keys        []APIKey
+	permissions PermissionSelector
+}
+
+// NewAPIKeyAuthenticator creates an authenticator for the given keys,
+// requiring each key to carry all permissions a request needs
+func NewAPIKeyAuthenticator(keys []APIKey, permissions PermissionSelector) (*APIKeyAuthenticator, error) {
+	for i := range keys {
+		hash, err := hex.DecodeString(keys[i].Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api key %q: hash must be a hex encoded SHA-256 digest", keys[i].Name)
+		}
+		keys[i].hash = hash
+	}
+	log.Printf("Initializing APIKeyAuthenticator with %d keys", len(keys))
+	if permissions == nil {
+		permissions = StaticPermissions()
+	}
+
+	return &APIKeyAuthenticator{keys: keys, permissions: permissions}, nil
+}
+
+// LoadAPIKeys reads a JSON file of the form {"keys": [{"name": ..., "hash": ..., "permissions": [...]}]}
+func LoadAPIKeys(path string, permissions PermissionSelector) (*APIKeyAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys file: %w", err)
+	}
+	var file struct {
+		Keys []APIKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys file: %w", err)
+	}
+	return NewAPIKeyAuthenticator(file.Keys, permissions)
+}
+
+// Name identifies the authenticator within an authenticator chain
+func (a *APIKeyAuthenticator) Name() string {
+	return "apikey"
+}
+
+// Middleware implements HTTP middleware for API key validation
+func (a *APIKeyAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := a.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authenticate checks the presented key against the known key hashes
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (context.Context, error) {
+	header := r.Header.Get(authHeader)
+	if header == "" {
+		return nil, ErrNoAuthHeader
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || parts[0] != apiKeyScheme {
+		return nil, ErrInvalidScheme
+	}
+
+	presented := sha256.Sum256([]byte(parts[1]))
+	var match *APIKey
+	// Compare against every key so the timing does not reveal which one matched
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare(presented[:], a.keys[i].hash) == 1 {
+			match = &a.keys[i]
+		}
+	}
+	if match == nil {
+		log.Printf("APIKey-Auth: unknown key presented for %s %s", r.Method, r.URL.Path)
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidToken)
+	}
+
+	granted := make([]Permission, len(match.Permissions))
+	for i, perm := range match.Permissions {
+		granted[i] = ParsePermission(perm)
+	}
+	for _, perm := range a.permissions(r) {
+		if !grantsAny(granted, perm) {
+			log.Printf("APIKey-Auth: key %s is missing permission %s", match.Name, perm)
+			return nil, fmt.Errorf("missing required permission: %s", perm)
+		}
+	}
+
+	log.Printf("APIKey-Auth: request authenticated as %s", match.Name)
+	return withClaims(r.Context(), &Claims{Subject: match.Name, Permissions: granted}), nil
+}
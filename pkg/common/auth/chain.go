@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+type authMethodKey struct{}
+
+// Strategy authenticates a single request without writing a response,
+// so several strategies can be combined in a ChainAuthenticator.
+type Strategy interface {
+	// Name identifies the strategy, e.g. "jwt", "apikey" or "mtls"
+	Name() string
+	// Authenticate checks the credentials of the request and returns the context to continue with.
+	// ErrNoAuthHeader, ErrInvalidScheme and ErrNoCredentials signal that the request carries
+	// no credentials this strategy understands.
+	Authenticate(r *http.Request) (context.Context, error)
+}
+
+// Challenger is implemented by strategies that tell rejected clients how to authenticate
+type Challenger interface {
+	// Challenge returns a Proxy-Authenticate header value, "" if there is nothing to offer
+	Challenge() string
+}
+
+// ChainAuthenticator tries several authentication strategies in order.
+// The first strategy that succeeds wins and is recorded in the request context.
+type ChainAuthenticator struct {
+	strategies []Strategy
+}
+
+// NewChainAuthenticator creates an authenticator trying the given strategies in order
+func NewChainAuthenticator(strategies ...Strategy) *ChainAuthenticator {
+	names := make([]string, len(strategies))
+	for i, s := range strategies {
+		names[i] = s.Name()
+	}
+	log.Printf("Initializing ChainAuthenticator with strategies: %v", names)
+
+	return &ChainAuthenticator{strategies: strategies}
+}
+
+// Middleware implements HTTP middleware trying all strategies
+func (c *ChainAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := c.Authenticate(r)
+		if err != nil {
+			for _, s := range c.strategies {
+				if challenger, ok := s.(Challenger); ok {
+					if challenge := challenger.Challenge(); challenge != "" {
+						w.Header().Add(challengeHeader, challenge)
+					}
+				}
+			}
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authenticate returns the context of the first successful strategy.
+// If all strategies fail, the error of the first strategy that found credentials is returned.
+func (c *ChainAuthenticator) Authenticate(r *http.Request) (context.Context, error) {
+	var firstErr error
+	for _, s := range c.strategies {
+		ctx, err := s.Authenticate(r)
+		if err == nil {
+			log.Printf("Auth-Chain: request authenticated by %s", s.Name())
+			return context.WithValue(ctx, authMethodKey{}, s.Name()), nil
+		}
+		if firstErr == nil && !isMissingCredentials(err) {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = ErrNoAuthHeader
+	}
+	return nil, firstErr
+}
+
+// AuthMethodFromContext returns the name of the strategy that authenticated the request
+func AuthMethodFromContext(ctx context.Context) (string, bool) {
+	method, ok := ctx.Value(authMethodKey{}).(string)
+	return method, ok
+}
+
+func isMissingCredentials(err error) bool {
+	return errors.Is(err, ErrNoAuthHeader) || errors.Is(err, ErrInvalidScheme) || errors.Is(err, ErrNoCredentials)
+}
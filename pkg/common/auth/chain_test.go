@@ -0,0 +1,120 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testAPIKeyAuthenticator(t *testing.T) *APIKeyAuthenticator {
+	hash := sha256.Sum256([]byte("probe-secret"))
+	limited := sha256.Sum256([]byte("limited-secret"))
+	a, err := NewAPIKeyAuthenticator([]APIKey{
+		{Name: "probe", Hash: hex.EncodeToString(hash[:]), Permissions: []string{"connect-tcp"}},
+		{Name: "limited", Hash: hex.EncodeToString(limited[:]), Permissions: []string{"connect-udp"}},
+	}, StaticPermissions(PERMISSION_CONNECT_TCP))
+	if err != nil {
+		t.Fatalf("Failed to create api key authenticator: %v", err)
+	}
+	return a
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	a := testAPIKeyAuthenticator(t)
+
+	tests := []struct {
+		name          string
+		header        string
+		expectSuccess bool
+	}{
+		{"Valid key", "ApiKey probe-secret", true},
+		{"Unknown key", "ApiKey wrong", false},
+		{"Key without permission", "ApiKey limited-secret", false},
+		{"Bearer scheme", "Bearer probe-secret", false},
+		{"No header", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+			if tc.header != "" {
+				req.Header.Set(authHeader, tc.header)
+			}
+			_, err := a.Authenticate(req)
+			if tc.expectSuccess && err != nil {
+				t.Errorf("Expected success, got %v", err)
+			} else if !tc.expectSuccess && err == nil {
+				t.Errorf("Expected failure but got success")
+			}
+		})
+	}
+
+	t.Run("Invalid hash", func(t *testing.T) {
+		_, err := NewAPIKeyAuthenticator([]APIKey{{Name: "bad", Hash: "abc"}}, nil)
+		if err == nil {
+			t.Fatal("Expected error for invalid hash")
+		}
+	})
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	jwtValidator := NewMultiKeyJWTValidator(&mockKeyProvider{}, StaticPermissions(PERMISSION_CONNECT_TCP))
+	chain := NewChainAuthenticator(jwtValidator, testAPIKeyAuthenticator(t), NewClientCertAuthenticator())
+
+	verifiedTLS := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "batch-job"}}}},
+	}
+
+	tests := []struct {
+		name           string
+		header         string
+		tls            *tls.ConnectionState
+		expectedMethod string
+	}{
+		{"API key", "ApiKey probe-secret", nil, "apikey"},
+		{"Client certificate", "", verifiedTLS, "mtls"},
+		{"Invalid JWT falls through to client certificate", "Bearer invalid", verifiedTLS, "mtls"},
+		{"Invalid JWT", "Bearer invalid", nil, ""},
+		{"No credentials", "", &tls.ConnectionState{}, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+			if tc.header != "" {
+				req.Header.Set(authHeader, tc.header)
+			}
+			req.TLS = tc.tls
+
+			var method string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, _ = AuthMethodFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+			recorder := httptest.NewRecorder()
+			chain.Middleware(handler).ServeHTTP(recorder, req)
+
+			if tc.expectedMethod == "" {
+				if recorder.Code != http.StatusUnauthorized {
+					t.Errorf("Expected status 401, got %d", recorder.Code)
+				}
+				return
+			}
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			if method != tc.expectedMethod {
+				t.Errorf("Expected method %q, got %q", tc.expectedMethod, method)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Constraints restrict how a token may be used
+type Constraints struct {
+	// MaxUses limits how often the token may be used, 0 means no limit
+	MaxUses int
+	// BandwidthLimit caps the tunnel throughput in bytes per second, 0 means no limit
+	BandwidthLimit int64
+}
+
+// Claims describe an authenticated request, whichever strategy authenticated it
+type Claims struct {
+	Subject  string
+	Issuer   string
+	Audience []string
+	// ExpiresAt is zero for credentials that do not expire
+	ExpiresAt   time.Time
+	TokenID     string
+	Permissions []Permission
+	Constraints Constraints
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims stored by the authenticator that accepted the request
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// withClaims stores the claims of an authenticated request in its context
+func withClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// HasPermission reports whether the claims grant a permission, directly or by a wildcard
+func (c *Claims) HasPermission(p Permission) bool {
+	return grantsAny(c.Permissions, p)
+}
+
+// claimsFromJWT converts verified JWT claims, granting only permissions below the allowed ones (nil means any)
+func claimsFromJWT(claims jwt.MapClaims, allowed []Permission) *Claims {
+	result := &Claims{
+		TokenID:     TokenID(claims),
+		Permissions: restrictPermissions(permissionsFromClaims(claims), allowed),
+		Constraints: Constraints{MaxUses: MaxUses(claims), BandwidthLimit: BandwidthLimit(claims)},
+	}
+	result.Subject, _ = claims.GetSubject()
+	result.Issuer, _ = claims.GetIssuer()
+	result.Audience, _ = claims.GetAudience()
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		result.ExpiresAt = exp.Time
+	}
+	return result
+}
+
+// BandwidthLimit returns the throughput limit in bytes per second carried in the token's constraints, 0 if there is none
+func BandwidthLimit(claims jwt.MapClaims) int64 {
+	constraints, ok := claims["constraints"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	limit, ok := constraints["bandwidth"].(float64)
+	if !ok || limit < 1 {
+		return 0
+	}
+	return int64(limit)
+}
@@ -0,0 +1,53 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// ClientCertAuthenticator authenticates requests that presented a TLS client certificate.
+// The certificate chain is verified by the TLS stack against the configured client CAs,
+// so any verified chain is accepted here and granted all proxy permissions.
+type ClientCertAuthenticator struct{}
+
+// NewClientCertAuthenticator creates a new mTLS authenticator
+func NewClientCertAuthenticator() *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{}
+}
+
+// Name identifies the authenticator within an authenticator chain
+func (a *ClientCertAuthenticator) Name() string {
+	return "mtls"
+}
+
+// Middleware implements HTTP middleware for client certificate validation
+func (a *ClientCertAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := a.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authenticate accepts requests whose connection carries a verified client certificate chain
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (context.Context, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	log.Printf("mTLS-Auth: request authenticated as %s", leaf.Subject.CommonName)
+	return withClaims(r.Context(), &Claims{
+		Subject:     leaf.Subject.CommonName,
+		Issuer:      leaf.Issuer.CommonName,
+		ExpiresAt:   leaf.NotAfter,
+		Permissions: []Permission{PERMISSION_PROXY_ALL},
+	}), nil
+}
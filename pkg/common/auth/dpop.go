@@ -0,0 +1,140 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoP (RFC 9449) settings
+const (
+	dpopHeader       = "DPoP"
+	dpopScheme       = "DPoP"
+	dpopProofType    = "dpop+jwt"
+	dpopProofMaxAge  = 60 * time.Second
+	dpopClockSkew    = 5 * time.Second
+	dpopReplayMaxIDs = 100000
+)
+
+var ErrInvalidDPoPProof = errors.New("invalid DPoP proof")
+
+// ConfirmationThumbprint returns the JWK thumbprint a token is bound to (cnf.jkt), if any
+func ConfirmationThumbprint(claims jwt.MapClaims) string {
+	cnf, ok := claims["cnf"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+// verifyDPoPProof checks the DPoP header of a request proves possession of the key
+// with thumbprint jkt, for this request and this access token. Seen proofs are recorded in replay.
+func verifyDPoPProof(r *http.Request, accessToken, jkt string, replay *ReplayCache) error {
+	proofs := r.Header.Values(dpopHeader)
+	if len(proofs) != 1 {
+		return fmt.Errorf("%w: exactly one DPoP header is required", ErrInvalidDPoPProof)
+	}
+
+	var proofKey JWK
+	proof, err := jwt.Parse(proofs[0], func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != dpopProofType {
+			return nil, fmt.Errorf("unexpected typ %q", t.Header["typ"])
+		}
+		raw, ok := t.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("missing jwk header")
+		}
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &proofKey); err != nil {
+			return nil, err
+		}
+		key, err := proofKey.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKeyAlgorithm(t.Method.Alg(), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{AlgorithmES256, AlgorithmEdDSA, AlgorithmRS256}))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDPoPProof, err)
+	}
+
+	thumbprint, err := proofKey.Thumbprint()
+	if err != nil || thumbprint != jkt {
+		return fmt.Errorf("%w: proof key does not match token binding", ErrInvalidDPoPProof)
+	}
+
+	claims, ok := proof.Claims.(jwt.MapClaims)
+	if !ok {
+		return fmt.Errorf("%w: invalid claims", ErrInvalidDPoPProof)
+	}
+
+	if htm, _ := claims["htm"].(string); htm != r.Method {
+		return fmt.Errorf("%w: htm does not match request method", ErrInvalidDPoPProof)
+	}
+	if htu, _ := claims["htu"].(string); !dpopTargetMatches(htu, r) {
+		return fmt.Errorf("%w: htu does not match request target", ErrInvalidDPoPProof)
+	}
+
+	tokenHash := sha256.Sum256([]byte(accessToken))
+	if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(tokenHash[:]) {
+		return fmt.Errorf("%w: ath does not match access token", ErrInvalidDPoPProof)
+	}
+
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		return fmt.Errorf("%w: missing iat", ErrInvalidDPoPProof)
+	}
+	now := time.Now()
+	if iat.After(now.Add(dpopClockSkew)) || iat.Before(now.Add(-dpopProofMaxAge)) {
+		return fmt.Errorf("%w: proof is too old or from the future", ErrInvalidDPoPProof)
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return fmt.Errorf("%w: missing jti", ErrInvalidDPoPProof)
+	}
+	uses, err := replay.Use(jkt+":"+jti, iat.Add(dpopProofMaxAge+dpopClockSkew))
+	if err != nil {
+		return err
+	}
+	if uses > 1 {
+		return fmt.Errorf("%w: proof has already been used", ErrInvalidDPoPProof)
+	}
+
+	return nil
+}
+
+// dpopTargetMatches compares the htu claim with the request.
+// For CONNECT the target is an authority, so only the host and port are compared.
+func dpopTargetMatches(htu string, r *http.Request) bool {
+	u, err := url.Parse(htu)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if r.Method == http.MethodConnect {
+		target := r.Host
+		if target == "" {
+			target = r.URL.Host
+		}
+		return u.Host == target
+	}
+	return u.Host == r.Host && u.Path == r.URL.Path
+}
@@ -0,0 +1,237 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	// Example from RFC 7638, section 3.1
+	jwk := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Alg: "RS256",
+		Kid: "2011-04-29",
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatalf("Failed to compute thumbprint: %v", err)
+	}
+	if thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("Unexpected thumbprint %s", thumbprint)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	cache := NewReplayCache(2)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	use := func(id string, expiresAt time.Time) int {
+		uses, err := cache.Use(id, expiresAt)
+		if err != nil {
+			t.Fatalf("Expected %s to be recorded, got %v", id, err)
+		}
+		return uses
+	}
+	if uses := use("a", now.Add(time.Minute)); uses != 1 {
+		t.Errorf("Expected first use, got %d", uses)
+	}
+	if uses := use("a", now.Add(time.Minute)); uses != 2 {
+		t.Errorf("Expected second use, got %d", uses)
+	}
+
+	// A full cache refuses new IDs instead of forgetting unexpired ones
+	use("b", now.Add(2*time.Minute))
+	if _, err := cache.Use("c", now.Add(3*time.Minute)); !errors.Is(err, ErrReplayCacheFull) {
+		t.Errorf("Expected ErrReplayCacheFull, got %v", err)
+	}
+	if uses := use("a", now.Add(time.Minute)); uses != 3 {
+		t.Errorf("Expected a to be remembered, got %d uses", uses)
+	}
+
+	// Expired entries make room and are forgotten
+	now = now.Add(90 * time.Second)
+	if uses := use("c", now.Add(time.Minute)); uses != 1 {
+		t.Errorf("Expected c to take the place of the expired entry, got %d uses", uses)
+	}
+	if uses := use("b", now.Add(time.Minute)); uses != 2 {
+		t.Errorf("Expected unexpired b to be remembered, got %d uses", uses)
+	}
+	now = now.Add(10 * time.Minute)
+	if uses := use("b", now.Add(time.Minute)); uses != 1 {
+		t.Errorf("Expected expired entry to be reset, got %d uses", uses)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Expected the other expired entries to be dropped, got %d", cache.Len())
+	}
+}
+
+func TestReplayCacheEvictsInExpiryOrder(t *testing.T) {
+	cache := NewReplayCache(100)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	// Inserted in shuffled expiry order, only the entries expired by now make room
+	expiry := func(i int) int { return (i*7919+918)%1000 + 1 }
+	for i := range 100 {
+		if _, err := cache.Use(fmt.Sprint(i), now.Add(time.Duration(expiry(i))*time.Second)); err != nil {
+			t.Fatalf("Expected room for entry %d, got %v", i, err)
+		}
+	}
+	now = now.Add(500 * time.Second)
+	expired := 0
+	for i := range 100 {
+		if expiry(i) <= 500 {
+			expired++
+		}
+	}
+	for i := 100; i < 100+expired; i++ {
+		if _, err := cache.Use(fmt.Sprint(i), now.Add(time.Hour)); err != nil {
+			t.Fatalf("Expected expired entries to make room for entry %d, got %v", i, err)
+		}
+	}
+	if _, err := cache.Use("one too many", now.Add(time.Hour)); !errors.Is(err, ErrReplayCacheFull) {
+		t.Errorf("Expected ErrReplayCacheFull once only unexpired entries are left, got %v", err)
+	}
+	for i := range 100 {
+		if _, ok := cache.entries[fmt.Sprint(i)]; ok != (expiry(i) > 500) {
+			t.Errorf("Expected only the unexpired entries to be kept, entry expiring after %ds kept: %v", expiry(i), ok)
+		}
+	}
+}
+
+// createDPoPProof signs a DPoP proof for the given request and access token
+func createDPoPProof(t *testing.T, key *ecdsa.PrivateKey, method, htu, accessToken string, iat time.Time) string {
+	jwk, err := NewJWK(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create JWK: %v", err)
+	}
+	tokenHash := sha256.Sum256([]byte(accessToken))
+	jti := make([]byte, 16)
+	rand.Read(jti)
+
+	proof := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"htm": method,
+		"htu": htu,
+		"iat": iat.Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+		"ath": base64.RawURLEncoding.EncodeToString(tokenHash[:]),
+	})
+	proof.Header["typ"] = dpopProofType
+	proof.Header["jwk"] = jwk
+	signed, err := proof.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign proof: %v", err)
+	}
+	return signed
+}
+
+func TestMultiKeyJWTValidatorDPoP(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	clientJWK, _ := NewJWK(&clientKey.PublicKey)
+	jkt, err := clientJWK.Thumbprint()
+	if err != nil {
+		t.Fatalf("Failed to compute thumbprint: %v", err)
+	}
+
+	mockProvider := &mockKeyProvider{
+		keys: map[string]PublicKey{"1": {Algorithm: AlgorithmRS256, Key: &signingKey.PublicKey}},
+	}
+	validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP))
+
+	createToken := func(bound bool) string {
+		claims := jwt.MapClaims{"connect-tcp": true}
+		if bound {
+			claims["cnf"] = map[string]string{"jkt": jkt}
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "1"
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+		return signed
+	}
+	boundToken := createToken(true)
+	bearerToken := createToken(false)
+	replayedProof := createDPoPProof(t, clientKey, http.MethodConnect, "https://example.com:443", boundToken, time.Now())
+
+	tests := []struct {
+		name          string
+		scheme        string
+		token         string
+		proof         string
+		expectSuccess bool
+	}{
+		{"Valid proof", dpopScheme, boundToken,
+			createDPoPProof(t, clientKey, http.MethodConnect, "https://example.com:443", boundToken, time.Now()), true},
+		{"Bound token without proof", dpopScheme, boundToken, "", false},
+		{"Bound token as bearer", authScheme, boundToken, "", false},
+		{"Proof from other key", dpopScheme, boundToken,
+			createDPoPProof(t, otherKey, http.MethodConnect, "https://example.com:443", boundToken, time.Now()), false},
+		{"Proof for other target", dpopScheme, boundToken,
+			createDPoPProof(t, clientKey, http.MethodConnect, "https://other.example.com:443", boundToken, time.Now()), false},
+		{"Proof for other method", dpopScheme, boundToken,
+			createDPoPProof(t, clientKey, http.MethodGet, "https://example.com:443", boundToken, time.Now()), false},
+		{"Proof for other token", dpopScheme, boundToken,
+			createDPoPProof(t, clientKey, http.MethodConnect, "https://example.com:443", bearerToken, time.Now()), false},
+		{"Stale proof", dpopScheme, boundToken,
+			createDPoPProof(t, clientKey, http.MethodConnect, "https://example.com:443", boundToken, time.Now().Add(-time.Hour)), false},
+		{"First use of proof", dpopScheme, boundToken, replayedProof, true},
+		{"Replayed proof", dpopScheme, boundToken, replayedProof, false},
+		{"Unbound token with DPoP scheme", dpopScheme, bearerToken, "", false},
+		{"Unbound bearer token", authScheme, bearerToken, "", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+			req.Host = "example.com:443"
+			req.Header.Set(authHeader, tc.scheme+" "+tc.token)
+			if tc.proof != "" {
+				req.Header.Set(dpopHeader, tc.proof)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			validator.Middleware(handler).ServeHTTP(recorder, req)
+
+			if tc.expectSuccess && recorder.Code != http.StatusOK {
+				t.Errorf("Expected success but got status %d: %s", recorder.Code, recorder.Body.String())
+			} else if !tc.expectSuccess && recorder.Code == http.StatusOK {
+				t.Errorf("Expected failure but got success")
+			}
+		})
+	}
+}
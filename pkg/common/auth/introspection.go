@@ -0,0 +1,205 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// introspectionCacheMaxEntries bounds the number of cached introspection results
+const introspectionCacheMaxEntries = 10000
+
+// IntrospectionConfig configures an IntrospectionAuthenticator
+type IntrospectionConfig struct {
+	// URL of the RFC 7662 introspection endpoint
+	URL string
+	// ClientSecret is sent as bearer token to authenticate to the introspection endpoint
+	ClientSecret string
+	// Permissions selects the permissions a request requires
+	Permissions PermissionSelector
+	// Audiences accepted in the aud claim, see WithAudiences
+	Audiences       []string
+	RequireAudience bool
+	// CacheTTL is how long introspection results are reused, never beyond the token's expiry
+	CacheTTL time.Duration
+	// MaxTokenUses limits how often any token may be used, see WithReplayDetection
+	MaxTokenUses int
+}
+
+// IntrospectionAuthenticator validates tokens by asking the control server about them (RFC 7662),
+// for deployments that cannot verify signatures locally. Unlike local validation it sees revocations.
+type IntrospectionAuthenticator struct {
+	cfg         IntrospectionConfig
+	client      *http.Client
+	cache       map[string]introspectionResult
+	cacheMutex  sync.Mutex
+	proofReplay *ReplayCache
+	tokenUses   *ReplayCache
+}
+
+// introspectionResult is a cached answer of the introspection endpoint, claims are nil for inactive tokens
+type introspectionResult struct {
+	claims    jwt.MapClaims
+	expiresAt time.Time
+}
+
+// NewIntrospectionAuthenticator creates an authenticator using the introspection endpoint in cfg
+func NewIntrospectionAuthenticator(cfg IntrospectionConfig) *IntrospectionAuthenticator {
+	log.Printf("Initializing IntrospectionAuthenticator with endpoint %s", cfg.URL)
+	if cfg.Permissions == nil {
+		cfg.Permissions = StaticPermissions()
+	}
+	return &IntrospectionAuthenticator{
+		cfg:         cfg,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		cache:       make(map[string]introspectionResult),
+		proofReplay: NewReplayCache(dpopReplayMaxIDs),
+		tokenUses:   NewReplayCache(tokenReplayMaxIDs),
+	}
+}
+
+// Name identifies the authenticator within an authenticator chain
+func (a *IntrospectionAuthenticator) Name() string {
+	return "introspection"
+}
+
+// Middleware implements HTTP middleware for token introspection
+func (a *IntrospectionAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := a.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authenticate introspects the token presented in the request and returns a context carrying its claims
+func (a *IntrospectionAuthenticator) Authenticate(r *http.Request) (context.Context, error) {
+	authHeader := r.Header.Get(authHeader)
+	if authHeader == "" {
+		return nil, ErrNoAuthHeader
+	}
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || (parts[0] != authScheme && parts[0] != dpopScheme) {
+		return nil, ErrInvalidScheme
+	}
+	tokenStr := parts[1]
+
+	claims, err := a.introspect(tokenStr)
+	if err != nil {
+		log.Printf("Introspection: request failed: %v", err)
+		return nil, fmt.Errorf("%w: introspection failed", ErrInvalidToken)
+	}
+	if claims == nil {
+		return nil, fmt.Errorf("%w: token is not active", ErrInvalidToken)
+	}
+
+	if err := checkAudience(claims, a.cfg.Audiences, a.cfg.RequireAudience); err != nil {
+		return nil, err
+	}
+	for _, perm := range a.cfg.Permissions(r) {
+		if !perm.Check(claims) {
+			return nil, fmt.Errorf("missing required permission: %s", perm)
+		}
+	}
+	if jkt := ConfirmationThumbprint(claims); jkt != "" {
+		if err := verifyDPoPProof(r, tokenStr, jkt, a.proofReplay); err != nil {
+			return nil, err
+		}
+	} else if parts[0] == dpopScheme {
+		return nil, fmt.Errorf("%w: token is not DPoP bound", ErrInvalidDPoPProof)
+	}
+	if err := checkTokenUses(claims, a.cfg.MaxTokenUses, a.tokenUses); err != nil {
+		return nil, err
+	}
+
+	return withClaims(r.Context(), claimsFromJWT(claims, nil)), nil
+}
+
+// introspect returns the claims of an active token or nil for an inactive one, using cached results when possible
+func (a *IntrospectionAuthenticator) introspect(tokenStr string) (jwt.MapClaims, error) {
+	hash := sha256.Sum256([]byte(tokenStr))
+	cacheKey := hex.EncodeToString(hash[:])
+	now := time.Now()
+
+	a.cacheMutex.Lock()
+	result, ok := a.cache[cacheKey]
+	a.cacheMutex.Unlock()
+	if ok && now.Before(result.expiresAt) {
+		return result.claims, nil
+	}
+
+	claims, err := a.fetch(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.Add(a.cfg.CacheTTL)
+	if claims != nil {
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil && exp.Before(expiresAt) {
+			expiresAt = exp.Time
+		}
+	}
+
+	a.cacheMutex.Lock()
+	if len(a.cache) >= introspectionCacheMaxEntries {
+		for key, cached := range a.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(a.cache, key)
+			}
+		}
+		if len(a.cache) >= introspectionCacheMaxEntries {
+			a.cache = make(map[string]introspectionResult)
+		}
+	}
+	a.cache[cacheKey] = introspectionResult{claims: claims, expiresAt: expiresAt}
+	a.cacheMutex.Unlock()
+
+	return claims, nil
+}
+
+// fetch asks the introspection endpoint about a token
+func (a *IntrospectionAuthenticator) fetch(tokenStr string) (jwt.MapClaims, error) {
+	form := url.Values{"token": {tokenStr}}
+	req, err := http.NewRequest(http.MethodPost, a.cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+a.cfg.ClientSecret)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var claims jwt.MapClaims
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, nil
+	}
+	delete(claims, "active")
+	return claims, nil
+}
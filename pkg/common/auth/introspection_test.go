@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIntrospectionAuthenticator(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		response := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "valid":
+			response = map[string]interface{}{"active": true, "connect-tcp": true, "exp": time.Now().Add(time.Hour).Unix()}
+		case "no-permission":
+			response = map[string]interface{}{"active": true}
+		case "other-proxy":
+			response = map[string]interface{}{"active": true, "connect-tcp": true, "aud": "https://other.example.com"}
+		case "single-use":
+			response = map[string]interface{}{"active": true, "connect-tcp": true, "jti": "1", "constraints": map[string]int{"maxUses": 1}}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	authenticator := NewIntrospectionAuthenticator(IntrospectionConfig{
+		URL:          server.URL,
+		ClientSecret: "secret",
+		Permissions:  StaticPermissions(PERMISSION_CONNECT_TCP),
+		Audiences:    []string{"https://proxy.example.com"},
+		CacheTTL:     time.Minute,
+	})
+
+	authenticate := func(scheme, token string) error {
+		req := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+		if token != "" {
+			req.Header.Set(authHeader, scheme+" "+token)
+		}
+		_, err := authenticator.Authenticate(req)
+		return err
+	}
+
+	tests := []struct {
+		name          string
+		scheme        string
+		token         string
+		expectedError error
+	}{
+		{"Active token", authScheme, "valid", nil},
+		{"Inactive token", authScheme, "revoked", ErrInvalidToken},
+		{"Missing permission", authScheme, "no-permission", errAny},
+		{"Other audience", authScheme, "other-proxy", ErrInvalidAudience},
+		{"No header", authScheme, "", ErrNoAuthHeader},
+		{"Unknown scheme", "Basic", "valid", ErrInvalidScheme},
+		{"DPoP scheme with unbound token", dpopScheme, "valid", ErrInvalidDPoPProof},
+		{"Single use token", authScheme, "single-use", nil},
+		{"Single use token reused", authScheme, "single-use", ErrTokenReused},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := authenticate(tc.scheme, tc.token)
+			switch {
+			case tc.expectedError == nil && err != nil:
+				t.Errorf("Expected success, got %v", err)
+			case tc.expectedError == errAny && err == nil:
+				t.Errorf("Expected failure, got success")
+			case tc.expectedError != nil && tc.expectedError != errAny && !errors.Is(err, tc.expectedError):
+				t.Errorf("Expected %v, got %v", tc.expectedError, err)
+			}
+		})
+	}
+
+	// Results are cached, so repeated use of a token does not hit the endpoint again
+	before := requests.Load()
+	if err := authenticate(authScheme, "valid"); err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	if requests.Load() != before {
+		t.Errorf("Expected cached introspection result to be used")
+	}
+
+	// Failing introspection rejects the request
+	server.Close()
+	if err := authenticate(authScheme, "uncached"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected %v when introspection is unavailable, got %v", ErrInvalidToken, err)
+	}
+}
+
+// errAny marks a test case that must fail with any error
+var errAny = errors.New("any error")
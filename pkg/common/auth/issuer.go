@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Issuer is a trusted token issuer, e.g. a regional or partner control server
+type Issuer struct {
+	// Name must match the iss claim of tokens from this issuer
+	Name string
+	// Keys provides the verification keys of this issuer
+	Keys KeyProvider
+	// Permissions this issuer may grant, wildcards included, empty means any
+	Permissions []Permission
+}
+
+// DefaultKeyCacheTTL is how long a validator uses the fetched keys of an issuer before fetching them again,
+// so keys removed from the key set, e.g. revoked ones, stop validating tokens
+const DefaultKeyCacheTTL = 5 * time.Minute
+
+// staleKeyCacheTTLs is how many key cache TTLs after the last fetch cached keys are still used while the
+// provider fails, a revoked key must not validate tokens for as long as the key set is unreachable
+const staleKeyCacheTTLs = 3
+
+// keySource caches the keys of a single issuer
+type keySource struct {
+	Issuer
+	keyCache      map[string]PublicKey
+	keyCacheTTL   time.Duration
+	fetchedAt     time.Time
+	keyCacheMutex sync.RWMutex
+}
+
+func newKeySource(issuer Issuer) *keySource {
+	return &keySource{
+		Issuer:      issuer,
+		keyCache:    make(map[string]PublicKey),
+		keyCacheTTL: DefaultKeyCacheTTL,
+	}
+}
+
+// allows reports whether the issuer may grant the permission
+func (s *keySource) allows(perm Permission) bool {
+	return len(s.Permissions) == 0 || grantsAny(s.Permissions, perm)
+}
+
+// freshLocked reports whether the cached keys may still be used without fetching them again
+func (s *keySource) freshLocked() bool {
+	return time.Since(s.fetchedAt) < s.keyCacheTTL
+}
+
+// expire makes the next lookup fetch the keys again
+func (s *keySource) expire() {
+	s.keyCacheMutex.Lock()
+	s.fetchedAt = time.Time{}
+	s.keyCacheMutex.Unlock()
+}
+
+// getKey retrieves a public key by ID, fetching from the provider if it is unknown or the cache expired
+func (s *keySource) getKey(keyID string) (PublicKey, error) {
+	log.Printf("JWT: Attempting to retrieve key with ID %s", keyID)
+
+	// First check the cache with a read lock
+	s.keyCacheMutex.RLock()
+	key, exists := s.keyCache[keyID]
+	fresh := s.freshLocked()
+	s.keyCacheMutex.RUnlock()
+
+	if exists && fresh {
+		log.Printf("JWT: Key ID %s found in cache", keyID)
+		return key, nil
+	}
+
+	log.Printf("JWT: Key ID %s not in cache or cache expired, fetching from provider", keyID)
+
+	// Key not found, fetch all keys with a write lock
+	s.keyCacheMutex.Lock()
+	defer s.keyCacheMutex.Unlock()
+
+	// Double-check if the keys were fetched while waiting for lock
+	key, exists = s.keyCache[keyID]
+	if exists && s.freshLocked() {
+		log.Printf("JWT: Key ID %s was added to cache while waiting for lock", keyID)
+		return key, nil
+	}
+
+	// Fetch keys from provider
+	startTime := time.Now()
+	keys, err := s.Keys.PublicKeys()
+	fetchDuration := time.Since(startTime)
+
+	if err != nil {
+		log.Printf("JWT: Error fetching public keys from provider after %v: %v", fetchDuration, err)
+		// Keep validating for a while when the provider is briefly unavailable, the key was in the last key set
+		if exists && time.Since(s.fetchedAt) < staleKeyCacheTTLs*s.keyCacheTTL && !key.expired(time.Now()) {
+			log.Printf("JWT: Using expired cache entry for key ID %s", keyID)
+			return key, nil
+		}
+		return PublicKey{}, fmt.Errorf("failed to fetch public keys: %w", err)
+	}
+
+	log.Printf("JWT: Successfully fetched %d keys from provider in %v", len(keys), fetchDuration)
+
+	// Replace the cache, keys missing from the key set were removed by the issuer
+	s.keyCache = maps.Clone(keys)
+	s.fetchedAt = time.Now()
+
+	// Check if our key is now in the cache
+	key, exists = s.keyCache[keyID]
+	if !exists {
+		log.Printf("JWT: Key ID %s not found in provider's keys", keyID)
+		return PublicKey{}, fmt.Errorf("key ID %s not found", keyID)
+	}
+
+	log.Printf("JWT: Successfully retrieved key ID %s", keyID)
+	return key, nil
+}
@@ -0,0 +1,208 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Supported signing algorithms, for the control server's signing keys as well as for verification keys.
+const (
+	AlgorithmRS256 = "RS256" // RSASSA-PKCS1-v1_5 using SHA-256 with a 2048 bit key
+	AlgorithmES256 = "ES256" // ECDSA using P-256 and SHA-256
+	AlgorithmEdDSA = "EdDSA" // Ed25519
+)
+
+// PublicKey is a verification key together with the one algorithm it may be used with.
+// Binding the algorithm to the key prevents algorithm confusion attacks where a token
+// header chooses how a key is interpreted.
+type PublicKey struct {
+	Algorithm string
+	Key       crypto.PublicKey
+	// ExpiresAt is when the issuer stops signing with the key, zero if the key set does not tell
+	ExpiresAt time.Time
+}
+
+// expired reports whether the issuer stopped signing with the key
+func (k PublicKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// jsonWebKey is a single entry of the JWKS document served by the control server.
+type jsonWebKey struct {
+	Kty       string `json:"kty"`
+	Alg       string `json:"alg"`
+	K         string `json:"k"`
+	Kid       string `json:"kid"`
+	ExpiresAt int64  `json:"expiresAt"`
+	// Standard RFC 7517 members, used by external identity providers instead of k
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// ParseJWKS parses a JWKS document into a map of key IDs to public keys. It understands the format
+// served by the control server as well as standard RFC 7517 keys of external identity providers.
+// Keys with an unknown type are skipped, keys whose type does not match their algorithm are rejected.
+// Standard keys this package cannot verify with, e.g. other curves or encryption keys, are skipped.
+func ParseJWKS(data []byte) (map[string]PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	publicKeys := make(map[string]PublicKey)
+	for _, key := range jwks.Keys {
+		alg := key.Alg
+		switch key.Kty {
+		case "RSA":
+			// Keys published before algorithm agility carry no alg and are always RS256
+			if alg == "" {
+				alg = AlgorithmRS256
+			}
+		case "EC", "OKP":
+		default:
+			continue
+		}
+
+		if key.K == "" {
+			if publicKey, ok := parseStandardKey(key); ok {
+				publicKeys[key.Kid] = publicKey
+			}
+			continue
+		}
+
+		// Decode the base64 key
+		keyBytes, err := base64.StdEncoding.DecodeString(key.K)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %s: %w", key.Kid, err)
+		}
+
+		// Parse the key bytes into a public key
+		pubKey, err := x509.ParsePKIXPublicKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", key.Kid, err)
+		}
+
+		if err := checkKeyAlgorithm(alg, pubKey); err != nil {
+			return nil, fmt.Errorf("key %s: %w", key.Kid, err)
+		}
+
+		publicKeys[key.Kid] = PublicKey{Algorithm: alg, Key: pubKey, ExpiresAt: unixTime(key.ExpiresAt)}
+	}
+
+	return publicKeys, nil
+}
+
+// parseStandardKey decodes an RFC 7517 signing key, reporting false for keys that cannot be used
+func parseStandardKey(key jsonWebKey) (PublicKey, bool) {
+	if key.Use != "" && key.Use != "sig" {
+		return PublicKey{}, false
+	}
+	jwk := JWK{Kty: key.Kty, N: key.N, E: key.E, Crv: key.Crv, X: key.X, Y: key.Y}
+	pubKey, err := jwk.PublicKey()
+	if err != nil {
+		return PublicKey{}, false
+	}
+
+	alg := key.Alg
+	if alg == "" {
+		switch key.Kty {
+		case "RSA":
+			alg = AlgorithmRS256
+		case "EC":
+			alg = AlgorithmES256
+		case "OKP":
+			alg = AlgorithmEdDSA
+		}
+	}
+	if checkKeyAlgorithm(alg, pubKey) != nil {
+		return PublicKey{}, false
+	}
+	return PublicKey{Algorithm: alg, Key: pubKey, ExpiresAt: unixTime(key.ExpiresAt)}, true
+}
+
+// unixTime converts an expiresAt member, 0 means no expiry
+func unixTime(seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// MarshalJWKS encodes public keys in the JWKS format served by the control server
+func MarshalJWKS(keys map[string]PublicKey) ([]byte, error) {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: []jsonWebKey{}}
+
+	for kid, key := range keys {
+		var kty string
+		switch key.Algorithm {
+		case AlgorithmRS256:
+			kty = "RSA"
+		case AlgorithmES256:
+			kty = "EC"
+		case AlgorithmEdDSA:
+			kty = "OKP"
+		default:
+			return nil, fmt.Errorf("key %s: unsupported algorithm %q", kid, key.Algorithm)
+		}
+
+		der, err := x509.MarshalPKIXPublicKey(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal key %s: %w", kid, err)
+		}
+		var expiresAt int64
+		if !key.ExpiresAt.IsZero() {
+			expiresAt = key.ExpiresAt.Unix()
+		}
+		jwks.Keys = append(jwks.Keys, jsonWebKey{
+			Kty:       kty,
+			Alg:       key.Algorithm,
+			K:         base64.StdEncoding.EncodeToString(der),
+			Kid:       kid,
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	return json.Marshal(jwks)
+}
+
+// checkKeyAlgorithm makes sure a public key is of the type the algorithm requires
+func checkKeyAlgorithm(alg string, key crypto.PublicKey) error {
+	switch alg {
+	case AlgorithmRS256:
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return fmt.Errorf("algorithm %s requires an RSA key", alg)
+		}
+	case AlgorithmES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return fmt.Errorf("algorithm %s requires a P-256 key", alg)
+		}
+	case AlgorithmEdDSA:
+		if _, ok := key.(ed25519.PublicKey); !ok {
+			return fmt.Errorf("algorithm %s requires an Ed25519 key", alg)
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func encodeTestKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	rsaK := encodeTestKey(t, &rsaKey.PublicKey)
+	ecK := encodeTestKey(t, &ecKey.PublicKey)
+	edK := encodeTestKey(t, edPub)
+
+	t.Run("Mixed key types", func(t *testing.T) {
+		doc := fmt.Sprintf(`{"keys":[
+			{"kty":"RSA","k":"%s","kid":"legacy"},
+			{"kty":"EC","alg":"ES256","k":"%s","kid":"ec"},
+			{"kty":"OKP","alg":"EdDSA","k":"%s","kid":"ed"},
+			{"kty":"oct","k":"c2VjcmV0","kid":"ignored"}
+		]}`, rsaK, ecK, edK)
+
+		keys, err := ParseJWKS([]byte(doc))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(keys) != 3 {
+			t.Fatalf("Expected 3 keys, got %d", len(keys))
+		}
+		if keys["legacy"].Algorithm != AlgorithmRS256 {
+			t.Errorf("Expected legacy RSA key to default to RS256, got %q", keys["legacy"].Algorithm)
+		}
+		if keys["ec"].Algorithm != AlgorithmES256 {
+			t.Errorf("Expected ES256, got %q", keys["ec"].Algorithm)
+		}
+		if keys["ed"].Algorithm != AlgorithmEdDSA {
+			t.Errorf("Expected EdDSA, got %q", keys["ed"].Algorithm)
+		}
+	})
+
+	t.Run("Algorithm not matching key type", func(t *testing.T) {
+		doc := fmt.Sprintf(`{"keys":[{"kty":"EC","alg":"EdDSA","k":"%s","kid":"bad"}]}`, ecK)
+		if _, err := ParseJWKS([]byte(doc)); err == nil {
+			t.Fatal("Expected error for mismatched algorithm")
+		}
+	})
+
+	t.Run("Standard RFC 7517 keys", func(t *testing.T) {
+		rsaJWK, _ := NewJWK(&rsaKey.PublicKey)
+		ecJWK, _ := NewJWK(&ecKey.PublicKey)
+		doc := fmt.Sprintf(`{"keys":[
+			{"kty":"RSA","use":"sig","n":"%s","e":"%s","kid":"idp-rsa"},
+			{"kty":"EC","crv":"P-256","x":"%s","y":"%s","kid":"idp-ec"},
+			{"kty":"RSA","use":"enc","n":"%s","e":"%s","kid":"encryption"},
+			{"kty":"RSA","alg":"PS256","n":"%s","e":"%s","kid":"unsupported"},
+			{"kty":"EC","crv":"P-384","x":"AA","y":"AA","kid":"other-curve"}
+		]}`, rsaJWK.N, rsaJWK.E, ecJWK.X, ecJWK.Y, rsaJWK.N, rsaJWK.E, rsaJWK.N, rsaJWK.E)
+
+		keys, err := ParseJWKS([]byte(doc))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(keys) != 2 {
+			t.Fatalf("Expected 2 keys, got %d", len(keys))
+		}
+		if keys["idp-rsa"].Algorithm != AlgorithmRS256 || !rsaKey.PublicKey.Equal(keys["idp-rsa"].Key) {
+			t.Errorf("Unexpected RSA key %+v", keys["idp-rsa"])
+		}
+		if keys["idp-ec"].Algorithm != AlgorithmES256 || !ecKey.PublicKey.Equal(keys["idp-ec"].Key) {
+			t.Errorf("Unexpected EC key %+v", keys["idp-ec"])
+		}
+	})
+
+	t.Run("Invalid JSON", func(t *testing.T) {
+		if _, err := ParseJWKS([]byte("not json")); err == nil {
+			t.Fatal("Expected error for invalid JSON")
+		}
+	})
+}
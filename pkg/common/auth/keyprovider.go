@@ -0,0 +1,136 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HTTPKeyProvider fetches a JWKS document from a URL, e.g. a control server's /.well-known/jwks.json
+type HTTPKeyProvider struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPKeyProvider creates a provider fetching the JWKS at url on every call
+func NewHTTPKeyProvider(url string) *HTTPKeyProvider {
+	return &HTTPKeyProvider{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PublicKeys fetches and parses the JWKS document
+func (h *HTTPKeyProvider) PublicKeys() (map[string]PublicKey, error) {
+	resp, err := h.client.Get(h.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from JWKS endpoint: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS response: %w", err)
+	}
+
+	return ParseJWKS(body)
+}
+
+// FileKeyProvider serves a static JWKS document from disk,
+// allowing a proxy to validate tokens without a control server.
+type FileKeyProvider struct {
+	path string
+}
+
+// NewFileKeyProvider creates a provider reading the JWKS file at path on every fetch
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{path: path}
+}
+
+// PublicKeys reads and parses the JWKS file
+func (f *FileKeyProvider) PublicKeys() (map[string]PublicKey, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	return ParseJWKS(data)
+}
+
+// CachingKeyProvider wraps another KeyProvider and persists the last good key set to disk.
+// When the upstream provider fails, e.g. during a control plane outage, the persisted
+// key set is served instead, including right after a restart, without the keys that expired since.
+type CachingKeyProvider struct {
+	upstream KeyProvider
+	cache    *FileKeyProvider
+	mutex    sync.Mutex
+}
+
+// NewCachingKeyProvider creates a provider that caches the keys of upstream in the file at path
+func NewCachingKeyProvider(upstream KeyProvider, path string) *CachingKeyProvider {
+	return &CachingKeyProvider{
+		upstream: upstream,
+		cache:    NewFileKeyProvider(path),
+	}
+}
+
+// PublicKeys fetches keys from upstream, falling back to the persisted key set on failure
+func (c *CachingKeyProvider) PublicKeys() (map[string]PublicKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys, err := c.upstream.PublicKeys()
+	if err != nil {
+		cached, cacheErr := c.cache.PublicKeys()
+		if cacheErr != nil {
+			return nil, fmt.Errorf("upstream failed: %w (no usable key cache: %v)", err, cacheErr)
+		}
+		// The issuer no longer signs with expired keys, and cannot tell whether it revoked others meanwhile
+		now := time.Now()
+		maps.DeleteFunc(cached, func(_ string, key PublicKey) bool { return key.expired(now) })
+		log.Printf("JWT: Key provider unavailable, using %d cached keys from %s: %v", len(cached), c.cache.path, err)
+		return cached, nil
+	}
+
+	if err := c.persist(keys); err != nil {
+		// Keys are still valid, only the fallback is outdated
+		log.Printf("JWT: Failed to persist key cache to %s: %v", c.cache.path, err)
+	}
+	return keys, nil
+}
+
+// persist atomically replaces the cache file with the given keys
+func (c *CachingKeyProvider) persist(keys map[string]PublicKey) error {
+	data, err := MarshalJWKS(keys)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.cache.path), ".jwks-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.cache.path)
+}
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	data, err := MarshalJWKS(map[string]PublicKey{"ec": {Algorithm: AlgorithmES256, Key: &ecKey.PublicKey}})
+	if err != nil {
+		t.Fatalf("Failed to marshal JWKS: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	keys, err := NewFileKeyProvider(path).PublicKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if keys["ec"].Algorithm != AlgorithmES256 || !ecKey.PublicKey.Equal(keys["ec"].Key) {
+		t.Errorf("Key did not survive a round trip: %+v", keys["ec"])
+	}
+
+	if _, err := NewFileKeyProvider(filepath.Join(t.TempDir(), "missing.json")).PublicKeys(); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestCachingKeyProvider(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	upstream := &mockKeyProvider{
+		keys: map[string]PublicKey{"ec": {Algorithm: AlgorithmES256, Key: &ecKey.PublicKey}},
+	}
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	t.Run("No cache and upstream down", func(t *testing.T) {
+		down := &mockKeyProvider{err: errors.New("control unreachable")}
+		if _, err := NewCachingKeyProvider(down, path).PublicKeys(); err == nil {
+			t.Fatal("Expected error without upstream and cache")
+		}
+	})
+
+	t.Run("Upstream up populates cache", func(t *testing.T) {
+		keys, err := NewCachingKeyProvider(upstream, path).PublicKeys()
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("Expected 1 key, got %d (%v)", len(keys), err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("Expected cache file to be written: %v", err)
+		}
+	})
+
+	t.Run("Restart with upstream down uses cache", func(t *testing.T) {
+		down := &mockKeyProvider{err: errors.New("control unreachable")}
+		keys, err := NewCachingKeyProvider(down, path).PublicKeys()
+		if err != nil {
+			t.Fatalf("Expected cached keys, got %v", err)
+		}
+		if !ecKey.PublicKey.Equal(keys["ec"].Key) {
+			t.Error("Cached key does not match upstream key")
+		}
+	})
+
+	t.Run("Expired keys are dropped from cache", func(t *testing.T) {
+		expiredKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		upstream := &mockKeyProvider{keys: map[string]PublicKey{
+			"current": {Algorithm: AlgorithmES256, Key: &ecKey.PublicKey, ExpiresAt: time.Now().Add(time.Hour)},
+			"expired": {Algorithm: AlgorithmES256, Key: &expiredKey.PublicKey, ExpiresAt: time.Now().Add(-time.Minute)},
+		}}
+		if _, err := NewCachingKeyProvider(upstream, path).PublicKeys(); err != nil {
+			t.Fatalf("Expected keys from upstream, got %v", err)
+		}
+
+		down := &mockKeyProvider{err: errors.New("control unreachable")}
+		keys, err := NewCachingKeyProvider(down, path).PublicKeys()
+		if err != nil {
+			t.Fatalf("Expected cached keys, got %v", err)
+		}
+		if _, ok := keys["expired"]; ok {
+			t.Error("Expected the expired key to be dropped from the cache")
+		}
+		if key, ok := keys["current"]; !ok || key.ExpiresAt.Unix() != upstream.keys["current"].ExpiresAt.Unix() {
+			t.Errorf("Expected the current key with its expiry, got %+v", key)
+		}
+	})
+}
@@ -6,12 +6,11 @@ package auth
 
 import (
 	"context"
-	"crypto/rsa"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -19,255 +18,357 @@ import (
 
 // KeyProvider interface for services that can provide public keys for JWT validation
 type KeyProvider interface {
-	// PublicKeys returns a map of key IDs to RSA public keys
-	PublicKeys() (map[string]*rsa.PublicKey, error)
+	// PublicKeys returns a map of key IDs to public keys
+	PublicKeys() (map[string]PublicKey, error)
 }
 
 // MultiKeyJWTValidator validates JWT tokens using multiple public keys
 // It fetches keys from a KeyProvider as needed
 type MultiKeyJWTValidator struct {
-	keyProvider        KeyProvider
-	keyCache           map[string]*rsa.PublicKey
-	keyCacheMutex      sync.RWMutex
+	sources            []*keySource
 	allowNoneSignature bool
-	permissions        []Permission
+	permissions        PermissionSelector
+	audiences          []string
+	requireAudience    bool
+	proofReplay        *ReplayCache
+	tokenUses          *ReplayCache
+	maxTokenUses       int
+	keyCacheTTL        time.Duration
 }
 
-// NewMultiKeyJWTValidator creates a new validator that can handle multiple keys
-func NewMultiKeyJWTValidator(keyProvider KeyProvider, permissions []Permission) *MultiKeyJWTValidator {
-	permStrings := make([]string, len(permissions))
-	for i, p := range permissions {
-		permStrings[i] = string(p)
-	}
-
-	log.Printf("Initializing MultiKeyJWTValidator with permissions: %v", permStrings)
+// ValidatorOption configures optional behaviour of a MultiKeyJWTValidator
+type ValidatorOption func(*MultiKeyJWTValidator)
 
-	return &MultiKeyJWTValidator{
-		keyProvider: keyProvider,
-		keyCache:    make(map[string]*rsa.PublicKey),
-		permissions: permissions,
+// WithAudiences only accepts tokens whose aud claim contains one of the given audiences,
+// typically the proxy's own URL and its fleet group.
+// Tokens without an aud claim are accepted unless requireAudience is set.
+func WithAudiences(audiences []string, requireAudience bool) ValidatorOption {
+	return func(v *MultiKeyJWTValidator) {
+		v.audiences = audiences
+		v.requireAudience = requireAudience
 	}
 }
 
-// getKey retrieves a public key by ID, fetching from the provider if necessary
-func (v *MultiKeyJWTValidator) getKey(keyID string) (*rsa.PublicKey, error) {
-	log.Printf("JWT: Attempting to retrieve key with ID %s", keyID)
-
-	// First check the cache with a read lock
-	v.keyCacheMutex.RLock()
-	key, exists := v.keyCache[keyID]
-	v.keyCacheMutex.RUnlock()
-
-	if exists {
-		log.Printf("JWT: Key ID %s found in cache", keyID)
-		return key, nil
+// WithIssuers trusts tokens from the given issuers, each validated only with keys from its own source.
+func WithIssuers(issuers ...Issuer) ValidatorOption {
+	return func(v *MultiKeyJWTValidator) {
+		for _, issuer := range issuers {
+			log.Printf("Trusting token issuer %q with permissions %v", issuer.Name, GetPermissionStrings(issuer.Permissions))
+			v.sources = append(v.sources, newKeySource(issuer))
+		}
 	}
+}
 
-	log.Printf("JWT: Key ID %s not in cache, fetching from provider", keyID)
+// WithKeyCacheTTL sets how long fetched keys are used before they are fetched again, DefaultKeyCacheTTL by default.
+// Tokens signed with a key removed from the key set stop validating within this time. While the key set cannot
+// be fetched, keys that did not expire are used for up to three times as long.
+func WithKeyCacheTTL(ttl time.Duration) ValidatorOption {
+	return func(v *MultiKeyJWTValidator) {
+		v.keyCacheTTL = ttl
+	}
+}
 
-	// Key not found, fetch all keys with a write lock
-	v.keyCacheMutex.Lock()
-	defer v.keyCacheMutex.Unlock()
+// NewMultiKeyJWTValidator creates a new validator that can handle multiple keys.
+// Tokens of any issuer are validated with keys from keyProvider, which may be nil
+// if only the issuers configured with WithIssuers should be trusted.
+func NewMultiKeyJWTValidator(keyProvider KeyProvider, permissions PermissionSelector, opts ...ValidatorOption) *MultiKeyJWTValidator {
+	log.Printf("Initializing MultiKeyJWTValidator")
 
-	// Double-check if the key was added while waiting for lock
-	if key, exists := v.keyCache[keyID]; exists {
-		log.Printf("JWT: Key ID %s was added to cache while waiting for lock", keyID)
-		return key, nil
+	if permissions == nil {
+		permissions = StaticPermissions()
+	}
+	v := &MultiKeyJWTValidator{
+		permissions: permissions,
+		proofReplay: NewReplayCache(dpopReplayMaxIDs),
+		tokenUses:   NewReplayCache(tokenReplayMaxIDs),
+		keyCacheTTL: DefaultKeyCacheTTL,
+	}
+	if keyProvider != nil {
+		v.sources = append(v.sources, newKeySource(Issuer{Keys: keyProvider}))
+	}
+	for _, opt := range opts {
+		opt(v)
 	}
+	for _, source := range v.sources {
+		source.keyCacheTTL = v.keyCacheTTL
+	}
+	return v
+}
 
-	// Fetch keys from provider
-	startTime := time.Now()
-	keys, err := v.keyProvider.PublicKeys()
-	fetchDuration := time.Since(startTime)
+// ExpireKeys makes the next validation fetch the keys of every issuer again,
+// e.g. after a key was removed from the key set
+func (v *MultiKeyJWTValidator) ExpireKeys() {
+	for _, source := range v.sources {
+		source.expire()
+	}
+}
 
+// checkAudience verifies the aud claim against the audiences a proxy accepts
+func checkAudience(claims jwt.MapClaims, audiences []string, requireAudience bool) error {
+	if len(audiences) == 0 {
+		return nil
+	}
+	tokenAudiences, err := claims.GetAudience()
 	if err != nil {
-		log.Printf("JWT: Error fetching public keys from provider after %v: %v", fetchDuration, err)
-		return nil, fmt.Errorf("failed to fetch public keys: %w", err)
+		return fmt.Errorf("invalid aud claim: %w", err)
 	}
-
-	log.Printf("JWT: Successfully fetched %d keys from provider in %v", len(keys), fetchDuration)
-
-	// Update the cache with all fetched keys
-	for id, pubKey := range keys {
-		v.keyCache[id] = pubKey
-		log.Printf("JWT: Added key ID %s to cache", id)
+	if len(tokenAudiences) == 0 {
+		if requireAudience {
+			return ErrInvalidAudience
+		}
+		return nil
+	}
+	for _, aud := range tokenAudiences {
+		if slices.Contains(audiences, aud) {
+			return nil
+		}
 	}
+	return ErrInvalidAudience
+}
 
-	// Check if our key is now in the cache
-	key, exists = v.keyCache[keyID]
-	if !exists {
-		log.Printf("JWT: Key ID %s not found in provider's keys", keyID)
-		return nil, fmt.Errorf("key ID %s not found", keyID)
+// sourceFor selects the key source for the (still unverified) issuer of a token.
+// Configured issuers take precedence over the default source, which accepts any issuer.
+func (v *MultiKeyJWTValidator) sourceFor(issuer string) (*keySource, error) {
+	var fallback *keySource
+	for _, source := range v.sources {
+		if source.Name == issuer && source.Name != "" {
+			return source, nil
+		}
+		if source.Name == "" {
+			fallback = source
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("%w: untrusted issuer %q", ErrInvalidToken, issuer)
 	}
+	return fallback, nil
+}
 
-	log.Printf("JWT: Successfully retrieved key ID %s", keyID)
-	return key, nil
+// Name identifies the validator within an authenticator chain
+func (v *MultiKeyJWTValidator) Name() string {
+	return "jwt"
 }
 
 // Middleware implements HTTP middleware for JWT validation
 func (v *MultiKeyJWTValidator) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		startTime := time.Now()
-		reqPath := r.URL.Path
-		reqMethod := r.Method
-		reqID := r.Header.Get("X-Request-ID") // Use request ID from header if available
-		if reqID == "" {
-			// Generate a simple unique identifier if none exists
-			reqID = fmt.Sprintf("%d", time.Now().UnixNano())
+		ctx, err := v.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
 		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-		logPrefix := fmt.Sprintf("JWT-Auth [%s] %s %s:", reqID, reqMethod, reqPath)
-		log.Printf("%s Starting authentication check", logPrefix)
+// Authenticate validates the JWT presented in the request and returns a context carrying its claims
+func (v *MultiKeyJWTValidator) Authenticate(r *http.Request) (context.Context, error) {
+	startTime := time.Now()
+	reqPath := r.URL.Path
+	reqMethod := r.Method
+	reqID := r.Header.Get("X-Request-ID") // Use request ID from header if available
+	if reqID == "" {
+		// Generate a simple unique identifier if none exists
+		reqID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
 
-		// Extract token from header
-		authHeader := r.Header.Get(authHeader)
-		if authHeader == "" {
-			log.Printf("%s Missing authorization header", logPrefix)
-			http.Error(w, ErrNoAuthHeader.Error(), http.StatusUnauthorized)
-			return
-		}
+	logPrefix := fmt.Sprintf("JWT-Auth [%s] %s %s:", reqID, reqMethod, reqPath)
+	log.Printf("%s Starting authentication check", logPrefix)
 
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != authScheme {
-			log.Printf("%s Invalid authorization scheme: %s", logPrefix, parts[0])
-			http.Error(w, ErrInvalidScheme.Error(), http.StatusUnauthorized)
-			return
-		}
+	// Extract token from header
+	authHeader := r.Header.Get(authHeader)
+	if authHeader == "" {
+		log.Printf("%s Missing authorization header", logPrefix)
+		return nil, ErrNoAuthHeader
+	}
+
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || (parts[0] != authScheme && parts[0] != dpopScheme) {
+		log.Printf("%s Invalid authorization scheme: %s", logPrefix, parts[0])
+		return nil, ErrInvalidScheme
+	}
+
+	tokenStr := parts[1]
+	log.Printf("%s Authorization header found, token length: %d chars", logPrefix, len(tokenStr))
 
-		tokenStr := parts[1]
-		log.Printf("%s Authorization header found, token length: %d chars", logPrefix, len(tokenStr))
-
-		// Handle "none" algorithm if allowed
-		if v.allowNoneSignature {
-			log.Printf("%s Checking for 'none' algorithm (insecure mode)", logPrefix)
-			parser := jwt.NewParser()
-			token, _, err := parser.ParseUnverified(tokenStr, jwt.MapClaims{})
-			if err == nil && token.Method.Alg() == "none" {
-				log.Printf("%s Token uses 'none' algorithm and none is allowed", logPrefix)
-				token.Valid = true
-				if claims, ok := token.Claims.(jwt.MapClaims); ok {
-					// Check permissions
-					log.Printf("%s Checking permissions for 'none' token", logPrefix)
-					for _, perm := range v.permissions {
-						if !perm.Check(claims) {
-							log.Printf("%s Permission denied: missing %s", logPrefix, string(perm))
-							http.Error(w, "missing required permission: "+string(perm), http.StatusUnauthorized)
-							return
-						}
+	// Handle "none" algorithm if allowed
+	if v.allowNoneSignature {
+		log.Printf("%s Checking for 'none' algorithm (insecure mode)", logPrefix)
+		parser := jwt.NewParser()
+		token, _, err := parser.ParseUnverified(tokenStr, jwt.MapClaims{})
+		if err == nil && token.Method.Alg() == "none" {
+			log.Printf("%s Token uses 'none' algorithm and none is allowed", logPrefix)
+			token.Valid = true
+			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+				// Check permissions
+				log.Printf("%s Checking permissions for 'none' token", logPrefix)
+				for _, perm := range v.permissions(r) {
+					if !perm.Check(claims) {
+						log.Printf("%s Permission denied: missing %s", logPrefix, string(perm))
+						return nil, fmt.Errorf("missing required permission: %s", perm)
 					}
-					log.Printf("%s All permissions granted for 'none' token", logPrefix)
 				}
+				log.Printf("%s All permissions granted for 'none' token", logPrefix)
 
-				// Add token to context and proceed
+				// Add claims to context and proceed
 				log.Printf("%s Authentication successful with 'none' token in %v", logPrefix, time.Since(startTime))
-				ctx := context.WithValue(r.Context(), "token", token)
-				next.ServeHTTP(w, r.WithContext(ctx))
-				return
+				return withClaims(r.Context(), claimsFromJWT(claims, nil)), nil
 			}
 		}
+	}
 
-		// Parse token without validation to extract the kid
-		log.Printf("%s Parsing token to extract key ID (kid)", logPrefix)
-		parser := jwt.NewParser()
-		unsafeToken, _, err := parser.ParseUnverified(tokenStr, jwt.MapClaims{})
-		if err != nil {
-			log.Printf("%s Error parsing token: %v", logPrefix, err)
-			http.Error(w, fmt.Sprintf("%s: %v", ErrInvalidToken.Error(), err), http.StatusUnauthorized)
-			return
-		}
+	token, source, err := v.verifyToken(tokenStr, logPrefix)
+	if err != nil {
+		return nil, err
+	}
 
-		// Extract the kid from token header
-		kidRaw, ok := unsafeToken.Header["kid"]
-		if !ok {
-			log.Printf("%s Token missing 'kid' header", logPrefix)
-			http.Error(w, "token missing 'kid' header", http.StatusUnauthorized)
-			return
-		}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		log.Printf("%s Token has invalid claims format", logPrefix)
+		return nil, fmt.Errorf("%w: invalid claims format", ErrInvalidToken)
+	}
+	log.Printf("%s Checking token claims and permissions", logPrefix)
 
-		// Convert kid to string format
-		var keyID string
-		switch kid := kidRaw.(type) {
-		case string:
-			keyID = kid
-		case float64:
-			keyID = fmt.Sprintf("%v", kid)
-		case int64:
-			keyID = fmt.Sprintf("%d", kid)
-		case int:
-			keyID = fmt.Sprintf("%d", kid)
-		default:
-			log.Printf("%s Invalid kid format in token: %T", logPrefix, kidRaw)
-			http.Error(w, "invalid kid format in token", http.StatusUnauthorized)
-			return
-		}
-		log.Printf("%s Extracted key ID (kid): %s", logPrefix, keyID)
+	// Log claim information for debugging (be careful with sensitive info)
+	if sub, ok := claims["sub"].(string); ok {
+		log.Printf("%s Token subject: %s", logPrefix, sub)
+	}
+	if iss, ok := claims["iss"].(string); ok {
+		log.Printf("%s Token issuer: %s", logPrefix, iss)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		expTime := time.Unix(int64(exp), 0)
+		log.Printf("%s Token expires: %s (in %v)", logPrefix, expTime, time.Until(expTime))
+	}
 
-		// Get the public key for this kid
-		log.Printf("%s Retrieving public key for kid: %s", logPrefix, keyID)
-		publicKey, err := v.getKey(keyID)
-		if err != nil {
-			log.Printf("%s Failed to retrieve key: %v", logPrefix, err)
-			http.Error(w, fmt.Sprintf("key not found: %v", err), http.StatusUnauthorized)
-			return
-		}
-		log.Printf("%s Public key retrieved successfully", logPrefix)
-
-		// Validate token with the correct public key
-		log.Printf("%s Validating token signature", logPrefix)
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-				alg, _ := token.Header["alg"].(string)
-				log.Printf("%s Unexpected signing method: %v, expected RSA", logPrefix, alg)
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return publicKey, nil
-		})
+	// Check the token was issued for this proxy
+	if err := checkAudience(claims, v.audiences, v.requireAudience); err != nil {
+		log.Printf("%s Audience check failed: %v", logPrefix, err)
+		return nil, err
+	}
 
-		if err != nil {
-			log.Printf("%s Token validation failed: %v", logPrefix, err)
-			http.Error(w, fmt.Sprintf("%s: %v", ErrInvalidToken.Error(), err), http.StatusUnauthorized)
-			return
+	// Check required permissions
+	for _, perm := range v.permissions(r) {
+		if !perm.Check(claims) {
+			log.Printf("%s Permission denied: missing %s", logPrefix, string(perm))
+			return nil, fmt.Errorf("missing required permission: %s", perm)
 		}
+		if !source.allows(perm) {
+			log.Printf("%s Permission denied: issuer %q may not grant %s", logPrefix, source.Name, string(perm))
+			return nil, fmt.Errorf("issuer may not grant permission: %s", perm)
+		}
+	}
+	log.Printf("%s All required permissions granted", logPrefix)
 
-		if !token.Valid {
-			log.Printf("%s Token is invalid", logPrefix)
-			http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
-			return
+	// Sender constrained tokens are useless without a proof of possession
+	if jkt := ConfirmationThumbprint(claims); jkt != "" {
+		if err := verifyDPoPProof(r, tokenStr, jkt, v.proofReplay); err != nil {
+			log.Printf("%s DPoP proof rejected: %v", logPrefix, err)
+			return nil, err
 		}
-		log.Printf("%s Token signature validated successfully", logPrefix)
+		log.Printf("%s DPoP proof verified", logPrefix)
+	} else if parts[0] == dpopScheme {
+		log.Printf("%s DPoP scheme used with an unbound token", logPrefix)
+		return nil, fmt.Errorf("%w: token is not DPoP bound", ErrInvalidDPoPProof)
+	}
 
-		// Check permissions
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			log.Printf("%s Checking token claims and permissions", logPrefix)
+	// Count the use only once the token is known to be valid for this request
+	if err := checkTokenUses(claims, v.maxTokenUses, v.tokenUses); err != nil {
+		log.Printf("%s Token use rejected: %v", logPrefix, err)
+		return nil, err
+	}
 
-			// Log claim information for debugging (be careful with sensitive info)
-			if sub, ok := claims["sub"].(string); ok {
-				log.Printf("%s Token subject: %s", logPrefix, sub)
-			}
-			if iss, ok := claims["iss"].(string); ok {
-				log.Printf("%s Token issuer: %s", logPrefix, iss)
-			}
-			if exp, ok := claims["exp"].(float64); ok {
-				expTime := time.Unix(int64(exp), 0)
-				log.Printf("%s Token expires: %s (in %v)", logPrefix, expTime, time.Until(expTime))
-			}
+	// Add the claims to the context and continue
+	log.Printf("%s Authentication successful in %v", logPrefix, time.Since(startTime))
+	return withClaims(r.Context(), claimsFromJWT(claims, source.Permissions)), nil
+}
 
-			// Check required permissions
-			for _, perm := range v.permissions {
-				if !perm.Check(claims) {
-					log.Printf("%s Permission denied: missing %s", logPrefix, string(perm))
-					http.Error(w, "missing required permission: "+string(perm), http.StatusUnauthorized)
-					return
-				}
-			}
-			log.Printf("%s All required permissions granted", logPrefix)
-		} else {
-			log.Printf("%s Token has invalid claims format", logPrefix)
+// ValidateToken verifies the signature, expiry and issuer of a token.
+// Request specific checks like audience, permissions and proofs of possession are left to the caller.
+func (v *MultiKeyJWTValidator) ValidateToken(tokenStr string) (*jwt.Token, error) {
+	token, _, err := v.verifyToken(tokenStr, "JWT-Validate:")
+	return token, err
+}
+
+// verifyToken checks a token was signed by a trusted issuer and returns it with the key source that verified it
+func (v *MultiKeyJWTValidator) verifyToken(tokenStr string, logPrefix string) (*jwt.Token, *keySource, error) {
+	// Parse token without validation to extract the kid
+	log.Printf("%s Parsing token to extract key ID (kid)", logPrefix)
+	parser := jwt.NewParser()
+	unsafeToken, _, err := parser.ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		log.Printf("%s Error parsing token: %v", logPrefix, err)
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	// Extract the kid from token header
+	kidRaw, ok := unsafeToken.Header["kid"]
+	if !ok {
+		log.Printf("%s Token missing 'kid' header", logPrefix)
+		return nil, nil, fmt.Errorf("token missing 'kid' header")
+	}
+
+	// Convert kid to string format
+	var keyID string
+	switch kid := kidRaw.(type) {
+	case string:
+		keyID = kid
+	case float64:
+		keyID = fmt.Sprintf("%v", kid)
+	case int64:
+		keyID = fmt.Sprintf("%d", kid)
+	case int:
+		keyID = fmt.Sprintf("%d", kid)
+	default:
+		log.Printf("%s Invalid kid format in token: %T", logPrefix, kidRaw)
+		return nil, nil, fmt.Errorf("invalid kid format in token")
+	}
+	log.Printf("%s Extracted key ID (kid): %s", logPrefix, keyID)
+
+	// Select the key source of the issuer the token claims to be from
+	unverifiedIssuer, _ := unsafeToken.Claims.GetIssuer()
+	source, err := v.sourceFor(unverifiedIssuer)
+	if err != nil {
+		log.Printf("%s %v", logPrefix, err)
+		return nil, nil, err
+	}
+
+	// Get the public key for this kid
+	log.Printf("%s Retrieving public key for kid: %s", logPrefix, keyID)
+	publicKey, err := source.getKey(keyID)
+	if err != nil {
+		log.Printf("%s Failed to retrieve key: %v", logPrefix, err)
+		return nil, nil, fmt.Errorf("key not found: %v", err)
+	}
+	log.Printf("%s Public key retrieved successfully", logPrefix)
+
+	// Validate token with the correct public key
+	log.Printf("%s Validating token signature", logPrefix)
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		// Only accept the algorithm the key was published with
+		if token.Method.Alg() != publicKey.Algorithm {
+			log.Printf("%s Unexpected signing method: %v, expected %s", logPrefix, token.Method.Alg(), publicKey.Algorithm)
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
+		return publicKey.Key, nil
+	}, jwt.WithValidMethods([]string{publicKey.Algorithm}))
 
-		// Add the token to the context and continue
-		log.Printf("%s Authentication successful in %v", logPrefix, time.Since(startTime))
-		ctx := context.WithValue(r.Context(), "token", token)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	if err != nil {
+		log.Printf("%s Token validation failed: %v", logPrefix, err)
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if !token.Valid {
+		log.Printf("%s Token is invalid", logPrefix)
+		return nil, nil, ErrInvalidToken
+	}
+	log.Printf("%s Token signature validated successfully", logPrefix)
+
+	// The issuer is signed now, it must still be the one whose key validated the token
+	if iss, _ := token.Claims.GetIssuer(); source.Name != "" && iss != source.Name {
+		log.Printf("%s Issuer %q does not match key source %q", logPrefix, iss, source.Name)
+		return nil, nil, fmt.Errorf("%w: issuer mismatch", ErrInvalidToken)
+	}
+
+	return token, source, nil
 }
@@ -5,24 +5,28 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 // Mock implementation of KeyProvider for testing
 type mockKeyProvider struct {
-	keys      map[string]*rsa.PublicKey
+	keys      map[string]PublicKey
 	err       error
 	callCount int
 }
 
-func (m *mockKeyProvider) PublicKeys() (map[string]*rsa.PublicKey, error) {
+func (m *mockKeyProvider) PublicKeys() (map[string]PublicKey, error) {
 	m.callCount++
 	return m.keys, m.err
 }
@@ -40,14 +44,14 @@ func TestMultiKeyJWTValidator(t *testing.T) {
 	}
 	// Create mock key provider
 	mockProvider := &mockKeyProvider{
-		keys: map[string]*rsa.PublicKey{
-			"1": &key1.PublicKey,
-			"2": &key2.PublicKey,
+		keys: map[string]PublicKey{
+			"1": {Algorithm: AlgorithmRS256, Key: &key1.PublicKey},
+			"2": {Algorithm: AlgorithmRS256, Key: &key2.PublicKey},
 		},
 	}
 
 	// Create validator
-	validator := NewMultiKeyJWTValidator(mockProvider, []Permission{PERMISSION_CONNECT_TCP})
+	validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP))
 	tests := []struct {
 		name          string
 		keyID         string
@@ -129,7 +133,7 @@ func TestMultiKeyJWTValidatorProviderError(t *testing.T) {
 	}
 
 	// Create validator
-	validator := NewMultiKeyJWTValidator(mockProvider, []Permission{PERMISSION_CONNECT_TCP})
+	validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP))
 
 	// Generate a test key
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -167,3 +171,426 @@ func TestMultiKeyJWTValidatorProviderError(t *testing.T) {
 		t.Errorf("Expected status 401 but got %d", recorder.Code)
 	}
 }
+
+func TestMultiKeyJWTValidatorKeyRemoved(t *testing.T) {
+	revokedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keys := map[string]PublicKey{
+		"revoked": {Algorithm: AlgorithmES256, Key: &revokedKey.PublicKey},
+		"other":   {Algorithm: AlgorithmES256, Key: &otherKey.PublicKey},
+	}
+	sign := func(kid string, key *ecdsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"connect-tcp": true})
+		token.Header["kid"] = kid
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+		return tokenString
+	}
+	revokedToken := sign("revoked", revokedKey)
+	otherToken := sign("other", otherKey)
+
+	t.Run("Cache expires", func(t *testing.T) {
+		mockProvider := &mockKeyProvider{keys: keys}
+		validator := NewMultiKeyJWTValidator(mockProvider, nil, WithKeyCacheTTL(50*time.Millisecond))
+		if _, err := validator.ValidateToken(revokedToken); err != nil {
+			t.Fatalf("Expected the token to validate before revocation: %v", err)
+		}
+
+		mockProvider.keys = map[string]PublicKey{"other": keys["other"]}
+		if _, err := validator.ValidateToken(revokedToken); err != nil {
+			t.Errorf("Expected the cached key to be used until the cache expires: %v", err)
+		}
+		time.Sleep(60 * time.Millisecond)
+		if _, err := validator.ValidateToken(revokedToken); err == nil {
+			t.Errorf("Expected a token signed with a removed key to fail once the cache expired")
+		}
+
+		// A briefly unavailable provider does not stop tokens of keys in the last key set
+		time.Sleep(60 * time.Millisecond)
+		mockProvider.err = errors.New("provider error")
+		if _, err := validator.ValidateToken(otherToken); err != nil {
+			t.Errorf("Expected the expired cache to be used while the provider fails: %v", err)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if _, err := validator.ValidateToken(otherToken); err == nil {
+			t.Errorf("Expected the cache not to be used three TTLs after the last fetch")
+		}
+	})
+
+	t.Run("Expired key not used from stale cache", func(t *testing.T) {
+		mockProvider := &mockKeyProvider{keys: map[string]PublicKey{
+			"other": {Algorithm: AlgorithmES256, Key: &otherKey.PublicKey, ExpiresAt: time.Now().Add(30 * time.Millisecond)},
+		}}
+		validator := NewMultiKeyJWTValidator(mockProvider, nil, WithKeyCacheTTL(20*time.Millisecond))
+		if _, err := validator.ValidateToken(otherToken); err != nil {
+			t.Fatalf("Expected the token to validate: %v", err)
+		}
+
+		mockProvider.err = errors.New("provider error")
+		time.Sleep(40 * time.Millisecond)
+		if _, err := validator.ValidateToken(otherToken); err == nil {
+			t.Errorf("Expected an expired key not to be used while the provider fails")
+		}
+	})
+
+	t.Run("Expired explicitly", func(t *testing.T) {
+		mockProvider := &mockKeyProvider{keys: keys}
+		validator := NewMultiKeyJWTValidator(mockProvider, nil)
+		if _, err := validator.ValidateToken(revokedToken); err != nil {
+			t.Fatalf("Expected the token to validate before revocation: %v", err)
+		}
+
+		mockProvider.keys = map[string]PublicKey{"other": keys["other"]}
+		validator.ExpireKeys()
+		if _, err := validator.ValidateToken(revokedToken); err == nil {
+			t.Errorf("Expected a token signed with a removed key to fail after expiring the keys")
+		}
+		if _, err := validator.ValidateToken(otherToken); err != nil {
+			t.Errorf("Expected tokens of the remaining key to validate: %v", err)
+		}
+	})
+}
+
+func TestMultiKeyJWTValidatorAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %v", err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+
+	mockProvider := &mockKeyProvider{
+		keys: map[string]PublicKey{
+			"rsa": {Algorithm: AlgorithmRS256, Key: &rsaKey.PublicKey},
+			"ec":  {Algorithm: AlgorithmES256, Key: &ecKey.PublicKey},
+			"ed":  {Algorithm: AlgorithmEdDSA, Key: edPub},
+		},
+	}
+	validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP))
+
+	tests := []struct {
+		name          string
+		keyID         string
+		method        jwt.SigningMethod
+		key           interface{}
+		expectSuccess bool
+	}{
+		{"RS256 token", "rsa", jwt.SigningMethodRS256, rsaKey, true},
+		{"ES256 token", "ec", jwt.SigningMethodES256, ecKey, true},
+		{"EdDSA token", "ed", jwt.SigningMethodEdDSA, edKey, true},
+		{"ES256 token claiming an EdDSA key", "ed", jwt.SigningMethodES256, ecKey, false},
+		{"RS384 token with RS256 key", "rsa", jwt.SigningMethodRS384, rsaKey, false},
+		{"HS256 token using RSA key material", "rsa", jwt.SigningMethodHS256, []byte("secret"), false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token := jwt.NewWithClaims(tc.method, jwt.MapClaims{"connect-tcp": true})
+			token.Header["kid"] = tc.keyID
+			tokenString, err := token.SignedString(tc.key)
+			if err != nil {
+				t.Fatalf("Failed to create token: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeader, authScheme+" "+tokenString)
+			recorder := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			validator.Middleware(handler).ServeHTTP(recorder, req)
+
+			if tc.expectSuccess && recorder.Code != http.StatusOK {
+				t.Errorf("Expected success but got status %d", recorder.Code)
+			} else if !tc.expectSuccess && recorder.Code == http.StatusOK {
+				t.Errorf("Expected failure but got success")
+			}
+		})
+	}
+}
+
+func TestMultiKeyJWTValidatorAudience(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	mockProvider := &mockKeyProvider{
+		keys: map[string]PublicKey{"1": {Algorithm: AlgorithmRS256, Key: &key.PublicKey}},
+	}
+	audiences := []string{"https://proxy-1.example.com", "eu-west"}
+
+	tests := []struct {
+		name            string
+		aud             interface{}
+		requireAudience bool
+		expectSuccess   bool
+	}{
+		{"Matching proxy URL", "https://proxy-1.example.com", false, true},
+		{"Matching fleet group", []string{"eu-west"}, false, true},
+		{"Other proxy", "https://proxy-2.example.com", false, false},
+		{"No audience allowed", nil, false, true},
+		{"No audience but required", nil, true, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP),
+				WithAudiences(audiences, tc.requireAudience))
+
+			claims := jwt.MapClaims{"connect-tcp": true}
+			if tc.aud != nil {
+				claims["aud"] = tc.aud
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = "1"
+			tokenString, err := token.SignedString(key)
+			if err != nil {
+				t.Fatalf("Failed to create token: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeader, authScheme+" "+tokenString)
+			recorder := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			validator.Middleware(handler).ServeHTTP(recorder, req)
+
+			if tc.expectSuccess && recorder.Code != http.StatusOK {
+				t.Errorf("Expected success but got status %d", recorder.Code)
+			} else if !tc.expectSuccess && recorder.Code == http.StatusOK {
+				t.Errorf("Expected failure but got success")
+			}
+		})
+	}
+}
+
+func TestMultiKeyJWTValidatorIssuers(t *testing.T) {
+	regionalKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	partnerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	validator := NewMultiKeyJWTValidator(nil, StaticPermissions(PERMISSION_CONNECT_TCP), WithIssuers(
+		Issuer{
+			Name: "control-eu",
+			Keys: &mockKeyProvider{keys: map[string]PublicKey{"eu-1": {Algorithm: AlgorithmRS256, Key: &regionalKey.PublicKey}}},
+		},
+		Issuer{
+			Name:        "partner",
+			Keys:        &mockKeyProvider{keys: map[string]PublicKey{"p-1": {Algorithm: AlgorithmES256, Key: &partnerKey.PublicKey}}},
+			Permissions: []Permission{PERMISSION_CONNECT_UDP},
+		},
+	))
+
+	tests := []struct {
+		name          string
+		issuer        string
+		keyID         string
+		method        jwt.SigningMethod
+		key           interface{}
+		expectSuccess bool
+	}{
+		{"Regional issuer", "control-eu", "eu-1", jwt.SigningMethodRS256, regionalKey, true},
+		{"Regional key claiming partner issuer", "partner", "eu-1", jwt.SigningMethodRS256, regionalKey, false},
+		{"Partner key claiming regional issuer", "control-eu", "p-1", jwt.SigningMethodES256, partnerKey, false},
+		{"Partner issuer lacking permission", "partner", "p-1", jwt.SigningMethodES256, partnerKey, false},
+		{"Unknown issuer", "somebody", "eu-1", jwt.SigningMethodRS256, regionalKey, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token := jwt.NewWithClaims(tc.method, jwt.MapClaims{"iss": tc.issuer, "connect-tcp": true})
+			token.Header["kid"] = tc.keyID
+			tokenString, err := token.SignedString(tc.key)
+			if err != nil {
+				t.Fatalf("Failed to create token: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeader, authScheme+" "+tokenString)
+			_, err = validator.Authenticate(req)
+
+			if tc.expectSuccess && err != nil {
+				t.Errorf("Expected success but got %v", err)
+			} else if !tc.expectSuccess && err == nil {
+				t.Errorf("Expected failure but got success")
+			}
+		})
+	}
+}
+
+func TestMultiKeyJWTValidatorTokenUses(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	mockProvider := &mockKeyProvider{
+		keys: map[string]PublicKey{"1": {Algorithm: AlgorithmRS256, Key: &key.PublicKey}},
+	}
+
+	createToken := func(jti interface{}, maxUses int) string {
+		claims := jwt.MapClaims{"connect-tcp": true, "exp": time.Now().Add(time.Hour).Unix()}
+		if jti != nil {
+			claims["jti"] = jti
+		}
+		if maxUses > 0 {
+			claims["constraints"] = map[string]int{"maxUses": maxUses}
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "1"
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name          string
+		maxUses       int
+		token         string
+		expectedUses  int
+		expectedError error
+	}{
+		{"Unlimited", 0, createToken(int64(1), 0), 5, nil},
+		{"Single use token", 0, createToken(int64(2), 1), 1, ErrTokenReused},
+		{"Single use string jti", 0, createToken("abc", 1), 1, ErrTokenReused},
+		{"Configured limit", 3, createToken(int64(3), 0), 3, ErrTokenReused},
+		{"Token limit lower than configured", 3, createToken(int64(4), 2), 2, ErrTokenReused},
+		{"Single use without jti", 0, createToken(nil, 1), 0, ErrInvalidToken},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP),
+				WithReplayDetection(tc.maxUses))
+
+			authenticate := func() error {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set(authHeader, authScheme+" "+tc.token)
+				_, err := validator.Authenticate(req)
+				return err
+			}
+
+			for i := 0; i < tc.expectedUses; i++ {
+				if err := authenticate(); err != nil {
+					t.Fatalf("Use %d failed: %v", i+1, err)
+				}
+			}
+			if tc.expectedError != nil {
+				if err := authenticate(); !errors.Is(err, tc.expectedError) {
+					t.Errorf("Expected %v, got %v", tc.expectedError, err)
+				}
+			}
+		})
+	}
+
+	t.Run("Full replay cache", func(t *testing.T) {
+		validator := NewMultiKeyJWTValidator(mockProvider, StaticPermissions(PERMISSION_CONNECT_TCP),
+			WithReplayDetection(1))
+		validator.tokenUses = NewReplayCache(1)
+
+		serve := func(token string) int {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(authHeader, authScheme+" "+token)
+			recorder := httptest.NewRecorder()
+			validator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		if code := serve(createToken("first", 0)); code != http.StatusOK {
+			t.Fatalf("Expected the first token to be accepted, got %d", code)
+		}
+		// Forgetting the first token would let it be used again, so the next one waits
+		if code := serve(createToken("second", 0)); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 while the cache is full, got %d", code)
+		}
+		if code := serve(createToken("first", 0)); code != http.StatusUnauthorized {
+			t.Errorf("Expected the first token to stay used up, got %d", code)
+		}
+	})
+}
+
+func TestMultiKeyJWTValidatorClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	mockProvider := &mockKeyProvider{
+		keys: map[string]PublicKey{"1": {Algorithm: AlgorithmRS256, Key: &key.PublicKey}},
+	}
+	validator := NewMultiKeyJWTValidator(mockProvider, ProtocolPermissions)
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":         "user-1",
+		"iss":         "test-issuer",
+		"aud":         "eu-west",
+		"exp":         expiresAt.Unix(),
+		"jti":         "abc",
+		"connect-tcp": true,
+		"constraints": map[string]int{"maxUses": 5},
+	})
+	token.Header["kid"] = "1"
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	req.Header.Set(authHeader, authScheme+" "+tokenString)
+	ctx, err := validator.Authenticate(req)
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		t.Fatal("Expected claims in context")
+	}
+	if claims.Subject != "user-1" || claims.Issuer != "test-issuer" || claims.TokenID != "abc" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if len(claims.Audience) != 1 || claims.Audience[0] != "eu-west" {
+		t.Errorf("Unexpected audience %v", claims.Audience)
+	}
+	if !claims.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected expiry %v, got %v", expiresAt, claims.ExpiresAt)
+	}
+	if claims.Constraints.MaxUses != 5 {
+		t.Errorf("Expected maxUses 5, got %d", claims.Constraints.MaxUses)
+	}
+	if !claims.HasPermission(PERMISSION_CONNECT_TCP) || claims.HasPermission(PERMISSION_CONNECT_UDP) {
+		t.Errorf("Unexpected permissions %v", claims.Permissions)
+	}
+
+	// The same token does not grant a connect-udp request
+	req = httptest.NewRequest(http.MethodConnect, "https://proxy.example.com/.well-known/masque/udp/example.com/53/", nil)
+	req.Header.Set(":protocol", "connect-udp")
+	req.Header.Set(authHeader, authScheme+" "+tokenString)
+	if _, err := validator.Authenticate(req); err == nil {
+		t.Error("Expected connect-udp request to be rejected")
+	}
+}
@@ -4,17 +4,77 @@
 
 package auth
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"net/http"
+	"strings"
 
-// PermissionFunc defines a function that checks a JWT claim set for a permission.
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Permission is a hierarchical scope such as "proxy:connect-tcp" or "admin:servers:write".
+// Segments are separated by colons, a trailing "*" segment grants everything below it.
 type Permission string
 
 const (
-	PERMISSION_CONNECT_TCP Permission = "connect-tcp"
-	PERMISSION_CONNECT_UDP Permission = "connect-udp"
-	PERMISSION_CONNECT_IP  Permission = "connect-ip"
+	PERMISSION_CONNECT_TCP Permission = "proxy:connect-tcp"
+	PERMISSION_CONNECT_UDP Permission = "proxy:connect-udp"
+	PERMISSION_CONNECT_IP  Permission = "proxy:connect-ip"
+	PERMISSION_PROXY_ALL   Permission = "proxy:*"
+
+	PERMISSION_ADMIN_SERVERS_READ  Permission = "admin:servers:read"
+	PERMISSION_ADMIN_SERVERS_WRITE Permission = "admin:servers:write"
+	PERMISSION_ADMIN_TOKENS_WRITE  Permission = "admin:tokens:write"
+	PERMISSION_ADMIN_ALL           Permission = "admin:*"
 )
 
+// scopeClaim is the JWT claim carrying the space separated permissions of a token
+const scopeClaim = "scope"
+
+// legacyNamespace holds the permissions that were once encoded as boolean claims named after their last segment
+const legacyNamespace = "proxy:"
+
+// legacyPermissions are the permissions old tokens can grant with boolean claims
+var legacyPermissions = []Permission{PERMISSION_CONNECT_TCP, PERMISSION_CONNECT_UDP, PERMISSION_CONNECT_IP}
+
+// PermissionSelector decides which permissions a request requires
+type PermissionSelector func(r *http.Request) []Permission
+
+// StaticPermissions requires the same permissions for every request
+func StaticPermissions(permissions ...Permission) PermissionSelector {
+	return func(r *http.Request) []Permission {
+		return permissions
+	}
+}
+
+// ProtocolPermissions requires the permission for the tunnel protocol a request asks for:
+// proxy:connect-tcp for a classic CONNECT, proxy:connect-udp (RFC 9298) or proxy:connect-ip (RFC 9484)
+// for extended CONNECT or an HTTP/1.1 upgrade.
+func ProtocolPermissions(r *http.Request) []Permission {
+	protocol := requestedProtocol(r)
+	if protocol == "" {
+		return []Permission{PERMISSION_CONNECT_TCP}
+	}
+	// Permissions are named after their protocol, unknown protocols are only granted by wildcards
+	return []Permission{Permission(legacyNamespace + protocol)}
+}
+
+// requestedProtocol returns the protocol of an extended CONNECT or upgrade request, "" for a classic CONNECT
+func requestedProtocol(r *http.Request) string {
+	// HTTP/2 passes the :protocol pseudo header on as a header
+	if protocol := r.Header.Get(":protocol"); protocol != "" {
+		return strings.ToLower(protocol)
+	}
+	if r.Method == http.MethodConnect {
+		// HTTP/3 reports the :protocol pseudo header as the request protocol
+		if r.ProtoMajor == 3 && !strings.HasPrefix(r.Proto, "HTTP/") {
+			return strings.ToLower(r.Proto)
+		}
+		return ""
+	}
+	// HTTP/1.1 asks for other protocols with an upgrade
+	return strings.ToLower(r.Header.Get("Upgrade"))
+}
+
 // GetPermissionStrings converts Permission constants to their string representations
 func GetPermissionStrings(permissions []Permission) []string {
 	result := make([]string, len(permissions))
@@ -24,17 +84,129 @@ func GetPermissionStrings(permissions []Permission) []string {
 	return result
 }
 
+// ParsePermission reads a permission from configuration, accepting legacy names like "connect-tcp"
+func ParsePermission(s string) Permission {
+	if !strings.Contains(s, ":") && s != "*" {
+		return Permission(legacyNamespace + s)
+	}
+	return Permission(s)
+}
+
+// ParseScope splits a space separated scope string into permissions
+func ParseScope(scope string) []Permission {
+	var permissions []Permission
+	for _, field := range strings.Fields(scope) {
+		permissions = append(permissions, Permission(field))
+	}
+	return permissions
+}
+
+// FormatScope joins permissions into a space separated scope string
+func FormatScope(permissions []Permission) string {
+	return strings.Join(GetPermissionStrings(permissions), " ")
+}
+
+// LegacyClaim returns the name of the boolean claim old tokens used for the permission, "" if there is none
+func (p Permission) LegacyClaim() string {
+	name, ok := strings.CutPrefix(string(p), legacyNamespace)
+	if !ok || strings.Contains(name, ":") || name == "*" {
+		return ""
+	}
+	return name
+}
+
+// Grants reports whether holding p grants the permission required, taking wildcards into account
+func (p Permission) Grants(required Permission) bool {
+	granted := strings.Split(string(p), ":")
+	wanted := strings.Split(string(required), ":")
+	for i, segment := range granted {
+		if segment == "*" && i == len(granted)-1 {
+			return len(wanted) > i
+		}
+		if i >= len(wanted) || segment != wanted[i] {
+			return false
+		}
+	}
+	return len(granted) == len(wanted)
+}
+
+// grantsAny reports whether any of the held permissions grants the required one
+func grantsAny(held []Permission, required Permission) bool {
+	for _, p := range held {
+		if p.Grants(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports whether the claims grant the permission, by scope or by a legacy boolean claim
 func (p *Permission) Check(claims jwt.MapClaims) bool {
 	if claims == nil {
 		return false
 	}
-	if val, ok := claims[string(*p)]; ok {
-		if b, ok := val.(bool); ok {
-			return b
+	return grantsAny(scopeFromClaims(claims), *p) || legacyGranted(claims, *p)
+}
+
+// legacyGranted reports whether an old style boolean claim grants the permission
+func legacyGranted(claims jwt.MapClaims, p Permission) bool {
+	legacy := p.LegacyClaim()
+	if legacy == "" {
+		return false
+	}
+	switch val := claims[legacy].(type) {
+	case bool:
+		return val
+	case string:
+		return val == "true"
+	}
+	return false
+}
+
+// scopeFromClaims returns the permissions listed in the scope claim of a token
+func scopeFromClaims(claims jwt.MapClaims) []Permission {
+	var permissions []Permission
+	switch scope := claims[scopeClaim].(type) {
+	case string:
+		permissions = ParseScope(scope)
+	case []interface{}:
+		for _, s := range scope {
+			if s, ok := s.(string); ok {
+				permissions = append(permissions, Permission(s))
+			}
 		}
-		if s, ok := val.(string); ok {
-			return s == "true"
+	}
+	return permissions
+}
+
+// permissionsFromClaims returns the scope of a token with legacy boolean claims converted to permissions
+func permissionsFromClaims(claims jwt.MapClaims) []Permission {
+	permissions := scopeFromClaims(claims)
+	for _, legacy := range legacyPermissions {
+		if legacyGranted(claims, legacy) && !grantsAny(permissions, legacy) {
+			permissions = append(permissions, legacy)
 		}
 	}
-	return false
+	return permissions
+}
+
+// restrictPermissions limits held permissions to those below one of the allowed ones, nil allowed means no limit
+func restrictPermissions(held []Permission, allowed []Permission) []Permission {
+	if len(allowed) == 0 {
+		return held
+	}
+	var result []Permission
+	for _, p := range held {
+		if grantsAny(allowed, p) {
+			result = append(result, p)
+			continue
+		}
+		// A wildcard is narrowed to the allowed permissions it covers
+		for _, a := range allowed {
+			if p.Grants(a) {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
 }
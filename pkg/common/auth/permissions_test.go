@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestProtocolPermissions(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  func() *http.Request
+		expected []Permission
+	}{
+		{"Classic CONNECT", func() *http.Request {
+			return httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+		}, []Permission{PERMISSION_CONNECT_TCP}},
+		{"HTTP/2 extended CONNECT", func() *http.Request {
+			r := httptest.NewRequest(http.MethodConnect, "https://proxy.example.com/.well-known/masque/udp/example.com/53/", nil)
+			r.ProtoMajor = 2
+			r.Header.Set(":protocol", "connect-udp")
+			return r
+		}, []Permission{PERMISSION_CONNECT_UDP}},
+		{"HTTP/3 extended CONNECT", func() *http.Request {
+			r := httptest.NewRequest(http.MethodConnect, "https://proxy.example.com/.well-known/masque/ip/*/*/", nil)
+			r.Proto, r.ProtoMajor, r.ProtoMinor = "connect-ip", 3, 0
+			return r
+		}, []Permission{PERMISSION_CONNECT_IP}},
+		{"HTTP/3 classic CONNECT", func() *http.Request {
+			r := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+			r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/3.0", 3, 0
+			return r
+		}, []Permission{PERMISSION_CONNECT_TCP}},
+		{"HTTP/1.1 upgrade", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/.well-known/masque/udp/example.com/53/", nil)
+			r.Header.Set("Upgrade", "connect-udp")
+			return r
+		}, []Permission{PERMISSION_CONNECT_UDP}},
+		{"Unknown protocol", func() *http.Request {
+			r := httptest.NewRequest(http.MethodConnect, "https://proxy.example.com/chat", nil)
+			r.Header.Set(":protocol", "websocket")
+			return r
+		}, []Permission{Permission("proxy:websocket")}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ProtocolPermissions(tc.request()); !slices.Equal(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestPermissionGrants(t *testing.T) {
+	tests := []struct {
+		held     Permission
+		required Permission
+		expected bool
+	}{
+		{PERMISSION_CONNECT_TCP, PERMISSION_CONNECT_TCP, true},
+		{PERMISSION_CONNECT_TCP, PERMISSION_CONNECT_UDP, false},
+		{PERMISSION_PROXY_ALL, PERMISSION_CONNECT_UDP, true},
+		{PERMISSION_PROXY_ALL, PERMISSION_ADMIN_SERVERS_READ, false},
+		{PERMISSION_ADMIN_ALL, PERMISSION_ADMIN_SERVERS_WRITE, true},
+		{"admin:servers:*", PERMISSION_ADMIN_SERVERS_READ, true},
+		{"admin:servers:*", PERMISSION_ADMIN_TOKENS_WRITE, false},
+		{"admin:servers", PERMISSION_ADMIN_SERVERS_READ, false},
+		{"*", PERMISSION_ADMIN_SERVERS_READ, true},
+		{"proxy:*", "proxy", false},
+		{PERMISSION_ADMIN_SERVERS_READ, "admin:servers", false},
+	}
+
+	for _, tc := range tests {
+		if got := tc.held.Grants(tc.required); got != tc.expected {
+			t.Errorf("%s grants %s: expected %v, got %v", tc.held, tc.required, tc.expected, got)
+		}
+	}
+}
+
+func TestPermissionCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		expected bool
+	}{
+		{"Scope", jwt.MapClaims{"scope": "proxy:connect-udp proxy:connect-tcp"}, true},
+		{"Wildcard scope", jwt.MapClaims{"scope": "proxy:*"}, true},
+		{"Scope array", jwt.MapClaims{"scope": []interface{}{"proxy:connect-tcp"}}, true},
+		{"Other scope", jwt.MapClaims{"scope": "proxy:connect-udp"}, false},
+		{"Legacy claim", jwt.MapClaims{"connect-tcp": true}, true},
+		{"Legacy claim denied", jwt.MapClaims{"connect-tcp": false}, false},
+		{"No permissions", jwt.MapClaims{}, false},
+	}
+
+	perm := PERMISSION_CONNECT_TCP
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := perm.Check(tc.claims); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRestrictPermissions(t *testing.T) {
+	held := []Permission{PERMISSION_PROXY_ALL, PERMISSION_ADMIN_SERVERS_READ}
+	allowed := []Permission{PERMISSION_CONNECT_TCP, PERMISSION_ADMIN_ALL}
+
+	got := restrictPermissions(held, allowed)
+	expected := []Permission{PERMISSION_CONNECT_TCP, PERMISSION_ADMIN_SERVERS_READ}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if got := restrictPermissions(held, nil); !slices.Equal(got, held) {
+		t.Errorf("Expected no restriction, got %v", got)
+	}
+}
@@ -0,0 +1,274 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common/privacypass"
+)
+
+const (
+	privateTokenScheme = "PrivateToken"
+	// privateTokenMaxNonces bounds the spent token nonces remembered for double-spend detection
+	privateTokenMaxNonces = 1000000
+	// privateTokenDefaultTTL is how long nonces of keys without an expiry are remembered
+	privateTokenDefaultTTL = 30 * 24 * time.Hour
+	// privateTokenRefetchInterval limits directory fetches triggered by unknown keys
+	privateTokenRefetchInterval = time.Minute
+)
+
+// ErrTokenSpent is returned when a Privacy Pass token is redeemed a second time
+var ErrTokenSpent = errors.New("token already redeemed")
+
+// PrivacyPassConfig configures a PrivacyPassAuthenticator
+type PrivacyPassConfig struct {
+	// DirectoryURL of the issuer directory listing the keys tokens are signed with
+	DirectoryURL string
+	// IssuerName and OriginInfo form the token challenge, the host names of the issuer and of this proxy
+	IssuerName string
+	OriginInfo string
+	// Permissions granted to requests redeeming a token
+	Permissions []Permission
+	// Required selects the permissions a request requires
+	Required PermissionSelector
+}
+
+// PrivacyPassAuthenticator redeems Privacy Pass tokens (RFC 9577, token type 0x0002) presented with
+// "Proxy-Authorization: PrivateToken token=<token>". The tokens carry nothing that links them to the user
+// they were issued to, every token can be redeemed once.
+type PrivacyPassAuthenticator struct {
+	cfg       PrivacyPassConfig
+	challenge privacypass.TokenChallenge
+	client    *http.Client
+	spent     *ReplayCache
+
+	mutex     sync.Mutex
+	keys      map[[privacypass.Nid]byte]privacyPassKey
+	newest    string
+	fetchedAt time.Time
+}
+
+// privacyPassKey is an issuer key taken from the directory
+type privacyPassKey struct {
+	key       *rsa.PublicKey
+	expiresAt time.Time
+}
+
+// NewPrivacyPassAuthenticator creates an authenticator redeeming tokens of the issuer in cfg
+func NewPrivacyPassAuthenticator(cfg PrivacyPassConfig) *PrivacyPassAuthenticator {
+	log.Printf("Initializing PrivacyPassAuthenticator for issuer %s at %s", cfg.IssuerName, cfg.DirectoryURL)
+	if cfg.Required == nil {
+		cfg.Required = StaticPermissions()
+	}
+	return &PrivacyPassAuthenticator{
+		cfg: cfg,
+		challenge: privacypass.TokenChallenge{
+			TokenType:  privacypass.TokenTypeBlindRSA,
+			IssuerName: cfg.IssuerName,
+			OriginInfo: cfg.OriginInfo,
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+		spent:  NewReplayCache(privateTokenMaxNonces),
+		keys:   make(map[[privacypass.Nid]byte]privacyPassKey),
+	}
+}
+
+// Name identifies the authenticator within an authenticator chain
+func (a *PrivacyPassAuthenticator) Name() string {
+	return "privacypass"
+}
+
+// Middleware implements HTTP middleware for token redemption
+func (a *PrivacyPassAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := a.Authenticate(r)
+		if err != nil {
+			if challenge := a.Challenge(); challenge != "" {
+				w.Header().Add(challengeHeader, challenge)
+			}
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Challenge asks clients for a token of the newest issuer key
+func (a *PrivacyPassAuthenticator) Challenge() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.newest == "" {
+		a.refreshLocked()
+	}
+	if a.newest == "" {
+		return ""
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(a.challenge.Marshal())
+	return fmt.Sprintf(`%s challenge="%s", token-key="%s"`, privateTokenScheme, challenge, a.newest)
+}
+
+// Authenticate redeems the token presented in the request
+func (a *PrivacyPassAuthenticator) Authenticate(r *http.Request) (context.Context, error) {
+	authHeader := r.Header.Get(authHeader)
+	if authHeader == "" {
+		return nil, ErrNoAuthHeader
+	}
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || parts[0] != privateTokenScheme {
+		return nil, ErrInvalidScheme
+	}
+
+	encoded, ok := authParam(parts[1], "token")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing token parameter", ErrInvalidToken)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: token is not base64url encoded", ErrInvalidToken)
+	}
+	token, err := privacypass.UnmarshalToken(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if token.ChallengeDigest != a.challenge.Digest() {
+		return nil, fmt.Errorf("%w: token was issued for another challenge", ErrInvalidToken)
+	}
+
+	key, ok := a.key(token.TokenKeyID)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown token key", ErrInvalidToken)
+	}
+	if err := privacypass.Verify(key.key, token); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	for _, perm := range a.cfg.Required(r) {
+		if !grantsAny(a.cfg.Permissions, perm) {
+			return nil, fmt.Errorf("missing required permission: %s", perm)
+		}
+	}
+
+	// Only spend the token once it is known to be valid for this request
+	expiresAt := key.expiresAt
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(privateTokenDefaultTTL)
+	}
+	uses, err := a.spent.Use(hex.EncodeToString(token.TokenKeyID[:])+hex.EncodeToString(token.Nonce[:]), expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if uses > 1 {
+		return nil, ErrTokenSpent
+	}
+
+	return withClaims(r.Context(), &Claims{
+		Issuer:      a.cfg.IssuerName,
+		ExpiresAt:   key.expiresAt,
+		Permissions: a.cfg.Permissions,
+	}), nil
+}
+
+// key returns an unexpired issuer key by its ID, fetching the directory again for unknown keys
+func (a *PrivacyPassAuthenticator) key(id [privacypass.Nid]byte) (privacyPassKey, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	key, ok := a.keys[id]
+	if !ok {
+		a.refreshLocked()
+		key, ok = a.keys[id]
+	}
+	if !ok || (!key.expiresAt.IsZero() && time.Now().After(key.expiresAt)) {
+		return privacyPassKey{}, false
+	}
+	return key, true
+}
+
+// refreshLocked fetches the issuer directory, at most once per refetch interval
+func (a *PrivacyPassAuthenticator) refreshLocked() {
+	if time.Since(a.fetchedAt) < privateTokenRefetchInterval {
+		return
+	}
+	a.fetchedAt = time.Now()
+
+	directory, err := a.fetchDirectory()
+	if err != nil {
+		log.Printf("PrivacyPass: failed to fetch issuer directory: %v", err)
+		return
+	}
+
+	keys := make(map[[privacypass.Nid]byte]privacyPassKey)
+	newest := ""
+	var newestNotBefore int64
+	for _, entry := range directory.TokenKeys {
+		if entry.TokenType != privacypass.TokenTypeBlindRSA {
+			continue
+		}
+		der, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(entry.TokenKey, "="))
+		if err != nil {
+			continue
+		}
+		pub, err := privacypass.ParsePublicKey(der)
+		if err != nil {
+			log.Printf("PrivacyPass: skipping invalid issuer key: %v", err)
+			continue
+		}
+		id, err := privacypass.TokenKeyID(pub)
+		if err != nil {
+			continue
+		}
+		key := privacyPassKey{key: pub}
+		if entry.ExpiresAt > 0 {
+			key.expiresAt = time.Unix(entry.ExpiresAt, 0)
+		}
+		keys[id] = key
+		if newest == "" || entry.NotBefore > newestNotBefore {
+			newest, newestNotBefore = entry.TokenKey, entry.NotBefore
+		}
+	}
+	log.Printf("PrivacyPass: loaded %d issuer keys", len(keys))
+	a.keys = keys
+	a.newest = newest
+}
+
+// fetchDirectory retrieves the issuer directory
+func (a *PrivacyPassAuthenticator) fetchDirectory() (*privacypass.Directory, error) {
+	resp, err := a.client.Get(a.cfg.DirectoryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var directory privacypass.Directory
+	if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil {
+		return nil, fmt.Errorf("failed to decode issuer directory: %w", err)
+	}
+	return &directory, nil
+}
+
+// authParam returns the value of a parameter of an authorization header, e.g. token in `token="abc"`
+func authParam(params string, name string) (string, bool) {
+	for _, param := range strings.Split(params, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.Trim(strings.TrimSpace(value), `"`), true
+		}
+	}
+	return "", false
+}
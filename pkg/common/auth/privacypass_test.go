@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strseb/zdvv/pkg/common/privacypass"
+)
+
+// issuePrivateToken runs the issuance protocol against key for the given challenge
+func issuePrivateToken(t *testing.T, key *rsa.PrivateKey, challenge privacypass.TokenChallenge) string {
+	t.Helper()
+	req, state, err := privacypass.NewTokenRequest(&key.PublicKey, &challenge)
+	if err != nil {
+		t.Fatalf("Failed to create token request: %v", err)
+	}
+	blindSig, err := privacypass.BlindSign(key, req)
+	if err != nil {
+		t.Fatalf("Failed to sign token request: %v", err)
+	}
+	token, err := state.Finalize(blindSig)
+	if err != nil {
+		t.Fatalf("Failed to finalize token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token.Marshal())
+}
+
+func TestPrivacyPassAuthenticator(t *testing.T) {
+	issuerKey, err := privacypass.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := privacypass.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := privacypass.MarshalPublicKey(&issuerKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	tokenKey := base64.RawURLEncoding.EncodeToString(der)
+
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", privacypass.DirectoryMediaType)
+		json.NewEncoder(w).Encode(privacypass.Directory{
+			IssuerRequestURI: "/api/v1/private-token",
+			TokenKeys: []privacypass.DirectoryKey{{
+				TokenType: privacypass.TokenTypeBlindRSA,
+				TokenKey:  tokenKey,
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			}},
+		})
+	}))
+	defer directory.Close()
+
+	authenticator := NewPrivacyPassAuthenticator(PrivacyPassConfig{
+		DirectoryURL: directory.URL,
+		IssuerName:   "issuer.example.com",
+		OriginInfo:   "proxy.example.com",
+		Permissions:  []Permission{PERMISSION_CONNECT_TCP},
+		Required:     ProtocolPermissions,
+	})
+	challenge := privacypass.TokenChallenge{
+		TokenType:  privacypass.TokenTypeBlindRSA,
+		IssuerName: "issuer.example.com",
+		OriginInfo: "proxy.example.com",
+	}
+	otherOrigin := challenge
+	otherOrigin.OriginInfo = "other.example.com"
+
+	valid := issuePrivateToken(t, issuerKey, challenge)
+	tests := []struct {
+		name          string
+		header        string
+		protocol      string
+		expectedError error
+	}{
+		{"Valid token", "PrivateToken token=" + valid, "", nil},
+		{"Double spend", "PrivateToken token=" + valid, "", ErrTokenSpent},
+		{"Quoted token", `PrivateToken token="` + issuePrivateToken(t, issuerKey, challenge) + `"`, "", nil},
+		{"Other origin", "PrivateToken token=" + issuePrivateToken(t, issuerKey, otherOrigin), "", ErrInvalidToken},
+		{"Unknown issuer key", "PrivateToken token=" + issuePrivateToken(t, otherKey, challenge), "", ErrInvalidToken},
+		{"Garbage token", "PrivateToken token=AAAA", "", ErrInvalidToken},
+		{"Missing permission", "PrivateToken token=" + issuePrivateToken(t, issuerKey, challenge), "connect-udp", errAny},
+		{"Bearer scheme", "Bearer abc", "", ErrInvalidScheme},
+		{"No header", "", "", ErrNoAuthHeader},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+			if tc.header != "" {
+				req.Header.Set(authHeader, tc.header)
+			}
+			if tc.protocol != "" {
+				req.Header.Set(":protocol", tc.protocol)
+			}
+			ctx, err := authenticator.Authenticate(req)
+			switch {
+			case tc.expectedError == nil && err != nil:
+				t.Errorf("Expected success, got %v", err)
+			case tc.expectedError == nil:
+				claims, ok := ClaimsFromContext(ctx)
+				if !ok || claims.Subject != "" || claims.TokenID != "" || !claims.HasPermission(PERMISSION_CONNECT_TCP) {
+					t.Errorf("Expected anonymous claims granting %s, got %+v", PERMISSION_CONNECT_TCP, claims)
+				}
+			case tc.expectedError == errAny && err == nil:
+				t.Error("Expected an error")
+			case tc.expectedError != errAny && !errors.Is(err, tc.expectedError):
+				t.Errorf("Expected %v, got %v", tc.expectedError, err)
+			}
+		})
+	}
+
+	t.Run("Challenge", func(t *testing.T) {
+		chain := NewChainAuthenticator(authenticator)
+		w := httptest.NewRecorder()
+		chain.Middleware(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil))
+		header := w.Header().Get(challengeHeader)
+		encodedChallenge := base64.RawURLEncoding.EncodeToString(challenge.Marshal())
+		if !strings.HasPrefix(header, "PrivateToken ") || !strings.Contains(header, `challenge="`+encodedChallenge+`"`) ||
+			!strings.Contains(header, `token-key="`+tokenKey+`"`) {
+			t.Errorf("Unexpected challenge %q", header)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplayCacheFull is returned when too many unexpired IDs are remembered to check another one
+var ErrReplayCacheFull = errors.New("too many recent tokens to check for replay, try again later")
+
+// ReplayCache counts how often an ID has been seen until it expires.
+// It holds at most maxEntries IDs. Expired IDs make room for new ones, but unexpired IDs are never
+// dropped: a flood of unique IDs must not push out an ID so it can be replayed.
+type ReplayCache struct {
+	mutex   sync.Mutex
+	entries map[string]*replayEntry
+	// expiries orders the entries by expiry, so making room never scans the whole cache
+	expiries   replayHeap
+	maxEntries int
+	now        func() time.Time
+}
+
+type replayEntry struct {
+	id        string
+	uses      int
+	expiresAt time.Time
+	// index is the position in the expiry heap
+	index int
+}
+
+// NewReplayCache creates a cache remembering at most maxEntries IDs
+func NewReplayCache(maxEntries int) *ReplayCache {
+	return &ReplayCache{
+		entries:    make(map[string]*replayEntry),
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+}
+
+// Use records one use of id, remembered until expiresAt, and returns how often it has been used in total.
+// It fails with ErrReplayCacheFull while the cache holds maxEntries unexpired IDs, callers must reject the ID then.
+func (c *ReplayCache) Use(id string, expiresAt time.Time) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	if entry, ok := c.entries[id]; ok {
+		if entry.expiresAt.After(now) {
+			entry.uses++
+			return entry.uses, nil
+		}
+		c.remove(entry)
+	}
+
+	c.evict(now)
+	if len(c.entries) >= c.maxEntries {
+		return 0, ErrReplayCacheFull
+	}
+	entry := &replayEntry{id: id, uses: 1, expiresAt: expiresAt}
+	c.entries[id] = entry
+	heap.Push(&c.expiries, entry)
+	return 1, nil
+}
+
+// Len returns the number of remembered IDs
+func (c *ReplayCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// evict drops expired entries
+func (c *ReplayCache) evict(now time.Time) {
+	for len(c.expiries) > 0 && !c.expiries[0].expiresAt.After(now) {
+		c.remove(c.expiries[0])
+	}
+}
+
+func (c *ReplayCache) remove(entry *replayEntry) {
+	heap.Remove(&c.expiries, entry.index)
+	delete(c.entries, entry.id)
+}
+
+// replayHeap is a min-heap of entries by expiry
+type replayHeap []*replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h replayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *replayHeap) Push(x any) {
+	entry := x.(*replayEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *replayHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token replay detection settings
+const (
+	tokenReplayMaxIDs = 100000
+	// tokenReplayDefaultTTL is how long the ID of a token without exp is remembered
+	tokenReplayDefaultTTL = 24 * time.Hour
+)
+
+var ErrTokenReused = errors.New("token has already been used")
+
+// WithReplayDetection limits how often any token may be used, tracked by its jti.
+// Tokens carrying their own limit in constraints.maxUses are always tracked, the lower limit wins.
+func WithReplayDetection(maxUses int) ValidatorOption {
+	return func(v *MultiKeyJWTValidator) {
+		v.maxTokenUses = maxUses
+	}
+}
+
+// TokenID returns the jti claim as a string, whether it was encoded as a string or a number.
+// Numbers are decoded as float64, so numeric jtis beyond 2^53 may collide; the control server issues strings.
+func TokenID(claims jwt.MapClaims) string {
+	switch jti := claims["jti"].(type) {
+	case string:
+		return jti
+	case float64:
+		return strconv.FormatFloat(jti, 'f', -1, 64)
+	case json.Number:
+		return jti.String()
+	}
+	return ""
+}
+
+// MaxUses returns the constraints.maxUses claim, 0 if the token may be used any number of times
+func MaxUses(claims jwt.MapClaims) int {
+	constraints, ok := claims["constraints"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	maxUses, ok := constraints["maxUses"].(float64)
+	if !ok || maxUses < 1 {
+		return 0
+	}
+	return int(maxUses)
+}
+
+// checkTokenUses records a use of the token in uses and rejects it once its use limit is exceeded.
+// maxUses applies to all tokens, 0 means only limits carried by the token itself are enforced.
+func checkTokenUses(claims jwt.MapClaims, maxUses int, uses *ReplayCache) error {
+	limit := maxUses
+	if tokenLimit := MaxUses(claims); tokenLimit > 0 && (limit == 0 || tokenLimit < limit) {
+		limit = tokenLimit
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	jti := TokenID(claims)
+	if jti == "" {
+		return fmt.Errorf("%w: missing jti", ErrInvalidToken)
+	}
+	expiresAt := time.Now().Add(tokenReplayDefaultTTL)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	iss, _ := claims.GetIssuer()
+
+	used, err := uses.Use(iss+":"+jti, expiresAt)
+	if err != nil {
+		return err
+	}
+	if used > limit {
+		return ErrTokenReused
+	}
+	return nil
+}
@@ -11,18 +11,30 @@ import (
 
 // Default auth configuration
 const (
-	authHeader = "Proxy-Authorization"
-	authScheme = "Bearer"
+	authHeader      = "Proxy-Authorization"
+	authScheme      = "Bearer"
+	challengeHeader = "Proxy-Authenticate"
 )
 
 // Errors
 var (
-	ErrNoAuthHeader  = errors.New("no authorization header")
-	ErrInvalidScheme = errors.New("invalid authorization scheme")
-	ErrInvalidToken  = errors.New("invalid token")
-	ErrTokenRevoked  = errors.New("token has been revoked")
+	ErrNoAuthHeader    = errors.New("no authorization header")
+	ErrNoCredentials   = errors.New("no credentials presented")
+	ErrInvalidScheme   = errors.New("invalid authorization scheme")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrTokenRevoked    = errors.New("token has been revoked")
+	ErrInvalidAudience = errors.New("token not valid for this proxy")
 )
 
+// errorStatus returns the HTTP status a request rejected with err is answered with.
+// Credentials that cannot be checked right now are not invalid, the client may retry.
+func errorStatus(err error) int {
+	if errors.Is(err, ErrReplayCacheFull) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnauthorized
+}
+
 // Authenticator defines the interface for authentication middleware
 type Authenticator interface {
 	Middleware(next http.Handler) http.Handler
@@ -19,9 +19,9 @@ type mockSingleKeyProvider struct {
 	publicKey *rsa.PublicKey
 }
 
-func (m *mockSingleKeyProvider) PublicKeys() (map[string]*rsa.PublicKey, error) {
-	return map[string]*rsa.PublicKey{
-		"1": m.publicKey,
+func (m *mockSingleKeyProvider) PublicKeys() (map[string]PublicKey, error) {
+	return map[string]PublicKey{
+		"1": {Algorithm: AlgorithmRS256, Key: m.publicKey},
 	}, nil
 }
 
@@ -188,7 +188,7 @@ func TestMultiKeyJWTValidatorPermissions(t *testing.T) {
 			})
 
 			keyProvider := &mockSingleKeyProvider{publicKey: publicKey}
-			validator := NewMultiKeyJWTValidator(keyProvider, tc.permissions)
+			validator := NewMultiKeyJWTValidator(keyProvider, StaticPermissions(tc.permissions...))
 			middleware := validator.Middleware(nextHandler)
 
 			req := httptest.NewRequest("GET", "/", nil)
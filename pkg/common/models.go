@@ -5,19 +5,46 @@
 package common
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"fmt"
 	"math/big"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/strseb/zdvv/pkg/common/auth"
 )
 
+// ServerState is the lifecycle state of a server
+type ServerState string
+
+const (
+	// ServerStatePending servers wait for an admin to approve their pairing
+	ServerStatePending ServerState = "pending"
+	// ServerStateActive servers are listed to clients
+	ServerStateActive ServerState = "active"
+	// ServerStateDraining servers are hidden from new clients but still serve existing token holders
+	ServerStateDraining ServerState = "draining"
+	// ServerStateDisabled servers are hidden and refuse new tunnels
+	ServerStateDisabled ServerState = "disabled"
+)
+
+// IsValid reports whether a registered server can be in the state, pending servers are not registered yet
+func (s ServerState) IsValid() bool {
+	return s == ServerStateActive || s == ServerStateDraining || s == ServerStateDisabled
+}
+
 type Server struct {
+	// Unique ID assigned by the control server on registration
+	ID string `json:"id"`
 	// Full URI of the endpoint Accepting CONNECT requests
 	ProxyURL string `json:"proxyUrl"`
+	// Optional fleet group the server belongs to, tokens can be scoped to a whole group
+	Group string `json:"group,omitempty"`
 	// Latitude of the server in decimal degrees.
 	Latitude float64 `json:"latitude"`
 	// Longitude of the server in decimal degrees.
@@ -37,28 +64,69 @@ type Server struct {
 	* The server will then use this token to revoke itself.
 	 */
 	RevocationToken string `json:"-"` // The - means this field will be ignored during JSON serialization
+	// Owner is the ID of the proxy credential the server was registered with, empty if it was registered
+	// with the admin secret. Only the owner may change or remove the server.
+	Owner string `json:"-"`
+	// LastHeartbeat is when the server last renewed its registration, in Unix time
+	LastHeartbeat int64 `json:"-"`
+	// ActiveConnections is the number of tunnels the server reported with its last heartbeat
+	ActiveConnections int `json:"-"`
+	// State decides whether the server is offered to clients, it is set by the control server
+	State ServerState `json:"state,omitempty"`
 }
 
 type JWTKey struct {
 	// base64 encoded public key used to verify JWT tokens
-	Kty       string `json:"kty"` // Key type, e.g., "RSA"
+	Kty       string `json:"kty"` // Key type, e.g., "RSA", "EC" or "OKP"
+	Alg       string `json:"alg"` // Signing algorithm, e.g., "RS256", "ES256" or "EdDSA"
 	PublicKey string `json:"k"`
 	Kid       string `json:"kid"` // Key ID for the public key
 	// Expiration date of the key in Unix timestamp
 	// JWT tokens can be signed with this key until it expires.
 	// If the key is expired tokens are still valid until their own expiration date.
 	ExpiresAt int64 `json:"expiresAt"` // Expiration time of the key in Unix timestamp
+	// PublishedAt is when the key was added to the key set, keys are published before they sign
+	PublishedAt int64 `json:"-"`
 
-	privateKey *rsa.PrivateKey `json:"-"`
+	privateKey crypto.Signer `json:"-"`
 }
 
 func (jwt *JWTKey) IsExpired() bool {
 	return jwt.ExpiresAt < 0 || jwt.ExpiresAt < time.Now().Unix()
 }
 
+// TokenRequest describes the claims of a token to be signed by a JWTKey.
+type TokenRequest struct {
+	Issuer string
+	// Subject identifies the end-user the token is issued to, empty for anonymous tokens
+	Subject string
+	// Audience restricts the token to the given proxy URLs or fleet groups, empty means any proxy
+	Audience []string
+	ValidFor time.Duration
+	// Permissions are granted by the space separated scope claim
+	Permissions []string
+	// LegacyClaims are additionally set as boolean claims, for proxies predating scopes
+	LegacyClaims []string
+	// Confirmation binds the token to a DPoP key by its JWK thumbprint (RFC 9449), empty means a bearer token
+	Confirmation string
+	// MaxUses limits how often the token may be used, 0 means no limit
+	MaxUses int
+	// BandwidthLimit caps the tunnel throughput in bytes per second, 0 means no limit
+	BandwidthLimit int64
+}
+
 // SignWithClaims creates and signs a JWT token with specific permissions without exposing the private key
 // Only permissions are allowed to be specified, along with standard JWT claims
 func (key *JWTKey) SignWithClaims(issuer string, validDuration time.Duration, permissions []string) (string, error) {
+	return key.Sign(TokenRequest{
+		Issuer:      issuer,
+		ValidFor:    validDuration,
+		Permissions: permissions,
+	})
+}
+
+// Sign creates and signs a JWT token for the given request without exposing the private key
+func (key *JWTKey) Sign(req TokenRequest) (string, error) {
 	// Generate a random JTI (JWT ID)
 	jti, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
 	if err != nil {
@@ -67,52 +135,115 @@ func (key *JWTKey) SignWithClaims(issuer string, validDuration time.Duration, pe
 
 	// Create the base claims
 	claims := jwt.MapClaims{
-		"iss": issuer,
-		"exp": time.Now().Add(validDuration).Unix(),
-		"jti": jti.Int64(),
+		"iss": req.Issuer,
+		"exp": time.Now().Add(req.ValidFor).Unix(),
+		// A string, JSON numbers are decoded as float64 and lose precision beyond 2^53
+		"jti": jti.String(),
 		"kid": key.Kid,
 	}
 
+	if req.Subject != "" {
+		claims["sub"] = req.Subject
+	}
+
+	switch len(req.Audience) {
+	case 0:
+	case 1:
+		claims["aud"] = req.Audience[0]
+	default:
+		claims["aud"] = req.Audience
+	}
+
+	if req.Confirmation != "" {
+		claims["cnf"] = map[string]string{"jkt": req.Confirmation}
+	}
+
+	constraints := map[string]int64{}
+	if req.MaxUses > 0 {
+		constraints["maxUses"] = int64(req.MaxUses)
+	}
+	if req.BandwidthLimit > 0 {
+		constraints["bandwidth"] = req.BandwidthLimit
+	}
+	if len(constraints) > 0 {
+		claims["constraints"] = constraints
+	}
+
 	// Add the specified permissions
-	for _, permission := range permissions {
-		claims[permission] = true
+	if len(req.Permissions) > 0 {
+		claims["scope"] = strings.Join(req.Permissions, " ")
+	}
+	for _, claim := range req.LegacyClaims {
+		claims[claim] = true
+	}
+
+	method := jwt.GetSigningMethod(key.Alg)
+	if method == nil {
+		return "", fmt.Errorf("unsupported signing algorithm %q", key.Alg)
 	}
 
 	// Create a new token with the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(method, claims)
 	token.Header["kid"] = key.Kid // Set the kid as a string in the header
 
 	// Sign the token with the private key
-	return token.SignedString(key.privateKey)
+	if key.privateKey == nil {
+		return "", fmt.Errorf("key %s has no private key", key.Kid)
+	}
+	return signJWT(token, key.privateKey)
 }
 
-func NewJWTKey() (*JWTKey, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// MarshalPrivateKey returns the private key in PKCS #8, ASN.1 DER form, for storing it encrypted.
+func (key *JWTKey) MarshalPrivateKey() ([]byte, error) {
+	if key.privateKey == nil {
+		return nil, fmt.Errorf("key %s has no private key", key.Kid)
+	}
+	return x509.MarshalPKCS8PrivateKey(key.privateKey)
+}
+
+// LoadPrivateKey sets the private key from its PKCS #8 form, it must match the public key.
+func (key *JWTKey) LoadPrivateKey(der []byte) error {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to parse private key: %w", err)
 	}
-	publicKey := &privateKey.PublicKey
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return key.SetSigner(signer)
+}
+
+// NewJWTKey creates a new RS256 signing key.
+func NewJWTKey() (*JWTKey, error) {
+	return NewJWTKeyWithAlgorithm(auth.AlgorithmRS256)
+}
 
-	// Marshal the public key to PKIX, ASN.1 DER form
-	pubBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+// NewJWTKeyWithAlgorithm creates a new signing key for the given algorithm, held in process memory.
+// An empty algorithm defaults to RS256.
+func NewJWTKeyWithAlgorithm(alg string) (*JWTKey, error) {
+	if alg == "" {
+		alg = auth.AlgorithmRS256
+	}
+	signer, err := GenerateSigner(alg)
 	if err != nil {
 		return nil, err
 	}
-
-	// Generate a random key ID as a string
-	kidInt, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
+	kid, err := NewKeyID()
 	if err != nil {
 		return nil, err
 	}
-	kidStr := kidInt.String()
+	return NewJWTKeyFromSigner(kid, alg, signer)
+}
 
-	return &JWTKey{
-		PublicKey:  base64.StdEncoding.EncodeToString(pubBytes),
-		Kid:        kidStr, // string id
-		ExpiresAt:  time.Now().Add(24 * time.Hour).Unix(),
-		privateKey: privateKey,
-		Kty:        "RSA",
-	}, nil
+// GenerateID assigns a new random ID to the server
+func (s *Server) GenerateID() (string, error) {
+	idBytes := make([]byte, 12)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	s.ID = base64.RawURLEncoding.EncodeToString(idBytes)
+	return s.ID, nil
 }
 
 func (s *Server) GenerateRevocationToken() (string, error) {
@@ -157,3 +288,39 @@ func (s *Server) IsValid() (bool, string) {
 
 	return true, ""
 }
+
+// Tier is an entitlement level, it decides what the tokens minted for its users may do
+type Tier struct {
+	// Unique name of the tier, e.g. "free" or "pro"
+	Name string `json:"name"`
+	// Permissions granted in the scope claim of minted tokens
+	Permissions []string `json:"permissions"`
+	// Lifetime of minted tokens in seconds
+	TokenTTL int64 `json:"tokenTtl"`
+	// Tunnel throughput limit in bytes per second carried in the token, 0 means unlimited
+	BandwidthLimit int64 `json:"bandwidthLimit,omitempty"`
+	// Fleet groups tokens may be used with, empty means any server
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+}
+
+// IsValid checks if the tier has valid required data
+func (t *Tier) IsValid() (bool, string) {
+	if t.Name == "" {
+		return false, "name is required"
+	}
+	if len(t.Permissions) == 0 {
+		return false, "at least one permission is required"
+	}
+	if t.TokenTTL <= 0 {
+		return false, "tokenTtl must be positive"
+	}
+	if t.BandwidthLimit < 0 {
+		return false, "bandwidthLimit must not be negative"
+	}
+	return true, ""
+}
+
+// AllowsGroup reports whether tokens of the tier may be used with servers of the given fleet group
+func (t *Tier) AllowsGroup(group string) bool {
+	return len(t.AllowedGroups) == 0 || slices.Contains(t.AllowedGroups, group)
+}
@@ -74,8 +74,8 @@ func TestJWTKeySignWithClaims(t *testing.T) {
 	}
 
 	// Check permission
-	if permit, ok := claims["connect-tcp"].(bool); !ok || !permit {
-		t.Fatalf("Expected connect-tcp to be true, got %v", claims["connect-tcp"])
+	if scope, ok := claims["scope"].(string); !ok || scope != string(auth.PERMISSION_CONNECT_TCP) {
+		t.Fatalf("Expected scope to be %s, got %v", auth.PERMISSION_CONNECT_TCP, claims["scope"])
 	}
 	// Check kid is present (float64 in JSON)
 	if kid, ok := claims["kid"]; !ok {
@@ -85,6 +85,82 @@ func TestJWTKeySignWithClaims(t *testing.T) {
 	}
 }
 
+// TestNewJWTKeyWithAlgorithm tests signing with every supported algorithm
+func TestNewJWTKeyWithAlgorithm(t *testing.T) {
+	tests := []struct {
+		alg string
+		kty string
+	}{
+		{auth.AlgorithmRS256, "RSA"},
+		{auth.AlgorithmES256, "EC"},
+		{auth.AlgorithmEdDSA, "OKP"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.alg, func(t *testing.T) {
+			key, err := NewJWTKeyWithAlgorithm(tc.alg)
+			if err != nil {
+				t.Fatalf("Failed to create JWT key: %v", err)
+			}
+			if key.Alg != tc.alg || key.Kty != tc.kty {
+				t.Fatalf("Expected alg=%s kty=%s, got alg=%s kty=%s", tc.alg, tc.kty, key.Alg, key.Kty)
+			}
+
+			token, err := key.SignWithClaims("test-issuer", time.Hour, nil)
+			if err != nil {
+				t.Fatalf("Failed to sign claims: %v", err)
+			}
+
+			parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+				keyBytes, err := base64.StdEncoding.DecodeString(key.PublicKey)
+				if err != nil {
+					return nil, err
+				}
+				return x509.ParsePKIXPublicKey(keyBytes)
+			}, jwt.WithValidMethods([]string{tc.alg}))
+			if err != nil || !parsedToken.Valid {
+				t.Fatalf("Failed to verify token: %v", err)
+			}
+			if jti, ok := parsedToken.Claims.(jwt.MapClaims)["jti"].(string); !ok || jti == "" {
+				t.Errorf("Expected a string jti, got %v", parsedToken.Claims.(jwt.MapClaims)["jti"])
+			}
+		})
+	}
+
+	t.Run("Unsupported algorithm", func(t *testing.T) {
+		if _, err := NewJWTKeyWithAlgorithm("HS256"); err == nil {
+			t.Fatal("Expected error for unsupported algorithm")
+		}
+	})
+}
+
+func TestJWTKeyPrivateKeyRoundTrip(t *testing.T) {
+	key, err := NewJWTKeyWithAlgorithm(auth.AlgorithmES256)
+	if err != nil {
+		t.Fatalf("Failed to create JWT key: %v", err)
+	}
+	der, err := key.MarshalPrivateKey()
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+
+	restored := &JWTKey{Kty: key.Kty, Alg: key.Alg, PublicKey: key.PublicKey, Kid: key.Kid, ExpiresAt: key.ExpiresAt}
+	if err := restored.LoadPrivateKey(der); err != nil {
+		t.Fatalf("Failed to load private key: %v", err)
+	}
+	if _, err := restored.SignWithClaims("test-issuer", time.Hour, nil); err != nil {
+		t.Errorf("Failed to sign with restored key: %v", err)
+	}
+
+	other, err := NewJWTKeyWithAlgorithm(auth.AlgorithmES256)
+	if err != nil {
+		t.Fatalf("Failed to create JWT key: %v", err)
+	}
+	if err := other.LoadPrivateKey(der); err == nil {
+		t.Error("Expected error loading a private key that does not match the public key")
+	}
+}
+
 // TestServerIsValid tests the IsValid method of the Server struct
 func TestServerIsValid(t *testing.T) {
 	tests := []struct {
@@ -220,3 +296,65 @@ func TestServerIsValid(t *testing.T) {
 		})
 	}
 }
+
+func TestServerStateIsValid(t *testing.T) {
+	for state, valid := range map[ServerState]bool{
+		ServerStateActive:   true,
+		ServerStateDraining: true,
+		ServerStateDisabled: true,
+		ServerStatePending:  false,
+		"":                  false,
+		"offline":           false,
+	} {
+		if state.IsValid() != valid {
+			t.Errorf("Expected IsValid()=%v for state %q", valid, state)
+		}
+	}
+}
+
+func TestTierIsValid(t *testing.T) {
+	tests := []struct {
+		name          string
+		tier          Tier
+		expectValid   bool
+		expectedError string
+	}{
+		{
+			name:        "Valid tier",
+			tier:        Tier{Name: "pro", Permissions: []string{"proxy:*"}, TokenTTL: 3600},
+			expectValid: true,
+		},
+		{
+			name:          "Missing name",
+			tier:          Tier{Permissions: []string{"proxy:*"}, TokenTTL: 3600},
+			expectedError: "name is required",
+		},
+		{
+			name:          "No permissions",
+			tier:          Tier{Name: "empty", TokenTTL: 3600},
+			expectedError: "at least one permission is required",
+		},
+		{
+			name:          "No token lifetime",
+			tier:          Tier{Name: "pro", Permissions: []string{"proxy:*"}},
+			expectedError: "tokenTtl must be positive",
+		},
+		{
+			name:          "Negative bandwidth limit",
+			tier:          Tier{Name: "pro", Permissions: []string{"proxy:*"}, TokenTTL: 3600, BandwidthLimit: -1},
+			expectedError: "bandwidthLimit must not be negative",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			valid, message := tc.tier.IsValid()
+			if valid != tc.expectValid {
+				t.Errorf("Expected valid=%v, got %v", tc.expectValid, valid)
+			}
+			if message != tc.expectedError {
+				t.Errorf("Expected message=%q, got %q", tc.expectedError, message)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package privacypass
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Parameters of RSABSSA-SHA384-PSS-Deterministic (RFC 9474), the variant used by token type 0x0002
+const (
+	keyBits    = Nk * 8
+	saltLength = sha512.Size384
+)
+
+var (
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidRSA       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSHA384    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+)
+
+// ErrInvalidSignature is returned for blind signatures and tokens that do not verify
+var ErrInvalidSignature = errors.New("invalid privacy pass signature")
+
+// pssParameters are the RSASSA-PSS-params of RFC 4055
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+// subjectPublicKeyInfo is the SPKI structure keys are encoded in
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// GenerateKey creates a new 2048 bit issuer key
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, keyBits)
+}
+
+// MarshalPublicKey encodes an issuer key as RSASSA-PSS SubjectPublicKeyInfo (RFC 9578 section 6.5)
+func MarshalPublicKey(pub *rsa.PublicKey) ([]byte, error) {
+	hash := pkix.AlgorithmIdentifier{Algorithm: oidSHA384, Parameters: asn1.NullRawValue}
+	hashDER, err := asn1.Marshal(hash)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pssParameters{
+		Hash:       hash,
+		MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: hashDER}},
+		SaltLength: saltLength,
+	})
+	if err != nil {
+		return nil, err
+	}
+	key := x509.MarshalPKCS1PublicKey(pub)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: key, BitLength: 8 * len(key)},
+	})
+}
+
+// ParsePublicKey decodes an issuer key encoded as SubjectPublicKeyInfo
+func ParsePublicKey(der []byte) (*rsa.PublicKey, error) {
+	var spki subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(der, &spki); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("%w: invalid public key", ErrMalformed)
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) && !spki.Algorithm.Algorithm.Equal(oidRSA) {
+		return nil, fmt.Errorf("%w: not an RSA key", ErrMalformed)
+	}
+	pub, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if pub.N.BitLen() != keyBits {
+		return nil, fmt.Errorf("%w: key must be %d bits", ErrMalformed, keyBits)
+	}
+	return pub, nil
+}
+
+// TokenKeyID returns the key ID tokens of the key carry: the SHA-256 of its encoding
+func TokenKeyID(pub *rsa.PublicKey) ([Nid]byte, error) {
+	der, err := MarshalPublicKey(pub)
+	if err != nil {
+		return [Nid]byte{}, err
+	}
+	return sha256.Sum256(der), nil
+}
+
+// BlindSign signs the blinded message of a token request (RFC 9474 section 4.3).
+// The issuer learns nothing about the token it signs.
+func BlindSign(key *rsa.PrivateKey, req *TokenRequest) ([]byte, error) {
+	n := key.N
+	m := new(big.Int).SetBytes(req.BlindedMessage)
+	if m.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("%w: blinded message out of range", ErrMalformed)
+	}
+
+	// Blind the exponentiation itself, math/big does not run in constant time
+	r, err := rand.Int(rand.Reader, n)
+	if err != nil {
+		return nil, err
+	}
+	rInv := new(big.Int).ModInverse(r, n)
+	if r.Sign() == 0 || rInv == nil {
+		return nil, errors.New("failed to generate blinding factor")
+	}
+	e := big.NewInt(int64(key.E))
+	blinded := new(big.Int).Mul(m, new(big.Int).Exp(r, e, n))
+	blinded.Mod(blinded, n)
+	s := new(big.Int).Exp(blinded, key.D, n)
+	s.Mul(s, rInv).Mod(s, n)
+
+	// Check the signature before releasing it, a faulty computation could leak the key
+	if new(big.Int).Exp(s, e, n).Cmp(m) != 0 {
+		return nil, ErrInvalidSignature
+	}
+	return s.FillBytes(make([]byte, Nk)), nil
+}
+
+// Verify checks the authenticator of a token against the issuer key
+func Verify(pub *rsa.PublicKey, token *Token) error {
+	keyID, err := TokenKeyID(pub)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(keyID[:], token.TokenKeyID[:]) != 1 {
+		return fmt.Errorf("%w: token key ID does not match", ErrInvalidSignature)
+	}
+	digest := sha512.Sum384(token.Input())
+	opts := &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA384}
+	if err := rsa.VerifyPSS(pub, crypto.SHA384, digest[:], token.Authenticator, opts); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// BlindState is what a client keeps between sending a token request and finalizing the token
+type BlindState struct {
+	pub   *rsa.PublicKey
+	token Token
+	rInv  *big.Int
+}
+
+// NewTokenRequest creates a token for the challenge and blinds it for the issuer (RFC 9578 section 6.1)
+func NewTokenRequest(pub *rsa.PublicKey, challenge *TokenChallenge) (*TokenRequest, *BlindState, error) {
+	keyID, err := TokenKeyID(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := &BlindState{pub: pub, token: Token{
+		TokenType:       TokenTypeBlindRSA,
+		ChallengeDigest: challenge.Digest(),
+		TokenKeyID:      keyID,
+	}}
+	if _, err := rand.Read(state.token.Nonce[:]); err != nil {
+		return nil, nil, err
+	}
+
+	encoded, err := emsaPSSEncode(state.token.Input(), keyBits-1)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := pub.N
+	m := new(big.Int).SetBytes(encoded)
+	if new(big.Int).GCD(nil, nil, m, n).Cmp(big.NewInt(1)) != 0 {
+		return nil, nil, errors.New("encoded message not invertible")
+	}
+
+	r, err := rand.Int(rand.Reader, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	state.rInv = new(big.Int).ModInverse(r, n)
+	if r.Sign() == 0 || state.rInv == nil {
+		return nil, nil, errors.New("failed to generate blinding factor")
+	}
+	x := new(big.Int).Exp(r, big.NewInt(int64(pub.E)), n)
+	z := x.Mul(m, x).Mod(x, n)
+
+	return &TokenRequest{
+		TokenType:           TokenTypeBlindRSA,
+		TruncatedTokenKeyID: keyID[Nid-1],
+		BlindedMessage:      z.FillBytes(make([]byte, Nk)),
+	}, state, nil
+}
+
+// Finalize unblinds the issuer's signature into a redeemable token
+func (s *BlindState) Finalize(blindSignature []byte) (*Token, error) {
+	if len(blindSignature) != Nk {
+		return nil, fmt.Errorf("%w: blind signature must be %d bytes", ErrMalformed, Nk)
+	}
+	z := new(big.Int).SetBytes(blindSignature)
+	sig := z.Mul(z, s.rInv).Mod(z, s.pub.N)
+
+	token := s.token
+	token.Authenticator = sig.FillBytes(make([]byte, Nk))
+	if err := Verify(s.pub, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// emsaPSSEncode encodes a message for signing with a random salt (RFC 8017 section 9.1.1)
+func emsaPSSEncode(msg []byte, emBits int) ([]byte, error) {
+	hLen := sha512.Size384
+	emLen := (emBits + 7) / 8
+	if emLen < hLen+saltLength+2 {
+		return nil, errors.New("key too small for PSS encoding")
+	}
+
+	mHash := sha512.Sum384(msg)
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	h := sha512.New384()
+	h.Write(make([]byte, 8))
+	h.Write(mHash[:])
+	h.Write(salt)
+	hash := h.Sum(nil)
+
+	em := make([]byte, emLen)
+	db := em[:emLen-hLen-1]
+	db[len(db)-saltLength-1] = 0x01
+	copy(db[len(db)-saltLength:], salt)
+	mgf1XOR(db, hash)
+	db[0] &= 0xff >> (8*emLen - emBits)
+	copy(em[emLen-hLen-1:], hash)
+	em[emLen-1] = 0xbc
+	return em, nil
+}
+
+// mgf1XOR masks out with MGF1 using SHA-384 and the given seed
+func mgf1XOR(out []byte, seed []byte) {
+	var counter [4]byte
+	done := 0
+	for done < len(out) {
+		h := sha512.New384()
+		h.Write(seed)
+		h.Write(counter[:])
+		digest := h.Sum(nil)
+		for i := 0; i < len(digest) && done < len(out); i++ {
+			out[done] ^= digest[i]
+			done++
+		}
+		for i := 3; i >= 0; i-- {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package privacypass implements the publicly verifiable Privacy Pass token type
+// (RFC 9578, token type 0x0002) based on RSA blind signatures (RFC 9474).
+// Tokens issued this way cannot be linked to their issuance by the issuer or the verifier.
+package privacypass
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// TokenTypeBlindRSA is the token type of publicly verifiable tokens using 2048 bit RSA blind signatures
+const TokenTypeBlindRSA uint16 = 0x0002
+
+// Sizes of the token type 0x0002 fields in bytes
+const (
+	Nk        = 256 // RSA modulus, blinded messages and signatures
+	NonceSize = 32
+	Nid       = sha256.Size
+)
+
+// Media types of the issuance protocol (RFC 9578)
+const (
+	DirectoryMediaType     = "application/private-token-issuer-directory"
+	TokenRequestMediaType  = "application/private-token-request"
+	TokenResponseMediaType = "application/private-token-response"
+)
+
+// DirectoryPath is where issuers publish their directory (RFC 9578 section 4)
+const DirectoryPath = "/.well-known/private-token-issuer-directory"
+
+// ErrMalformed is returned for messages that cannot be decoded
+var ErrMalformed = errors.New("malformed privacy pass message")
+
+// Directory lists the request URI and keys of an issuer
+type Directory struct {
+	IssuerRequestURI string         `json:"issuer-request-uri"`
+	TokenKeys        []DirectoryKey `json:"token-keys"`
+}
+
+// DirectoryKey is a key entry of an issuer directory
+type DirectoryKey struct {
+	TokenType uint16 `json:"token-type"`
+	// TokenKey is the base64url encoded public key as produced by MarshalPublicKey
+	TokenKey  string `json:"token-key"`
+	NotBefore int64  `json:"not-before,omitempty"`
+	// ExpiresAt is when verifiers stop accepting tokens of the key, an extension of this issuer
+	ExpiresAt int64 `json:"expires-at,omitempty"`
+}
+
+// TokenChallenge is sent by a verifier asking for a token (RFC 9577 section 2.1)
+type TokenChallenge struct {
+	TokenType         uint16
+	IssuerName        string
+	RedemptionContext []byte
+	OriginInfo        string
+}
+
+// Marshal encodes the challenge
+func (c *TokenChallenge) Marshal() []byte {
+	b := binary.BigEndian.AppendUint16(nil, c.TokenType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(c.IssuerName)))
+	b = append(b, c.IssuerName...)
+	b = append(b, uint8(len(c.RedemptionContext)))
+	b = append(b, c.RedemptionContext...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(c.OriginInfo)))
+	return append(b, c.OriginInfo...)
+}
+
+// Digest returns the challenge digest a token for this challenge must carry
+func (c *TokenChallenge) Digest() [32]byte {
+	return sha256.Sum256(c.Marshal())
+}
+
+// TokenRequest asks the issuer to sign a blinded token (RFC 9578 section 6.1)
+type TokenRequest struct {
+	TokenType           uint16
+	TruncatedTokenKeyID uint8
+	BlindedMessage      []byte
+}
+
+// Marshal encodes the token request
+func (r *TokenRequest) Marshal() []byte {
+	b := binary.BigEndian.AppendUint16(nil, r.TokenType)
+	b = append(b, r.TruncatedTokenKeyID)
+	return append(b, r.BlindedMessage...)
+}
+
+// UnmarshalTokenRequest decodes a token request of token type 0x0002
+func UnmarshalTokenRequest(data []byte) (*TokenRequest, error) {
+	if len(data) != 3+Nk {
+		return nil, fmt.Errorf("%w: token request must be %d bytes", ErrMalformed, 3+Nk)
+	}
+	req := &TokenRequest{
+		TokenType:           binary.BigEndian.Uint16(data),
+		TruncatedTokenKeyID: data[2],
+		BlindedMessage:      data[3:],
+	}
+	if req.TokenType != TokenTypeBlindRSA {
+		return nil, fmt.Errorf("%w: unsupported token type %#04x", ErrMalformed, req.TokenType)
+	}
+	return req, nil
+}
+
+// Token is a redeemable token (RFC 9577 section 2.2)
+type Token struct {
+	TokenType       uint16
+	Nonce           [NonceSize]byte
+	ChallengeDigest [32]byte
+	TokenKeyID      [Nid]byte
+	Authenticator   []byte
+}
+
+// Input returns the message the authenticator signs: all token fields before it
+func (t *Token) Input() []byte {
+	b := binary.BigEndian.AppendUint16(nil, t.TokenType)
+	b = append(b, t.Nonce[:]...)
+	b = append(b, t.ChallengeDigest[:]...)
+	return append(b, t.TokenKeyID[:]...)
+}
+
+// Marshal encodes the token
+func (t *Token) Marshal() []byte {
+	return append(t.Input(), t.Authenticator...)
+}
+
+// UnmarshalToken decodes a token of token type 0x0002
+func UnmarshalToken(data []byte) (*Token, error) {
+	inputLen := 2 + NonceSize + 32 + Nid
+	if len(data) != inputLen+Nk {
+		return nil, fmt.Errorf("%w: token must be %d bytes", ErrMalformed, inputLen+Nk)
+	}
+	t := &Token{TokenType: binary.BigEndian.Uint16(data)}
+	if t.TokenType != TokenTypeBlindRSA {
+		return nil, fmt.Errorf("%w: unsupported token type %#04x", ErrMalformed, t.TokenType)
+	}
+	data = data[2:]
+	data = data[copy(t.Nonce[:], data):]
+	data = data[copy(t.ChallengeDigest[:], data):]
+	data = data[copy(t.TokenKeyID[:], data):]
+	t.Authenticator = data
+	return t, nil
+}
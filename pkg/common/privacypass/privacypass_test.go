@@ -0,0 +1,115 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package privacypass
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestIssuance(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	challenge := &TokenChallenge{
+		TokenType:  TokenTypeBlindRSA,
+		IssuerName: "issuer.example",
+		OriginInfo: "proxy.example",
+	}
+
+	req, state, err := NewTokenRequest(&key.PublicKey, challenge)
+	if err != nil {
+		t.Fatalf("Failed to create token request: %v", err)
+	}
+	// The issuer only ever sees the encoded request
+	decoded, err := UnmarshalTokenRequest(req.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to decode token request: %v", err)
+	}
+	keyID, _ := TokenKeyID(&key.PublicKey)
+	if decoded.TruncatedTokenKeyID != keyID[Nid-1] {
+		t.Errorf("Expected truncated key ID %d, got %d", keyID[Nid-1], decoded.TruncatedTokenKeyID)
+	}
+	blindSig, err := BlindSign(key, decoded)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	token, err := state.Finalize(blindSig)
+	if err != nil {
+		t.Fatalf("Failed to finalize token: %v", err)
+	}
+	if bytes.Contains(token.Marshal(), decoded.BlindedMessage) || bytes.Equal(token.Authenticator, blindSig) {
+		t.Error("Token must not reveal the blinded message or blind signature")
+	}
+
+	redeemed, err := UnmarshalToken(token.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+	if redeemed.ChallengeDigest != challenge.Digest() {
+		t.Error("Token is not bound to the challenge")
+	}
+	if err := Verify(&key.PublicKey, redeemed); err != nil {
+		t.Errorf("Expected token to verify: %v", err)
+	}
+
+	t.Run("Tampered nonce", func(t *testing.T) {
+		tampered := *redeemed
+		tampered.Nonce[0] ^= 1
+		if err := Verify(&key.PublicKey, &tampered); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature, got %v", err)
+		}
+	})
+
+	t.Run("Other key", func(t *testing.T) {
+		other, err := GenerateKey()
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		if err := Verify(&other.PublicKey, redeemed); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature, got %v", err)
+		}
+	})
+
+	t.Run("Wrong blind signature", func(t *testing.T) {
+		bad := bytes.Clone(blindSig)
+		bad[Nk-1] ^= 1
+		if _, err := state.Finalize(bad); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature, got %v", err)
+		}
+	})
+}
+
+func TestPublicKeyEncoding(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	parsed, err := ParsePublicKey(der)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	if !parsed.Equal(&key.PublicKey) {
+		t.Error("Parsed key does not match")
+	}
+	if _, err := ParsePublicKey([]byte("garbage")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestTokenChallengeMarshal(t *testing.T) {
+	challenge := &TokenChallenge{TokenType: TokenTypeBlindRSA, IssuerName: "ab", RedemptionContext: []byte{1}, OriginInfo: "c"}
+	want := []byte{0x00, 0x02, 0x00, 0x02, 'a', 'b', 0x01, 0x01, 0x00, 0x01, 'c'}
+	if got := challenge.Marshal(); !bytes.Equal(got, want) {
+		t.Errorf("Expected %x, got %x", want, got)
+	}
+}
@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// GenerateSigner creates a new private key for the given algorithm in process memory.
+func GenerateSigner(alg string) (crypto.Signer, error) {
+	switch alg {
+	case auth.AlgorithmRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case auth.AlgorithmES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case auth.AlgorithmEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// NewKeyID returns a random key ID.
+func NewKeyID() (string, error) {
+	kidInt, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
+	if err != nil {
+		return "", err
+	}
+	return kidInt.String(), nil
+}
+
+// NewJWTKeyFromSigner creates a signing key for a private key held elsewhere, e.g. in an HSM.
+// The signer must hold a key matching the algorithm.
+func NewJWTKeyFromSigner(kid string, alg string, signer crypto.Signer) (*JWTKey, error) {
+	var kty string
+	switch public := signer.Public().(type) {
+	case *rsa.PublicKey:
+		kty = "RSA"
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", public.Curve.Params().Name)
+		}
+		kty = "EC"
+	case ed25519.PublicKey:
+		kty = "OKP"
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+	if expected := map[string]string{auth.AlgorithmRS256: "RSA", auth.AlgorithmES256: "EC", auth.AlgorithmEdDSA: "OKP"}[alg]; expected != kty {
+		return nil, fmt.Errorf("%s key cannot be used with algorithm %q", kty, alg)
+	}
+
+	// Marshal the public key to PKIX, ASN.1 DER form
+	pubBytes, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTKey{
+		PublicKey:   base64.StdEncoding.EncodeToString(pubBytes),
+		Kid:         kid,
+		ExpiresAt:   time.Now().Add(24 * time.Hour).Unix(),
+		PublishedAt: time.Now().Unix(),
+		privateKey:  signer,
+		Kty:         kty,
+		Alg:         alg,
+	}, nil
+}
+
+// SetSigner sets the signer holding the private key, it must match the public key.
+func (key *JWTKey) SetSigner(signer crypto.Signer) error {
+	pubBytes, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	if base64.StdEncoding.EncodeToString(pubBytes) != key.PublicKey {
+		return fmt.Errorf("private key does not match the public key of %s", key.Kid)
+	}
+	key.privateKey = signer
+	return nil
+}
+
+// ecdsaSignature is the ASN.1 form of ECDSA signatures returned by crypto.Signer
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// signJWT signs a token with any crypto.Signer. The jwt library only signs with the concrete RSA and
+// ECDSA key types, keys in an HSM are only reachable through crypto.Signer.
+func signJWT(token *jwt.Token, signer crypto.Signer) (string, error) {
+	signingString, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+
+	var signature []byte
+	switch token.Method.Alg() {
+	case auth.AlgorithmRS256:
+		digest := sha256.Sum256([]byte(signingString))
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case auth.AlgorithmES256:
+		digest := sha256.Sum256([]byte(signingString))
+		var der []byte
+		if der, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			break
+		}
+		// JWS uses the fixed size concatenation of r and s (RFC 7518 section 3.4)
+		var parsed ecdsaSignature
+		if _, err = asn1.Unmarshal(der, &parsed); err != nil {
+			break
+		}
+		if parsed.R == nil || parsed.S == nil || parsed.R.BitLen() > 256 || parsed.S.BitLen() > 256 {
+			return "", fmt.Errorf("invalid ECDSA signature")
+		}
+		signature = make([]byte, 64)
+		parsed.R.FillBytes(signature[:32])
+		parsed.S.FillBytes(signature[32:])
+	case auth.AlgorithmEdDSA:
+		signature, err = signer.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	default:
+		return "", fmt.Errorf("unsupported signing algorithm %q", token.Method.Alg())
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signingString + "." + token.EncodeSegment(signature), nil
+}
@@ -0,0 +1,70 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package common
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/strseb/zdvv/pkg/common/auth"
+)
+
+// opaqueSigner hides the concrete key type, like a key held by an HSM
+type opaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (s opaqueSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func TestNewJWTKeyFromSigner(t *testing.T) {
+	for _, alg := range []string{auth.AlgorithmRS256, auth.AlgorithmES256, auth.AlgorithmEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			signer, err := GenerateSigner(alg)
+			if err != nil {
+				t.Fatalf("Failed to generate key: %v", err)
+			}
+			key, err := NewJWTKeyFromSigner("kid-1", alg, opaqueSigner{signer})
+			if err != nil {
+				t.Fatalf("Failed to create JWT key: %v", err)
+			}
+
+			token, err := key.SignWithClaims("test-issuer", time.Hour, nil)
+			if err != nil {
+				t.Fatalf("Failed to sign claims: %v", err)
+			}
+			parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+				keyBytes, err := base64.StdEncoding.DecodeString(key.PublicKey)
+				if err != nil {
+					return nil, err
+				}
+				return x509.ParsePKIXPublicKey(keyBytes)
+			}, jwt.WithValidMethods([]string{alg}))
+			if err != nil || !parsedToken.Valid {
+				t.Fatalf("Failed to verify token: %v", err)
+			}
+		})
+	}
+
+	t.Run("Algorithm mismatch", func(t *testing.T) {
+		signer, err := GenerateSigner(auth.AlgorithmES256)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		if _, err := NewJWTKeyFromSigner("kid-1", auth.AlgorithmRS256, signer); err == nil {
+			t.Error("Expected error for an EC key used with RS256")
+		}
+	})
+}